@@ -75,8 +75,16 @@ func (gb *GraphBroker) Fanout(input GraphReceiver) {
 				"msgid":     in.MsgID(),
 			}).Debug("Received new graph, sending to all subscribers")
 
-			i := 1
+			// Copy the subscriber list first, as it may change while sending
+			gb.lock.RLock()
+			subs := make(map[GraphReceiver]GraphSender, len(gb.subs))
 			for k, c := range gb.subs {
+				subs[k] = c
+			}
+			gb.lock.RUnlock()
+
+			i := 1
+			for k, c := range subs {
 				log.WithFields(log.Fields{
 					"system":    "broker",
 					"broker-id": gb.id,
@@ -104,7 +104,7 @@ MenuLoop:
 				if resp.StatusCode >= 200 && resp.StatusCode <= 300 {
 					fmt.Printf("Message accepted (HTTP code %v), msgid %v\n", resp.StatusCode, string(bod))
 				} else {
-					fmt.Printf("Message was rejected with HTTP code %v and message %v\n", resp.StatusCode, string(bod))
+					printRejection(os.Stdout, resp.StatusCode, bod)
 				}
 				break MenuLoop
 
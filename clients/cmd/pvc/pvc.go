@@ -8,6 +8,7 @@ import (
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
 	"github.com/pipeviz/pipeviz/types/semantic"
 )
 
@@ -85,6 +86,26 @@ func validateAndPrint(w io.Writer, v interface{}) {
 	}
 }
 
+// printRejection renders the error document in the body of a response from
+// the ingestor that rejected a message.
+func printRejection(w io.Writer, status int, body []byte) {
+	doc := errdoc.Parse(status, body)
+	fmt.Fprintf(w, "Message was rejected with HTTP code %v. Errors:\n", status)
+	for _, e := range doc.Errors {
+		if e.Section != "" {
+			fmt.Fprintf(w, "\t%s: %s", e.Section, e.Message)
+		} else {
+			fmt.Fprintf(w, "\t%s", e.Message)
+		}
+		if e.Keyword != "" {
+			fmt.Fprintf(w, " (%s: %s)", e.Code, e.Keyword)
+		} else if e.Code != "" {
+			fmt.Fprintf(w, " (%s)", e.Code)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
 func runCreate(cmd *cobra.Command, args []string) {
 	// Create the root runner
 	//cr := &cliRunner{
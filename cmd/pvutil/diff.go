@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/pipeviz/pipeviz/history"
+	"github.com/pipeviz/pipeviz/mlog/boltdb"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/snapshot"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func diffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [-f|--from <msgid>] [-t|--to <msgid>] <mlog>",
+		Short: "Shows the changes to the graph between two messages in a bolt mlog file.",
+		Long: `Builds the graph as it existed immediately after each of the two given msgids were merged,
+then prints the vertices and edges that were added, removed or changed between them. The mlog cannot be in use by a running pipeviz daemon.`,
+		Run: runDiff,
+	}
+
+	cmd.Flags().Uint64P("from", "f", 0, "The msgid of the older graph. Defaults to the empty graph.")
+	cmd.Flags().Uint64P("to", "t", 0, "The msgid of the newer graph. Defaults to the last message in the mlog.")
+	cmd.Flags().StringP("snapshots", "s", "", "Path to a directory of graph snapshots to speed up graph construction.")
+	cmd.Flags().Bool("json", false, "Print the diff as JSON, in the same form as the webapp's /diff endpoint.")
+
+	return cmd
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		erro.Fatalln("Must provide exactly one mlog file to diff.")
+	}
+
+	j, err := boltdb.NewReadOnlyBoltStore(args[0])
+	if err != nil {
+		erro.Fatalf("Failed to open mlog at %v: %v\n", args[0], err)
+	}
+
+	var sd *snapshot.Dir
+	if path := cmd.Flags().Lookup("snapshots").Value.String(); path != "" {
+		if sd, err = snapshot.NewDir(path); err != nil {
+			erro.Fatalf("Failed to open snapshot directory: %v\n", err)
+		}
+	}
+
+	from, _ := strconv.ParseUint(cmd.Flags().Lookup("from").Value.String(), 10, 64)
+	to, _ := strconv.ParseUint(cmd.Flags().Lookup("to").Value.String(), 10, 64)
+	if !cmd.Flags().Lookup("to").Changed {
+		if to, err = j.Count(); err != nil {
+			erro.Fatalf("Failed to count records in mlog: %v\n", err)
+		}
+	}
+
+	hb := history.NewBuilder(j, sd)
+	fg, err := hb.AtMsgID(from)
+	if err != nil {
+		erro.Fatalf("Failed to build graph at msgid %d: %v\n", from, err)
+	}
+	tg, err := hb.AtMsgID(to)
+	if err != nil {
+		erro.Fatalf("Failed to build graph at msgid %d: %v\n", to, err)
+	}
+
+	d := represent.Diff(fg, tg)
+
+	if cmd.Flags().Lookup("json").Changed {
+		printDiffJSON(d)
+	} else {
+		printDiff(d)
+	}
+}
+
+func printDiffJSON(d represent.GraphDiff) {
+	out, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		erro.Fatalf("Failed to marshal diff to JSON: %v\n", err)
+	}
+
+	os.Stdout.Write(out)
+	fmt.Println()
+}
+
+func printDiff(d represent.GraphDiff) {
+	fmt.Printf("diff msgid %d..%d\n", d.From, d.To)
+	if d.Empty() {
+		fmt.Println("no changes")
+		return
+	}
+
+	for _, v := range d.VerticesAdded {
+		fmt.Printf("+ vertex %d (%s)\n", v.ID, v.VType)
+		printPropMap("+", v.Props)
+	}
+	for _, v := range d.VerticesRemoved {
+		fmt.Printf("- vertex %d (%s)\n", v.ID, v.VType)
+		printPropMap("-", v.Props)
+	}
+	for _, v := range d.VerticesChanged {
+		fmt.Printf("~ vertex %d (%s)\n", v.ID, v.VType)
+		for _, pc := range v.Props {
+			if pc.Old != nil {
+				fmt.Printf("\t- %s: %v (msgsrc %d)\n", pc.Key, pc.Old.Value, pc.Old.MsgSrc)
+			}
+			if pc.New != nil {
+				fmt.Printf("\t+ %s: %v (msgsrc %d)\n", pc.Key, pc.New.Value, pc.New.MsgSrc)
+			}
+		}
+	}
+
+	for _, e := range d.EdgesAdded {
+		fmt.Printf("+ edge %d (%s): %d -> %d\n", e.ID, e.EType, e.Source, e.Target)
+	}
+	for _, e := range d.EdgesRemoved {
+		fmt.Printf("- edge %d (%s): %d -> %d\n", e.ID, e.EType, e.Source, e.Target)
+	}
+	for _, e := range d.EdgesChanged {
+		fmt.Printf("~ edge %d (%s): %d -> %d\n", e.ID, e.EType, e.Source, e.Target)
+		printPropMap("", e.Props)
+	}
+}
+
+func printPropMap(prefix string, props map[string]system.Property) {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf("\t%s %s: %v (msgsrc %d)\n", prefix, k, props[k].Value, props[k].MsgSrc)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
 )
 
 func fixrCommand() *cobra.Command {
@@ -105,7 +106,7 @@ FileLoop:
 				}
 				resp.Body.Close()
 
-				fmt.Printf("%v, msgid %v\n", resp.StatusCode, string(bod))
+				printResponse(resp.StatusCode, bod)
 				continue FileLoop
 			case "q", "quit":
 				fmt.Printf("Quitting...\n")
@@ -137,6 +138,28 @@ func runFixrBatch(cmd *cobra.Command, files []fileInfo) {
 		}
 		resp.Body.Close()
 
-		fmt.Printf("%v, msgid %v\n", resp.StatusCode, string(bod))
+		printResponse(resp.StatusCode, bod)
+	}
+}
+
+// printResponse reports the outcome of sending a fixture: the msgid if it was
+// accepted, or the errors from the ingestor if not.
+func printResponse(status int, body []byte) {
+	if status >= 200 && status < 300 {
+		fmt.Printf("%v, msgid %v\n", status, string(body))
+		return
+	}
+
+	fmt.Printf("%v, rejected\n", status)
+	for _, e := range errdoc.Parse(status, body).Errors {
+		loc := e.Section
+		if loc == "" {
+			loc = "(message)"
+		}
+		fmt.Printf("    %s [%s", loc, e.Code)
+		if e.Keyword != "" {
+			fmt.Printf(" %s", e.Keyword)
+		}
+		fmt.Printf("]: %s\n", e.Message)
 	}
 }
@@ -12,8 +12,11 @@ var erro = log.New(os.Stderr, "", 0)
 
 func main() {
 	root := &cobra.Command{Use: "pvutil"}
+	root.AddCommand(diffCommand())
 	root.AddCommand(dotDumperCommand())
 	root.AddCommand(fixrCommand())
+	root.AddCommand(queryCommand())
+	root.AddCommand(snapshotCommand())
 	root.AddCommand(validateCommand())
 	root.Execute()
 }
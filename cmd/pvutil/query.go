@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/pipeviz/pipeviz/history"
+	"github.com/pipeviz/pipeviz/mlog/boltdb"
+	"github.com/pipeviz/pipeviz/represent/q"
+)
+
+func queryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query [-m|--msgid <msgid>] <mlog> [<query-file>]",
+		Short: "Runs a JSON graph query against a bolt mlog file.",
+		Long: `Builds the graph from the given bolt mlog file, then runs a JSON query against it and prints the result.
+The query is read from the query file if one is given, otherwise from stdin. The query language is the same as that accepted by the webapp's /query endpoint.
+The mlog cannot be in use by a running pipeviz daemon.`,
+		Run: runQuery,
+	}
+
+	cmd.Flags().Uint64P("msgid", "m", 0, "Query the graph as it was after this message was merged. Defaults to the last message in the mlog.")
+
+	return cmd
+}
+
+func runQuery(cmd *cobra.Command, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		erro.Fatalln("Must provide an mlog file, and optionally a query file.")
+	}
+
+	var in io.Reader = os.Stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			erro.Fatalf("Failed to open query file: %v\n", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	qry, err := q.ParseQuery(in)
+	if err != nil {
+		erro.Fatalf("Invalid query: %v\n", err)
+	}
+
+	j, err := boltdb.NewReadOnlyBoltStore(args[0])
+	if err != nil {
+		erro.Fatalf("Failed to open mlog at %v: %v\n", args[0], err)
+	}
+
+	msgid, _ := strconv.ParseUint(cmd.Flags().Lookup("msgid").Value.String(), 10, 64)
+	if !cmd.Flags().Lookup("msgid").Changed {
+		if msgid, err = j.Count(); err != nil {
+			erro.Fatalf("Failed to count records in mlog: %v\n", err)
+		}
+	}
+
+	g, err := history.NewBuilder(j, nil).AtMsgID(msgid)
+	if err != nil {
+		erro.Fatalf("Failed to build graph at msgid %d: %v\n", msgid, err)
+	}
+
+	out, err := json.MarshalIndent(qry.Run(g), "", "    ")
+	if err != nil {
+		erro.Fatalf("Failed to marshal query result to JSON: %v\n", err)
+	}
+
+	os.Stdout.Write(out)
+	fmt.Println()
+}
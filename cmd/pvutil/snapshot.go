@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog/boltdb"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/snapshot"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func snapshotCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Creates, inspects, and verifies pipeviz graph snapshots.",
+		Long:  `Graph snapshots allow a pipeviz daemon to restore its graph on startup without replaying the entire mlog. These subcommands operate on snapshot files directly.`,
+	}
+
+	create := &cobra.Command{
+		Use:   "create [-o|--output <dir>] <mlog>",
+		Short: "Creates a snapshot from a bolt mlog file.",
+		Long:  `Replays all the records in the given bolt mlog file into a new graph, then writes a snapshot of that graph into the output directory. The mlog cannot be in use by a running pipeviz daemon.`,
+		Run:   runSnapshotCreate,
+	}
+	create.Flags().StringP("output", "o", "snapshots", "Directory into which the snapshot will be written.")
+
+	inspect := &cobra.Command{
+		Use:   "inspect <file>...",
+		Short: "Prints summary information about snapshot files.",
+		Run:   runSnapshotInspect,
+	}
+
+	verify := &cobra.Command{
+		Use:   "verify [-m|--mlog <mlog>] <file>...",
+		Short: "Verifies the integrity of snapshot files.",
+		Long:  `Verifies that snapshot files are intact and decodable. If a bolt mlog file is provided, each snapshot is also compared against a graph built by replaying the mlog up to the snapshot's msgid.`,
+		Run:   runSnapshotVerify,
+	}
+	verify.Flags().StringP("mlog", "m", "", "Path to a bolt mlog file to verify snapshot contents against.")
+
+	cmd.AddCommand(create, inspect, verify)
+	return cmd
+}
+
+func runSnapshotCreate(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		erro.Fatalln("Must provide exactly one mlog file to create a snapshot from.")
+	}
+
+	j, err := boltdb.NewReadOnlyBoltStore(args[0])
+	if err != nil {
+		erro.Fatalf("Failed to open mlog at %v: %v\n", args[0], err)
+	}
+
+	tot, err := j.Count()
+	if err != nil {
+		erro.Fatalf("Failed to count records in mlog: %v\n", err)
+	}
+
+	g, err := ingest.Replay(represent.NewGraph(), j.Get, tot)
+	if err != nil {
+		erro.Fatalf("Failed to replay mlog: %v\n", err)
+	}
+
+	sd, err := snapshot.NewDir(cmd.Flags().Lookup("output").Value.String())
+	if err != nil {
+		erro.Fatalf("Failed to prepare snapshot directory: %v\n", err)
+	}
+
+	info, err := sd.Write(g)
+	if err != nil {
+		erro.Fatalf("Failed to write snapshot: %v\n", err)
+	}
+
+	fmt.Printf("Wrote snapshot of graph at msgid %v to %v\n", info.MsgID, info.Path)
+}
+
+func runSnapshotInspect(cmd *cobra.Command, args []string) {
+	var failed bool
+	for _, path := range args {
+		g, info, err := snapshot.Read(path)
+		if err != nil {
+			failed = true
+			erro.Printf("%v: %v\n", path, err)
+			continue
+		}
+
+		var edges int
+		vtv := g.VerticesWith(q.Qbv())
+		for _, vt := range vtv {
+			edges += vt.OutEdges.Size()
+		}
+
+		fmt.Printf("%v:\n\tmsgid: %d\n\tsize: %d bytes\n\tchecksum: %08x\n\tvertices: %d\n\tedges: %d\n",
+			path, info.MsgID, info.Size, info.Checksum, len(vtv), edges)
+
+		counts := make(map[system.VType]int)
+		for _, vt := range vtv {
+			counts[vt.Vertex.Typ()]++
+		}
+		for typ, n := range counts {
+			fmt.Printf("\t\t%s: %d\n", typ, n)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runSnapshotVerify(cmd *cobra.Command, args []string) {
+	var get func(uint64) (system.CoreGraph, error)
+	if path := cmd.Flags().Lookup("mlog").Value.String(); path != "" {
+		j, err := boltdb.NewReadOnlyBoltStore(path)
+		if err != nil {
+			erro.Fatalf("Failed to open mlog at %v: %v\n", path, err)
+		}
+
+		get = func(msgid uint64) (system.CoreGraph, error) {
+			return ingest.Replay(represent.NewGraph(), j.Get, msgid)
+		}
+	}
+
+	var failed bool
+	for _, path := range args {
+		g, info, err := snapshot.Read(path)
+		if err != nil {
+			failed = true
+			fmt.Printf("%v: INVALID: %v\n", path, err)
+			continue
+		}
+
+		if get != nil {
+			rg, err := get(info.MsgID)
+			if err != nil {
+				failed = true
+				fmt.Printf("%v: could not replay mlog to msgid %d: %v\n", path, info.MsgID, err)
+				continue
+			}
+
+			if !sameGraph(g, rg) {
+				failed = true
+				fmt.Printf("%v: MISMATCH: snapshot differs from mlog replay at msgid %d\n", path, info.MsgID)
+				continue
+			}
+		}
+
+		fmt.Printf("%v: OK (msgid %d)\n", path, info.MsgID)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// sameGraph compares two graphs by way of their (canonical) snapshot encoding.
+func sameGraph(g1, g2 system.CoreGraph) bool {
+	var b1, b2 bytes.Buffer
+	if represent.WriteSnapshot(&b1, g1) != nil || represent.WriteSnapshot(&b2, g2) != nil {
+		return false
+	}
+
+	return bytes.Equal(b1.Bytes(), b2.Bytes())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/spf13/cobra"
 	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/ingest"
 	"github.com/pipeviz/pipeviz/schema"
 )
 
@@ -15,13 +17,14 @@ const (
 	FileReadFail = 1 << iota
 	ValidationFail
 	ValidationError
+	SemanticFail
 )
 
 func validateCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "validate <dir>...",
 		Short: "Reads JSON message fixtures from a directory and validates them against the master schema.",
-		Long:  `Given one or more directories containing a set of JSON pipeviz message fixtures, validates each of those messages against the master schema and reports any failures.`,
+		Long:  `Given one or more directories containing a set of JSON pipeviz message fixtures, validates each of those messages against the master schema, then checks those that pass for semantic errors the schema cannot express, such as malformed sha1s. Reports any failures.`,
 		Run:   runValidate,
 	}
 
@@ -68,6 +71,17 @@ func runValidate(cmd *cobra.Command, args []string) {
 					for _, desc := range result.Errors() {
 						fmt.Printf("\t%s\n", desc)
 					}
+					continue
+				}
+
+				m := ingest.Message{}
+				json.Unmarshal(src, &m)
+				if serrs := m.Validate(); len(serrs) > 0 {
+					errors |= SemanticFail
+					fmt.Printf("Semantic errors in %v/%v:\n", dir, f.Name())
+					for _, e := range serrs {
+						fmt.Printf("\t%s\n", e)
+					}
 				} else {
 					fmt.Printf("%v/%v successfully validated\n", dir, f.Name())
 				}
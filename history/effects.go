@@ -0,0 +1,63 @@
+package history
+
+import (
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Effects describes what merging a single message did to the graph.
+type Effects struct {
+	// The changes between the graph immediately before the message was
+	// merged, and immediately after. Vertices and edges the message merely
+	// reaffirmed appear as changed, as their properties' MsgSrc is updated.
+	represent.GraphDiff
+	// Edge specs from the message that could not be resolved, and were held
+	// as orphans for later merges.
+	Orphans []represent.Orphan `json:"orphans"`
+}
+
+// Effects determines the effects of merging the message with the given id, by
+// comparing the graph before the merge with the graph after it. The later graph
+// is made by merging just that message into the earlier one.
+func (b *Builder) Effects(id uint64) (*Effects, error) {
+	tot, err := b.mlog.Count()
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 || id > tot {
+		return nil, ErrOutOfRange
+	}
+
+	from, err := b.AtMsgID(id - 1)
+	if err != nil {
+		return nil, err
+	}
+	to, err := ingest.Replay(from, b.mlog.Get, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stepping through effects one message at a time can then start from here
+	b.lock.Lock()
+	b.last = to
+	b.lock.Unlock()
+
+	return MergeEffects(from, to), nil
+}
+
+// MergeEffects determines the effects of merging a single message, given the
+// graph immediately before the merge and immediately after.
+func MergeEffects(from, to system.CoreGraph) *Effects {
+	e := &Effects{
+		GraphDiff: represent.Diff(from, to),
+		Orphans:   []represent.Orphan{},
+	}
+	for _, o := range represent.Orphans(to) {
+		if o.MsgID == to.MsgID() {
+			e.Orphans = append(e.Orphans, o)
+		}
+	}
+
+	return e
+}
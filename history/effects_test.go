@@ -0,0 +1,75 @@
+package history
+
+import "testing"
+
+func TestEffects(t *testing.T) {
+	b := NewBuilder(fixtureLog(t), nil)
+
+	// Message 2 declares logic states referring to commits that do not
+	// arrive until message 3.
+	e, err := b.Effects(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.From != 1 || e.To != 2 {
+		t.Errorf("Expected effects to span msgids 1 to 2, got %v to %v", e.From, e.To)
+	}
+	if len(e.VerticesAdded) == 0 {
+		t.Error("Expected message 2 to add vertices")
+	}
+	for _, v := range e.VerticesAdded {
+		if v.VType != "logic-state" {
+			t.Errorf("Message 2 should only add logic states, but added %v", v.VType)
+		}
+	}
+	if len(e.VerticesRemoved) != 0 || len(e.EdgesRemoved) != 0 {
+		t.Error("Message 2 should not remove anything")
+	}
+	if len(e.Orphans) == 0 {
+		t.Error("Expected message 2 to leave orphaned edge specs")
+	}
+	for _, o := range e.Orphans {
+		if o.MsgID != 2 {
+			t.Errorf("Only orphans from message 2 should be reported, got one from %v", o.MsgID)
+		}
+	}
+
+	// Message 3 resolves them, but has no orphans of its own
+	e, err = b.Effects(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Orphans) != 0 {
+		t.Errorf("Expected message 3 to have no orphans, got %v", len(e.Orphans))
+	}
+	var resolved bool
+	for _, ed := range e.EdgesAdded {
+		if ed.EType == "version" {
+			resolved = true
+		}
+	}
+	if !resolved {
+		t.Error("Expected message 3 to add edges from logic states to commits")
+	}
+
+	for _, id := range []uint64{0, 9} {
+		if _, err := b.Effects(id); err != ErrOutOfRange {
+			t.Errorf("Expected ErrOutOfRange for msgid %v, got %v", id, err)
+		}
+	}
+}
+
+func TestEffectsReplaysOnce(t *testing.T) {
+	cs := &countingStore{Store: fixtureLog(t), gets: make(map[uint64]int)}
+	b := NewBuilder(cs, nil)
+
+	// Each step builds on the graph from the last, merging only one record
+	for id := uint64(1); id <= 8; id++ {
+		if _, err := b.Effects(id); err != nil {
+			t.Fatal(err)
+		}
+		if n := cs.total(t); n != 1 {
+			t.Errorf("Expected the effects of msgid %v to merge only that record, but %v were retrieved", id, n)
+		}
+	}
+}
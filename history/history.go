@@ -0,0 +1,140 @@
+// Package history reconstructs the pipeviz graph as it existed at some point
+// in the past - either immediately after a given message was merged, or as of
+// a wall-clock time.
+//
+// Past graphs are built by loading the newest usable snapshot (if any), then
+// replaying mlog records on top of it up to the requested point.
+package history
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/snapshot"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// ErrOutOfRange is returned when a graph is requested for a msgid that does
+// not (yet) exist in the mlog.
+var ErrOutOfRange = errors.New("requested msgid is beyond the end of the mlog")
+
+// Builder constructs historical graphs from a mlog and, optionally, a
+// directory of snapshots. It is safe for concurrent use.
+type Builder struct {
+	mlog  mlog.Store
+	snaps *snapshot.Dir
+
+	// The most recently built graph is kept around; requests for the same or a
+	// slightly later msgid (a common pattern when stepping through history) can
+	// then start from it instead of from a snapshot.
+	lock sync.Mutex
+	last system.CoreGraph
+}
+
+// NewBuilder creates a Builder that reads from the provided mlog. The snapshot
+// directory may be nil, in which case every graph is built by replaying the
+// mlog from the beginning.
+func NewBuilder(j mlog.Store, sd *snapshot.Dir) *Builder {
+	return &Builder{
+		mlog:  j,
+		snaps: sd,
+	}
+}
+
+// AtMsgID returns the graph as it existed immediately after the message with
+// the provided id was merged. An id of 0 yields an empty graph.
+func (b *Builder) AtMsgID(id uint64) (system.CoreGraph, error) {
+	tot, err := b.mlog.Count()
+	if err != nil {
+		return nil, err
+	}
+	if id > tot {
+		return nil, ErrOutOfRange
+	}
+
+	start := b.base(id)
+	if start.MsgID() == id {
+		return start, nil
+	}
+
+	g, err := ingest.Replay(start, b.mlog.Get, id)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.last = g
+	b.lock.Unlock()
+
+	return g, nil
+}
+
+// base returns the latest graph from which the graph at the provided id can be
+// built by replaying: the cached graph, the newest snapshot, or, failing
+// those, an empty graph.
+func (b *Builder) base(id uint64) system.CoreGraph {
+	b.lock.Lock()
+	start := b.last
+	b.lock.Unlock()
+
+	if start == nil || start.MsgID() > id {
+		start = represent.NewGraph()
+	}
+
+	if b.snaps != nil && id > start.MsgID() {
+		// Errors here aren't fatal; we can always fall back to replaying.
+		if sg, _, err := b.snaps.Latest(id); err == nil && sg != nil && sg.MsgID() > start.MsgID() {
+			start = sg
+		}
+	}
+
+	return start
+}
+
+// AtTime returns the graph as it existed at the provided time - that is, the
+// graph after merging the last record persisted at or before t.
+func (b *Builder) AtTime(t time.Time) (system.CoreGraph, error) {
+	id, err := b.MsgIDAt(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.AtMsgID(id)
+}
+
+// MsgIDAt returns the index of the last record in the mlog that was persisted
+// at or before the provided time, or 0 if no record was.
+//
+// Records are timestamped as they are appended, so their times are assumed to
+// be non-decreasing; this allows a binary search over the mlog.
+func (b *Builder) MsgIDAt(t time.Time) (uint64, error) {
+	tot, err := b.mlog.Count()
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the first record strictly after t; the one before it is our target.
+	var serr error
+	n := sort.Search(int(tot), func(i int) bool {
+		if serr != nil {
+			return true
+		}
+
+		rec, err := b.mlog.Get(uint64(i + 1))
+		if err != nil {
+			serr = err
+			return true
+		}
+		return rec.Time().After(t)
+	})
+
+	if serr != nil {
+		return 0, serr
+	}
+	return uint64(n), nil
+}
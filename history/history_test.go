@@ -0,0 +1,120 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/snapshot"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+var epoch = time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// Loads the ein fixtures into a memory mlog, with record n persisted n hours
+// after the epoch.
+func fixtureLog(t *testing.T) mlog.Store {
+	j := mem.NewMemStore()
+	for i := range make([]struct{}, 8) {
+		path := fmt.Sprintf("../fixtures/ein/%v.json", i+1)
+		f, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("json fnf: " + path)
+		}
+
+		rec, _ := j.NewEntry(f, "127.0.0.1", "")
+		ts := epoch.Add(time.Duration(rec.Index) * time.Hour)
+		rec.TimeSec, rec.TimeNSec = ts.Unix(), int64(ts.Nanosecond())
+	}
+
+	return j
+}
+
+func sameGraph(t *testing.T, g1, g2 system.CoreGraph) bool {
+	var b1, b2 bytes.Buffer
+	if err := represent.WriteSnapshot(&b1, g1); err != nil {
+		t.Fatal(err)
+	}
+	if err := represent.WriteSnapshot(&b2, g2); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(b1.Bytes(), b2.Bytes())
+}
+
+func TestAtMsgID(t *testing.T) {
+	j := fixtureLog(t)
+
+	path, err := ioutil.TempDir("", "pvhist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	sd, _ := snapshot.NewDir(path)
+
+	g3, _ := ingest.Replay(represent.NewGraph(), j.Get, 3)
+	sd.Write(g3)
+
+	for _, b := range []*Builder{NewBuilder(j, nil), NewBuilder(j, sd)} {
+		// Go forward and backward, to exercise both the cache and the snapshots
+		for _, id := range []uint64{0, 5, 2, 8, 6, 6, 1} {
+			g, err := b.AtMsgID(id)
+			if err != nil {
+				t.Fatalf("Failed to build graph at msgid %v: %v", id, err)
+			}
+			if g.MsgID() != id {
+				t.Errorf("Requested graph at msgid %v, got %v", id, g.MsgID())
+			}
+
+			expect, _ := ingest.Replay(represent.NewGraph(), j.Get, id)
+			if !sameGraph(t, g, expect) {
+				t.Errorf("Graph built at msgid %v differs from a straight replay", id)
+			}
+		}
+
+		if _, err := b.AtMsgID(9); err != ErrOutOfRange {
+			t.Errorf("Expected ErrOutOfRange when requesting msgid past end of mlog, got %v", err)
+		}
+	}
+}
+
+func TestMsgIDAt(t *testing.T) {
+	b := NewBuilder(fixtureLog(t), nil)
+
+	cases := []struct {
+		at    time.Time
+		msgid uint64
+	}{
+		{epoch, 0},
+		{epoch.Add(time.Hour - time.Nanosecond), 0},
+		{epoch.Add(time.Hour), 1},
+		{epoch.Add(90 * time.Minute), 1},
+		{epoch.Add(5 * time.Hour), 5},
+		{epoch.Add(8 * time.Hour), 8},
+		{epoch.Add(1000 * time.Hour), 8},
+	}
+
+	for _, c := range cases {
+		id, err := b.MsgIDAt(c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != c.msgid {
+			t.Errorf("At %v, expected msgid %v, got %v", c.at, c.msgid, id)
+		}
+	}
+
+	g, err := b.AtTime(epoch.Add(150 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.MsgID() != 2 {
+		t.Errorf("Expected graph at msgid 2 for time between records 2 and 3, got %v", g.MsgID())
+	}
+}
@@ -0,0 +1,47 @@
+package history
+
+import (
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Preview describes what merging a message would do to the graph, in terms
+// of how its contents would be interpreted.
+type Preview struct {
+	// The msgid the message would be merged with
+	MsgID uint64 `json:"msgid"`
+	// Vertices the message would create, as nothing already in the graph
+	// unifies with them
+	Created []represent.DiffVertex `json:"created"`
+	// Existing vertices the message's vertices would unify with. Those the
+	// message merely reaffirms are included, as their properties' MsgSrc
+	// would be updated.
+	Unified []represent.VertexChange `json:"unified"`
+	// Vertices that would be removed, as by tombstones
+	Removed []represent.DiffVertex `json:"removed"`
+	// Edges that would resolve, whether new or already in the graph. This
+	// includes edges from earlier messages' orphans that the message
+	// would satisfy.
+	Resolved []represent.DiffEdge `json:"resolved"`
+	// Edges that would be removed along with their vertices
+	EdgesRemoved []represent.DiffEdge `json:"edgesRemoved"`
+	// Edge specs from the message that would not resolve, and so would be
+	// held as orphans
+	Orphans []represent.Orphan `json:"orphans"`
+}
+
+// NewPreview describes the effects of merging a single message, given the
+// graph immediately before the merge and immediately after. Typically, the
+// latter is a graph that is discarded once previewed.
+func NewPreview(from, to system.CoreGraph) *Preview {
+	e := MergeEffects(from, to)
+	return &Preview{
+		MsgID:        to.MsgID(),
+		Created:      e.VerticesAdded,
+		Unified:      e.VerticesChanged,
+		Removed:      e.VerticesRemoved,
+		Resolved:     append(e.EdgesAdded, e.EdgesChanged...),
+		EdgesRemoved: e.EdgesRemoved,
+		Orphans:      e.Orphans,
+	}
+}
@@ -0,0 +1,48 @@
+package history
+
+import "testing"
+
+func TestNewPreview(t *testing.T) {
+	b := NewBuilder(fixtureLog(t), nil)
+
+	from, err := b.AtMsgID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := b.AtMsgID(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPreview(from, to)
+	if p.MsgID != 3 {
+		t.Errorf("Expected preview of msgid 3, got %v", p.MsgID)
+	}
+	if len(p.Orphans) != 0 {
+		t.Errorf("Expected message 3 to leave no orphans, got %v", len(p.Orphans))
+	}
+
+	// Message 3 satisfies the orphaned version edges from message 2
+	var resolved bool
+	for _, e := range p.Resolved {
+		if e.EType == "version" {
+			resolved = true
+		}
+	}
+	if !resolved {
+		t.Error("Expected message 3 to resolve edges from logic states to commits")
+	}
+
+	// Message 2's logic states are all new
+	from, _ = b.AtMsgID(1)
+	to, _ = b.AtMsgID(2)
+	p = NewPreview(from, to)
+	if len(p.Created) == 0 || len(p.Orphans) == 0 {
+		t.Errorf("Expected message 2 to create vertices and leave orphans, got %v and %v", len(p.Created), len(p.Orphans))
+	}
+	for _, o := range p.Orphans {
+		if o.MsgID != 2 {
+			t.Errorf("Only orphans from message 2 should be reported, got one from %v", o.MsgID)
+		}
+	}
+}
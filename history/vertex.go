@@ -0,0 +1,180 @@
+package history
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// ErrNoVertex is returned when a history is requested for a vertex that does
+// not exist in the provided graph.
+var ErrNoVertex = errors.New("vertex does not exist in the graph")
+
+// PropValue is a value held by a property, along with the message that first
+// set it to that value.
+type PropValue struct {
+	MsgID uint64      `json:"msgid"`
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// VertexHistory is a timeline of the values held by each property of a vertex.
+type VertexHistory struct {
+	ID    uint64       `json:"id"`
+	VType system.VType `json:"type"`
+	// Values for each property, oldest first. Successive messages reporting
+	// the same value are collapsed into a single entry.
+	Props map[string][]PropValue `json:"properties"`
+}
+
+// Vertex reconstructs the history of the properties of the vertex with the
+// given id, up to the provided graph.
+//
+// A property only records the last message that set it, so earlier values are
+// found by going back to the graph as it was before that message. That graph
+// is replayed from the nearest snapshot (or cached graph) preceding it, noting
+// each value set along the way; the oldest values then found say how much
+// further back to go. This ends once the vertex does not exist in the graph
+// replayed from. Each record is replayed at most once, and records after the
+// vertex last changed, or before the snapshot preceding its creation, are not
+// replayed at all.
+//
+// Vertex ids are never reused, and properties are never removed from a
+// vertex, so the vertex with the same id in an earlier graph is always the
+// same one, and a property absent from it was first set later.
+func (b *Builder) Vertex(g system.CoreGraph, vid uint64) (*VertexHistory, error) {
+	vt, err := g.Get(vid)
+	if err != nil {
+		return nil, ErrNoVertex
+	}
+
+	vh := &VertexHistory{
+		ID:    vid,
+		VType: vt.Vertex.Typ(),
+		Props: make(map[string][]PropValue),
+	}
+
+	// For each property, the msgids that set the values found so far, and the
+	// oldest of them. Also the times of the records replayed along the way;
+	// the times of any others are retrieved at the end.
+	seen := make(map[string]map[uint64]bool)
+	oldest := make(map[string]uint64)
+	times := make(map[uint64]time.Time)
+
+	record := func(k string, p system.Property) {
+		if seen[k][p.MsgSrc] {
+			return
+		}
+
+		vh.Props[k] = append(vh.Props[k], PropValue{MsgID: p.MsgSrc, Value: p.Value})
+		if seen[k] == nil {
+			seen[k] = make(map[uint64]bool)
+		}
+		seen[k][p.MsgSrc] = true
+		if o, exists := oldest[k]; !exists || p.MsgSrc < o {
+			oldest[k] = p.MsgSrc
+		}
+	}
+
+	// observe records the vertex's property values in the graph, reporting
+	// whether the vertex exists in it.
+	observe := func(g system.CoreGraph) bool {
+		vt, err := g.Get(vid)
+		if err != nil {
+			return false
+		}
+
+		vt.Vertex.Props().ForEach(func(k string, val ps.Any) {
+			record(k, val.(system.Property))
+		})
+		return true
+	}
+
+	// Records are retrieved one at a time as they are replayed; keep their
+	// times, rather than retrieving them again.
+	get := func(id uint64) (*mlog.Record, error) {
+		rec, err := b.mlog.Get(id)
+		if err == nil {
+			times[id] = rec.Time()
+		}
+		return rec, err
+	}
+
+	observe(g)
+
+	// Properties whose oldest value was set after the graph last replayed from
+	// were not yet set in it, so their history is complete.
+	limit := g.MsgID()
+	for {
+		var frontier uint64
+		for _, o := range oldest {
+			if o <= limit && o > frontier {
+				frontier = o
+			}
+		}
+		if frontier <= 1 {
+			break
+		}
+
+		pg := b.base(frontier - 1)
+		limit = pg.MsgID()
+		exists := observe(pg)
+
+		for i := limit + 1; i < frontier; i++ {
+			if pg, err = ingest.Replay(pg, get, i); err != nil {
+				return nil, err
+			}
+			observe(pg)
+		}
+
+		if !exists {
+			// Created since the graph replayed from, so there is nothing older
+			break
+		}
+	}
+
+	for k, vals := range vh.Props {
+		for i, v := range vals {
+			t, exists := times[v.MsgID]
+			if !exists && v.MsgID != 0 {
+				rec, err := b.mlog.Get(v.MsgID)
+				if err != nil {
+					return nil, err
+				}
+				t = rec.Time()
+				times[v.MsgID] = t
+			}
+			vals[i].Time = t
+		}
+		vh.Props[k] = collapse(vals)
+	}
+
+	return vh, nil
+}
+
+// collapse orders the values oldest first, merging runs of the same value
+// into their earliest entry.
+func collapse(vals []PropValue) []PropValue {
+	sort.Sort(byMsgID(vals))
+
+	ret := vals[:0]
+	for _, v := range vals {
+		if len(ret) > 0 && reflect.DeepEqual(ret[len(ret)-1].Value, v.Value) {
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+type byMsgID []PropValue
+
+func (v byMsgID) Len() int           { return len(v) }
+func (v byMsgID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byMsgID) Less(i, j int) bool { return v[i].MsgID < v[j].MsgID }
@@ -0,0 +1,181 @@
+package history
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/snapshot"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestVertexHistory(t *testing.T) {
+	msgs := []string{
+		`{"environments": [{"address": {"hostname": "foo"}, "os": "linux"}]}`,
+		`{"environments": [{"address": {"hostname": "bar"}}]}`,
+		`{"environments": [{"address": {"hostname": "foo"}, "os": "freebsd", "provider": "aws"}]}`,
+		`{"environments": [{"address": {"hostname": "foo"}, "os": "freebsd"}]}`,
+		`{"environments": [{"address": {"hostname": "foo"}, "os": "linux"}]}`,
+	}
+
+	j := mem.NewMemStore()
+	for _, m := range msgs {
+		rec, _ := j.NewEntry([]byte(m), "127.0.0.1", "")
+		ts := epoch.Add(time.Duration(rec.Index) * time.Hour)
+		rec.TimeSec, rec.TimeNSec = ts.Unix(), int64(ts.Nanosecond())
+	}
+
+	g, _ := ingest.Replay(represent.NewGraph(), j.Get, uint64(len(msgs)))
+	env := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "foo"))[0]
+
+	b := NewBuilder(j, nil)
+	vh, err := b.Vertex(g, env.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(k string, expect ...PropValue) {
+		vals := vh.Props[k]
+		if len(vals) != len(expect) {
+			t.Errorf("Expected %v values in history of %q, got %v: %v", len(expect), k, len(vals), vals)
+			return
+		}
+		for i, v := range vals {
+			if v.MsgID != expect[i].MsgID || v.Value != expect[i].Value {
+				t.Errorf("History of %q at %v: expected value %v from msgid %v, got %v from %v", k, i, expect[i].Value, expect[i].MsgID, v.Value, v.MsgID)
+			}
+			if !v.Time.Equal(epoch.Add(time.Duration(v.MsgID) * time.Hour)) {
+				t.Errorf("History of %q at %v has time %v, which is not that of msgid %v", k, i, v.Time, v.MsgID)
+			}
+		}
+	}
+
+	check("os", PropValue{MsgID: 1, Value: "linux"}, PropValue{MsgID: 3, Value: "freebsd"}, PropValue{MsgID: 5, Value: "linux"})
+	check("provider", PropValue{MsgID: 3, Value: "aws"})
+	check("hostname", PropValue{MsgID: 1, Value: "foo"})
+
+	// History as of an earlier graph stops there
+	g3, _ := b.AtMsgID(3)
+	vh, err = b.Vertex(g3, env.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("os", PropValue{MsgID: 1, Value: "linux"}, PropValue{MsgID: 3, Value: "freebsd"})
+
+	if _, err = b.Vertex(g, 1000); err != ErrNoVertex {
+		t.Errorf("Expected ErrNoVertex for nonexistent vertex, got %v", err)
+	}
+}
+
+// countingStore counts the times each record is retrieved from the
+// underlying mlog; replaying a record retrieves it once.
+type countingStore struct {
+	mlog.Store
+	gets map[uint64]int
+}
+
+func (cs *countingStore) Get(index uint64) (*mlog.Record, error) {
+	cs.gets[index]++
+	return cs.Store.Get(index)
+}
+
+// total is the number of records retrieved, failing if any was retrieved more
+// than once.
+func (cs *countingStore) total(t *testing.T) int {
+	var n int
+	for idx, c := range cs.gets {
+		if c > 1 {
+			t.Errorf("Expected each record to be replayed at most once, but %v was retrieved %v times", idx, c)
+		}
+		n += c
+	}
+	cs.gets = make(map[uint64]int)
+	return n
+}
+
+// longLog is a mlog of n messages about environment foo, whose os changes
+// every tenth message, and one about environment bar, at message n-10.
+func longLog(n int) mlog.Store {
+	j := mem.NewMemStore()
+	for i := 1; i <= n; i++ {
+		m := `{"environments": [{"address": {"hostname": "foo"}}]}`
+		if i == n-10 {
+			m = `{"environments": [{"address": {"hostname": "bar"}}]}`
+		} else if i%10 == 1 {
+			m = fmt.Sprintf(`{"environments": [{"address": {"hostname": "foo"}, "os": "os%v"}]}`, i/10)
+		}
+
+		rec, _ := j.NewEntry([]byte(m), "127.0.0.1", "")
+		ts := epoch.Add(time.Duration(rec.Index) * time.Hour)
+		rec.TimeSec, rec.TimeNSec = ts.Unix(), int64(ts.Nanosecond())
+	}
+	return j
+}
+
+func TestVertexHistoryLongMlog(t *testing.T) {
+	const n = 300
+
+	path, err := ioutil.TempDir("", "pvhist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	sd, _ := snapshot.NewDir(path)
+
+	j := longLog(n)
+	for _, id := range []uint64{100, 200} {
+		sg, _ := ingest.Replay(represent.NewGraph(), j.Get, id)
+		sd.Write(sg)
+	}
+
+	g, _ := ingest.Replay(represent.NewGraph(), j.Get, n)
+	foo := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "foo"))[0]
+	bar := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "bar"))[0]
+
+	cs := &countingStore{Store: j, gets: make(map[uint64]int)}
+	for _, b := range []*Builder{NewBuilder(cs, nil), NewBuilder(cs, sd)} {
+		vh, err := b.Vertex(g, foo.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(vh.Props["os"]) != n/10 {
+			t.Errorf("Expected %v values in history of os, got %v", n/10, len(vh.Props["os"]))
+		}
+		for i, v := range vh.Props["os"] {
+			if v.MsgID != uint64(i*10+1) || v.Value != fmt.Sprintf("os%v", i) {
+				t.Errorf("History of os at %v: expected value os%v from msgid %v, got %v from %v", i, i, i*10+1, v.Value, v.MsgID)
+			}
+		}
+
+		// Each message is replayed once, not once per step back through history
+		if gets := cs.total(t); gets > n {
+			t.Errorf("Expected reconstructing history to replay each of %v messages at most once, got %v", n, gets)
+		}
+	}
+
+	// Without snapshots, the whole mlog before bar was created is replayed.
+	// With them, only what follows the snapshot preceding its creation is.
+	for _, c := range []struct {
+		b   *Builder
+		max int
+	}{{NewBuilder(cs, nil), n - 10}, {NewBuilder(cs, sd), n - 10 - 200}} {
+		vh, err := c.b.Vertex(g, bar.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := vh.Props["hostname"]; len(h) != 1 || h[0].MsgID != n-10 {
+			t.Errorf("Expected a single hostname for bar, from msgid %v, got %v", n-10, h)
+		}
+		if gets := cs.total(t); gets > c.max {
+			t.Errorf("Expected reconstructing history of bar to retrieve at most %v records, got %v", c.max, gets)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package ingest
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCredentials is returned by an Authenticator when a request carries none
+// of the credentials it checks, as distinct from carrying bad ones.
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// An Authenticator establishes the identity of the producer that sent a
+// message to the ingestor.
+//
+// The body is passed separately from the request, as it has already been read
+// by the time authentication happens.
+type Authenticator interface {
+	Authenticate(r *http.Request, body []byte) (producer string, err error)
+}
+
+// TokenAuth authenticates producers by a static bearer token, sent in the
+// Authorization header.
+type TokenAuth struct {
+	// Map of producer name to token
+	tokens map[string]string
+}
+
+// LoadTokenAuth creates a TokenAuth from a file of producer names and tokens.
+// See readKeyFile for the format.
+func LoadTokenAuth(path string) (*TokenAuth, error) {
+	tokens, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAuth{tokens: tokens}, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *TokenAuth) Authenticate(r *http.Request, body []byte) (string, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return "", ErrNoCredentials
+	}
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", errors.New("unsupported authorization scheme")
+	}
+
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+	// Check every token, so that timing reveals nothing about which matched
+	var producer string
+	for p, t := range a.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			producer = p
+		}
+	}
+
+	if producer == "" {
+		return "", errors.New("unknown bearer token")
+	}
+	return producer, nil
+}
+
+// HMACAuth authenticates producers by an HMAC-SHA256 signature of the message
+// body, computed with a secret shared between the producer and pipeviz.
+//
+// The producer names itself in the X-Pipeviz-Producer header, and sends the
+// hex-encoded signature in the X-Pipeviz-Signature header, optionally
+// prefixed with "sha256=".
+//
+// Opening a stream has no body to sign, so the producer instead sends the
+// current unix time in the X-Pipeviz-Timestamp header, and signs the string
+// "stream:" followed by that timestamp. The timestamp must be within
+// MaxStreamSignatureAge of the present, and each signature may open only one
+// stream, so that a captured upgrade request cannot be replayed.
+type HMACAuth struct {
+	// Map of producer name to shared secret
+	secrets map[string]string
+
+	// Stream signatures already used, with the time they would expire
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+// MaxStreamSignatureAge is how far the timestamp signed by a producer opening
+// a stream with HMACAuth may be from the present, in either direction.
+const MaxStreamSignatureAge = 5 * time.Minute
+
+// LoadHMACAuth creates an HMACAuth from a file of producer names and secrets.
+// See readKeyFile for the format.
+func LoadHMACAuth(path string) (*HMACAuth, error) {
+	secrets, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &HMACAuth{secrets: secrets}, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *HMACAuth) Authenticate(r *http.Request, body []byte) (string, error) {
+	producer, sig := r.Header.Get("X-Pipeviz-Producer"), r.Header.Get("X-Pipeviz-Signature")
+	if sig == "" {
+		return "", ErrNoCredentials
+	}
+
+	secret, exists := a.secrets[producer]
+	if !exists {
+		return "", fmt.Errorf("unknown producer %q", producer)
+	}
+
+	given, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+
+	stream := isStreamOpen(r)
+	var expires time.Time
+	if stream {
+		ts := r.Header.Get("X-Pipeviz-Timestamp")
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return "", errors.New("stream must be opened with a signed X-Pipeviz-Timestamp")
+		}
+
+		t := time.Unix(sec, 0)
+		if age := time.Since(t); age > MaxStreamSignatureAge || age < -MaxStreamSignatureAge {
+			return "", errors.New("signed timestamp is too far from the present")
+		}
+		expires = t.Add(MaxStreamSignatureAge)
+		body = []byte("stream:" + ts)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return "", errors.New("signature does not match message body")
+	}
+
+	if stream && !a.use(hex.EncodeToString(given), expires) {
+		return "", errors.New("stream signature has already been used")
+	}
+	return producer, nil
+}
+
+// use records that a stream signature, valid until the provided time, has
+// been used. It returns false if it already had been.
+func (a *HMACAuth) use(sig string, expires time.Time) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for s, e := range a.used {
+		if e.Before(now) {
+			delete(a.used, s)
+		}
+	}
+
+	if _, exists := a.used[sig]; exists {
+		return false
+	}
+	if a.used == nil {
+		a.used = make(map[string]time.Time)
+	}
+	a.used[sig] = expires
+	return true
+}
+
+// isStreamOpen reports whether the request is to open a stream, which has no
+// body for a signature to cover.
+func isStreamOpen(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// CertAuth authenticates producers by a TLS client certificate, signed by one
+// of the provided CAs. The producer is the common name of the certificate's
+// subject.
+//
+// Verification of the certificate chain is done by the TLS handshake, so
+// CertAuth only works when the ingestor is serving TLS.
+type CertAuth struct {
+	Roots *x509.CertPool
+}
+
+// LoadCertAuth creates a CertAuth that trusts the PEM-encoded CA certificates
+// in the provided file.
+func LoadCertAuth(path string) (*CertAuth, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return &CertAuth{Roots: pool}, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *CertAuth) Authenticate(r *http.Request, body []byte) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", ErrNoCredentials
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		return "", errors.New("client certificate was not verified")
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return "", errors.New("client certificate has no common name")
+	}
+	return cn, nil
+}
+
+// readKeyFile reads a file containing one producer per line, as the producer
+// name followed by whitespace and its token or secret. Blank lines and lines
+// beginning with # are ignored.
+func readKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a producer name and a key", path, line)
+		}
+		if _, exists := keys[fields[0]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate producer %q", path, line, fields[0])
+		}
+		keys[fields[0]] = fields[1]
+	}
+
+	return keys, sc.Err()
+}
+
+// authenticate identifies the producer of a request using the ingestor's
+// authenticators, in order. The first one for which the request carries
+// credentials decides the outcome.
+//
+// If the ingestor has no authenticators, every request is accepted, with an
+// empty producer.
+func (s *Ingestor) authenticate(r *http.Request, body []byte) (string, error) {
+	if len(s.auth) == 0 {
+		return "", nil
+	}
+
+	for _, a := range s.auth {
+		producer, err := a.Authenticate(r, body)
+		if err != ErrNoCredentials {
+			return producer, err
+		}
+	}
+	return "", ErrNoCredentials
+}
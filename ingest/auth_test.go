@@ -0,0 +1,190 @@
+package ingest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const authMsg = `{"environments":[{"address":{"hostname":"a"}}]}`
+
+func writeKeyFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "pipeviz-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestReadKeyFile(t *testing.T) {
+	path := writeKeyFile(t, "# producers\nci-runner s3cret\n\n  deployer   other \n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	keys, err := readKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys["ci-runner"] != "s3cret" || keys["deployer"] != "other" {
+		t.Errorf("Unexpected keys read from file: %v", keys)
+	}
+
+	for _, bad := range []string{"lonely\n", "a b c\n", "a b\na c\n"} {
+		path := writeKeyFile(t, bad)
+		if _, err := readKeyFile(path); err == nil {
+			t.Errorf("Expected error reading key file %q", bad)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	a := &TokenAuth{tokens: map[string]string{"ci-runner": "abc", "deployer": "xyz"}}
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	if _, err := a.Authenticate(r, nil); err != ErrNoCredentials {
+		t.Errorf("Expected ErrNoCredentials with no Authorization header, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer xyz")
+	if p, err := a.Authenticate(r, nil); err != nil || p != "deployer" {
+		t.Errorf("Expected producer 'deployer', got %q (err %v)", p, err)
+	}
+
+	for _, h := range []string{"Bearer nope", "Basic eHl6"} {
+		r.Header.Set("Authorization", h)
+		if _, err := a.Authenticate(r, nil); err == nil || err == ErrNoCredentials {
+			t.Errorf("Expected rejection of %q, got %v", h, err)
+		}
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	a := &HMACAuth{secrets: map[string]string{"ci-runner": "s3cret"}}
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	if _, err := a.Authenticate(r, []byte(authMsg)); err != ErrNoCredentials {
+		t.Errorf("Expected ErrNoCredentials with no signature, got %v", err)
+	}
+
+	r.Header.Set("X-Pipeviz-Producer", "ci-runner")
+	for _, sig := range []string{sign("s3cret", authMsg), "sha256=" + sign("s3cret", authMsg)} {
+		r.Header.Set("X-Pipeviz-Signature", sig)
+		if p, err := a.Authenticate(r, []byte(authMsg)); err != nil || p != "ci-runner" {
+			t.Errorf("Expected producer 'ci-runner' for signature %q, got %q (err %v)", sig, p, err)
+		}
+	}
+
+	r.Header.Set("X-Pipeviz-Signature", sign("s3cret", authMsg))
+	if _, err := a.Authenticate(r, []byte(authMsg+" ")); err == nil {
+		t.Error("Expected rejection of signature over a different body")
+	}
+
+	r.Header.Set("X-Pipeviz-Signature", sign("wrong", authMsg))
+	if _, err := a.Authenticate(r, []byte(authMsg)); err == nil {
+		t.Error("Expected rejection of signature made with the wrong secret")
+	}
+
+	r.Header.Set("X-Pipeviz-Producer", "impostor")
+	r.Header.Set("X-Pipeviz-Signature", sign("s3cret", authMsg))
+	if _, err := a.Authenticate(r, []byte(authMsg)); err == nil {
+		t.Error("Expected rejection of unknown producer")
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	a := &CertAuth{Roots: x509.NewCertPool()}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}}
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	if _, err := a.Authenticate(r, nil); err != ErrNoCredentials {
+		t.Errorf("Expected ErrNoCredentials without TLS, got %v", err)
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	if _, err := a.Authenticate(r, nil); err != ErrNoCredentials {
+		t.Errorf("Expected ErrNoCredentials without a client cert, got %v", err)
+	}
+
+	r.TLS.PeerCertificates = []*x509.Certificate{cert}
+	if _, err := a.Authenticate(r, nil); err == nil || err == ErrNoCredentials {
+		t.Errorf("Expected rejection of unverified cert, got %v", err)
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if p, err := a.Authenticate(r, nil); err != nil || p != "ci-runner" {
+		t.Errorf("Expected producer 'ci-runner', got %q (err %v)", p, err)
+	}
+}
+
+func TestAuthenticatedIngest(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetAuth(&TokenAuth{tokens: map[string]string{"ci-runner": "abc"}},
+		&HMACAuth{secrets: map[string]string{"deployer": "s3cret"}})
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func(hdr map[string]string) int {
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(authMsg))
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post(nil); status != 401 {
+		t.Errorf("Expected 401 for message with no credentials, got %v", status)
+	}
+	if status := post(map[string]string{"Authorization": "Bearer nope"}); status != 401 {
+		t.Errorf("Expected 401 for message with bad token, got %v", status)
+	}
+	if status := post(map[string]string{"Authorization": "Bearer abc"}); status != 202 {
+		t.Errorf("Expected 202 for message with good token, got %v", status)
+	}
+	if status := post(map[string]string{
+		"X-Pipeviz-Producer":  "deployer",
+		"X-Pipeviz-Signature": sign("s3cret", authMsg),
+	}); status != 202 {
+		t.Errorf("Expected 202 for message with good signature, got %v", status)
+	}
+
+	if n, _ := s.mlog.Count(); n != 2 {
+		t.Fatalf("Expected only the two authenticated messages in the mlog, found %v", n)
+	}
+	for i, producer := range []string{"ci-runner", "deployer"} {
+		rec, _ := s.mlog.Get(uint64(i + 1))
+		if rec.Producer != producer {
+			t.Errorf("Expected record %v to have producer %q, got %q", i+1, producer, rec.Producer)
+		}
+	}
+
+	// Batches are authenticated as a whole
+	if status, _ := postBatch(t, s, authMsg); status != 401 {
+		t.Errorf("Expected 401 for batch with no credentials, got %v", status)
+	}
+}
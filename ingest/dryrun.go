@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+	"github.com/pipeviz/pipeviz/log"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// A MergeDescriber describes the effects of merging a message, given the graph
+// immediately before the merge and immediately after. The description is
+// written back to dry-run clients as JSON.
+type MergeDescriber func(from, to system.CoreGraph) interface{}
+
+// SetMergeDescriber sets the function used to describe the effects of messages
+// sent to the dry-run endpoint. If none is set (the default), the endpoint
+// is unavailable.
+func (s *Ingestor) SetMergeDescriber(f MergeDescriber) {
+	s.describe = f
+}
+
+// setGraph records the latest graph produced by interpretation.
+func (s *Ingestor) setGraph(g system.CoreGraph) {
+	s.graphLock.Lock()
+	s.graph = g
+	s.graphLock.Unlock()
+}
+
+// latestGraph returns the latest graph produced by interpretation, or nil if
+// interpretation has not yet begun.
+func (s *Ingestor) latestGraph() system.CoreGraph {
+	s.graphLock.RLock()
+	defer s.graphLock.RUnlock()
+	return s.graph
+}
+
+// handleDryRun validates a single message, checks it against the policy and
+// admits it exactly as if it had been POSTed to /, then merges it into the
+// latest graph and writes back a description of the result. Neither the mlog
+// nor the graph are altered; the merged graph is discarded, and the merge is
+// logged as a dry run.
+//
+// A dry run holds a place in the interpretation queue while it is merged, and
+// counts against the producer's rate limit, as merging is no cheaper than for
+// a real message.
+//
+// Messages received concurrently may be merged before this one would be, so
+// the result is a preview, not a promise.
+func (s *Ingestor) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeBadRequest, Message: "Could not read request body"})
+		return
+	}
+
+	producer, ok := s.authorize(w, r, b)
+	if !ok {
+		return
+	}
+
+	if s.describe == nil {
+		writeErrors(w, 501, errdoc.FieldError{Code: errdoc.CodeUnavailable, Message: "Dry runs are not supported by this server"})
+		return
+	}
+
+	result, err := s.schema.Validate(gjs.NewStringLoader(string(b)))
+	if err != nil {
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeMalformedJSON, Message: err.Error()})
+		return
+	}
+	if !result.Valid() {
+		writeErrors(w, 422, schemaErrors(result)...)
+		return
+	}
+	if errs, _ := s.checkSemantics(requestNote(r, 0), b); len(errs) > 0 {
+		writeErrors(w, 422, errs...)
+		return
+	}
+	if violations := s.checkPolicy(requestNote(r, 0), producer, b); len(violations) > 0 {
+		writeErrors(w, 403, violations...)
+		return
+	}
+
+	g := s.latestGraph()
+	if g == nil {
+		retryAfter(w, SaturatedRetryAfter)
+		writeErrors(w, 503, errdoc.FieldError{Code: errdoc.CodeUnavailable, Message: "Graph is not yet available"})
+		return
+	}
+
+	if !s.admit(w, r, producer, 1) {
+		return
+	}
+
+	m := Message{}
+	json.Unmarshal(b, &m)
+	preview := s.describe(g, g.DryRunAt(g.MsgID()+1, time.Now(), m.UnificationForm()))
+	// Nothing is left to merge
+	s.release(1)
+
+	j, err := json.Marshal(preview)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system": "ingestor",
+			"err":    err,
+		}).Error("Failed to marshal dry-run result")
+		writeErrors(w, 500, errdoc.FieldError{Code: errdoc.CodeInternal, Message: "Failed to describe merge"})
+		return
+	}
+
+	log.AddFields(r, logrus.Fields{"dry-run-msgid": g.MsgID() + 1})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
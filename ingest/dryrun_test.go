@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestDryRun(t *testing.T) {
+	s := newTestIngestor(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleDryRun))
+	defer srv.Close()
+
+	post := func(body string) (*http.Response, represent.GraphDiff) {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		defer resp.Body.Close()
+
+		var d represent.GraphDiff
+		if resp.StatusCode == 200 {
+			if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+				t.Fatal("Failed to decode dry-run result:", err)
+			}
+		}
+		return resp, d
+	}
+
+	msg := `{"environments": [{"address": {"hostname": "a"}}, {"address": {"hostname": "b"}}]}`
+	if resp, _ := post(msg); resp.StatusCode != 501 {
+		t.Errorf("Expected 501 without a merge describer, got %v", resp.StatusCode)
+	}
+
+	s.SetMergeDescriber(func(from, to system.CoreGraph) interface{} {
+		return represent.Diff(from, to)
+	})
+	if resp, _ := post(msg); resp.StatusCode != 503 {
+		t.Errorf("Expected 503 before interpretation has begun, got %v", resp.StatusCode)
+	}
+
+	g := represent.NewGraph().Merge(1, Message{}.UnificationForm())
+	im := Message{}
+	json.Unmarshal([]byte(`{"environments": [{"address": {"hostname": "a"}}]}`), &im)
+	g = g.Merge(2, im.UnificationForm())
+	s.setGraph(g)
+
+	if resp, _ := post(`{"environments": [{"nick": 1}]}`); resp.StatusCode != 422 {
+		t.Errorf("Expected 422 for invalid message, got %v", resp.StatusCode)
+	}
+
+	lc, restore := capture()
+	defer restore()
+
+	resp, d := post(msg)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200 for valid message, got %v", resp.StatusCode)
+	}
+	if d.From != 2 || d.To != 3 {
+		t.Errorf("Expected preview to span msgids 2 to 3, got %v to %v", d.From, d.To)
+	}
+	if len(d.VerticesAdded) != 1 || d.VerticesAdded[0].Props["hostname"].Value != "b" {
+		t.Errorf("Expected only environment b to be created, got %+v", d.VerticesAdded)
+	}
+	if len(d.VerticesChanged) != 1 {
+		t.Errorf("Expected environment a to be unified, got %+v", d.VerticesChanged)
+	}
+
+	if s.latestGraph() != g {
+		t.Error("Dry run should not alter the latest graph")
+	}
+	if n, _ := s.mlog.Count(); n != 0 {
+		t.Errorf("Dry run should not write to the mlog, found %v records", n)
+	}
+
+	merges := lc.captured("Merging message 3 into graph")
+	if len(merges) != 1 || merges[0].Data["dry-run"] != true {
+		t.Errorf("Expected the merge to be logged as a dry run, got %v", merges)
+	}
+
+	// Dry runs are admitted like any other message, and give up their place
+	// in the queue once merged
+	if d := s.queueDepth(); d != 0 {
+		t.Errorf("Expected dry run to release its place in the queue, queue depth is %v", d)
+	}
+	s.SetRateLimit(1, 1)
+	if resp, _ := post(msg); resp.StatusCode != 200 {
+		t.Errorf("Expected 200 for dry run within rate limit, got %v", resp.StatusCode)
+	}
+	if resp, _ := post(msg); resp.StatusCode != 429 {
+		t.Errorf("Expected 429 for dry run beyond rate limit, got %v", resp.StatusCode)
+	}
+	s.SetRateLimit(0, 0)
+	s.reserve(cap(s.interpretChan))
+	if resp, _ := post(msg); resp.StatusCode != 503 {
+		t.Errorf("Expected 503 for dry run with a full queue, got %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,61 @@
+// Package errdoc defines the error documents with which the ingestor rejects
+// messages. It has no dependencies, so that producers can interpret them
+// without importing the ingestor itself.
+package errdoc
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Machine-readable codes for the errors the ingestor reports.
+const (
+	CodeBadRequest      = "bad-request"
+	CodeMalformedJSON   = "malformed-json"
+	CodeSchemaViolation = "schema-violation"
+	CodeSemanticError   = "semantic-error"
+	CodePolicyViolation = "policy-violation"
+	CodeUnauthenticated = "unauthenticated"
+	CodeRateLimited     = "rate-limited"
+	CodeQueueFull       = "queue-full"
+	CodePersistFailed   = "persist-failed"
+	CodeUnavailable     = "unavailable"
+	CodeInternal        = "internal-error"
+)
+
+// ErrorDoc is the body of every error response from the ingestor.
+type ErrorDoc struct {
+	Status int          `json:"status"`
+	Errors []FieldError `json:"errors"`
+}
+
+// FieldError describes a single problem with a message.
+type FieldError struct {
+	Code string `json:"code"`
+	// JSON pointer to the part of the message at fault, if any
+	Pointer string `json:"pointer,omitempty"`
+	// The same location, as a message section path, e.g. logic-states[2].environment
+	Section string `json:"section,omitempty"`
+	// For schema violations, the schema keyword that failed
+	Keyword string `json:"keyword,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	if e.Section == "" {
+		return e.Message
+	}
+	return e.Section + ": " + e.Message
+}
+
+// Parse interprets the body of an error response from the ingestor. Bodies
+// that are not an error document, as from older servers, are treated as a
+// single error with the body as its message.
+func Parse(status int, body []byte) ErrorDoc {
+	var doc ErrorDoc
+	if err := json.Unmarshal(body, &doc); err != nil || len(doc.Errors) == 0 {
+		doc.Errors = []FieldError{{Message: strings.TrimSpace(string(body))}}
+	}
+	doc.Status = status
+	return doc
+}
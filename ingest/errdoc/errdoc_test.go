@@ -0,0 +1,15 @@
+package errdoc
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	doc := Parse(403, []byte(`{"status": 403, "errors": [{"code": "policy-violation", "section": "processes", "message": "no"}]}`))
+	if len(doc.Errors) != 1 || doc.Errors[0].String() != "processes: no" {
+		t.Errorf("Unexpected parse of error document: %+v", doc)
+	}
+
+	doc = Parse(502, []byte("Bad Gateway\n"))
+	if doc.Status != 502 || len(doc.Errors) != 1 || doc.Errors[0].Message != "Bad Gateway" {
+		t.Errorf("Expected plain body to be treated as a single error, got %+v", doc)
+	}
+}
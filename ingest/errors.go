@@ -0,0 +1,98 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+)
+
+// writeErrors writes an error document back to the client.
+func writeErrors(w http.ResponseWriter, status int, errs ...errdoc.FieldError) {
+	j, _ := json.Marshal(errdoc.ErrorDoc{Status: status, Errors: errs})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// schemaErrors translates the errors from schema validation.
+func schemaErrors(result *gjs.Result) []errdoc.FieldError {
+	var errs []errdoc.FieldError
+	for _, re := range result.Errors() {
+		path := strings.Split(re.Context.String(), ".")[1:] // drop "(root)"
+		errs = append(errs, errdoc.FieldError{
+			Code:    errdoc.CodeSchemaViolation,
+			Pointer: jsonPointer(path),
+			Section: sectionPath(path),
+			Keyword: schemaKeyword(re.Description),
+			Message: re.Description,
+		})
+	}
+	return errs
+}
+
+// jsonPointer renders a path as an RFC 6901 JSON pointer.
+func jsonPointer(path []string) string {
+	var buf []string
+	for _, p := range path {
+		buf = append(buf, "/", strings.Replace(strings.Replace(p, "~", "~0", -1), "/", "~1", -1))
+	}
+	return strings.Join(buf, "")
+}
+
+// sectionPath renders a path as a message section path, with array indices
+// in brackets, e.g. logic-states[2].environment.
+func sectionPath(path []string) string {
+	var buf []string
+	for k, p := range path {
+		if _, err := strconv.Atoi(p); err == nil && k > 0 {
+			buf = append(buf, "["+p+"]")
+		} else {
+			if k > 0 {
+				buf = append(buf, ".")
+			}
+			buf = append(buf, p)
+		}
+	}
+	return strings.Join(buf, "")
+}
+
+// schemaKeywords maps fragments of gojsonschema's error descriptions to the
+// schema keyword that produced them. Order matters where one fragment
+// contains another.
+var schemaKeywords = []struct{ fragment, keyword string }{
+	{"is missing and required", "required"},
+	{"must be of type", "type"},
+	{"items must be unique", "uniqueItems"},
+	{"additional property", "additionalProperties"},
+	{"no additional item", "additionalItems"},
+	{"property \"", "patternProperties"},
+	{"does not match pattern", "pattern"},
+	{"must match one of the enum values", "enum"},
+	{"string length must be greater", "minLength"},
+	{"string length must be lower", "maxLength"},
+	{"array must have at least", "minItems"},
+	{"array must have at the most", "maxItems"},
+	{"must have at least", "minProperties"},
+	{"must have at the most", "maxProperties"},
+	{"must be lower than", "maximum"},
+	{"must be greater than", "minimum"},
+	{"(allOf)", "allOf"},
+	{"(anyOf)", "anyOf"},
+	{"(oneOf)", "oneOf"},
+	{"(not)", "not"},
+	{"has a dependency on", "dependencies"},
+	{"must be a multiple of", "multipleOf"},
+}
+
+func schemaKeyword(desc string) string {
+	for _, sk := range schemaKeywords {
+		if strings.Contains(desc, sk.fragment) {
+			return sk.keyword
+		}
+	}
+	return ""
+}
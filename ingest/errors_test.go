@@ -0,0 +1,91 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+)
+
+func TestSchemaErrors(t *testing.T) {
+	s := newTestIngestor(t)
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func(body string) (int, errdoc.ErrorDoc) {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected error document to have JSON content type, got %q", ct)
+		}
+		var doc errdoc.ErrorDoc
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatal("Failed to decode error document:", err)
+		}
+		return resp.StatusCode, doc
+	}
+
+	status, doc := post(`{"logic-states": [
+		{"path": "/a", "environment": {"address": {"hostname": "a"}}},
+		{"path": "/b", "environment": {"address": {"hostname": "a"}}},
+		{"path": "/c", "environment": "a"}
+	], "environments": [{"os": "plan9"}]}`)
+	if status != 422 || doc.Status != 422 {
+		t.Errorf("Expected 422 for schema violation, got %v (document says %v)", status, doc.Status)
+	}
+
+	var found []errdoc.FieldError
+	for _, e := range doc.Errors {
+		if e.Code != errdoc.CodeSchemaViolation {
+			t.Errorf("Expected code %q, got %q", errdoc.CodeSchemaViolation, e.Code)
+		}
+		if e.Message == "" {
+			t.Error("Expected error to have a message")
+		}
+		e.Message = ""
+		found = append(found, e)
+	}
+
+	for _, expect := range []errdoc.FieldError{
+		{Code: errdoc.CodeSchemaViolation, Pointer: "/logic-states/2/environment", Section: "logic-states[2].environment", Keyword: "type"},
+		{Code: errdoc.CodeSchemaViolation, Pointer: "/environments/0/os", Section: "environments[0].os", Keyword: "enum"},
+	} {
+		var ok bool
+		for _, e := range found {
+			ok = ok || reflect.DeepEqual(e, expect)
+		}
+		if !ok {
+			t.Errorf("Expected an error %+v, got %+v", expect, found)
+		}
+	}
+
+	status, doc = post(`{not json`)
+	if status != 400 || len(doc.Errors) != 1 || doc.Errors[0].Code != errdoc.CodeMalformedJSON {
+		t.Errorf("Expected a single malformed-json error with 400, got %v %+v", status, doc)
+	}
+}
+
+func TestSchemaKeyword(t *testing.T) {
+	for desc, kw := range map[string]string{
+		`"pid" property is missing and required`:        "required",
+		`additional property "foo" is not allowed`:      "additionalProperties",
+		`array must have at least 1 items`:              "minItems",
+		`must have at least 1 properties`:               "minProperties",
+		`string length must be greater or equal to 1`:   "minLength",
+		`must be greater than or equal to 0`:            "minimum",
+		`must validate one and only one schema (oneOf)`: "oneOf",
+		`something unexpected`:                          "",
+	} {
+		if got := schemaKeyword(desc); got != kw {
+			t.Errorf("Expected keyword %q for %q, got %q", kw, desc, got)
+		}
+	}
+}
@@ -1,29 +1,50 @@
 package ingest
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/unrolled/secure"
 	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/graceful"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/web"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
 	"github.com/pipeviz/pipeviz/log"
 	"github.com/pipeviz/pipeviz/mlog"
 	"github.com/pipeviz/pipeviz/types/system"
 )
 
+// DefaultMaxBatchSize is the maximum size of the request body accepted by the
+// batch endpoint. Each message within the batch is still subject to the
+// ingestor's maximum message size.
+const DefaultMaxBatchSize = 64 << 20
+
 // Ingestor brings together the required components to run a pipeviz ingestion HTTP server.
 type Ingestor struct {
+	// Admitted messages not yet merged; accessed atomically, so kept first
+	// for alignment. See admission.
+	backlog        int64
 	mlog           mlog.Store
 	schema         *gjs.Schema
 	interpretChan  chan *mlog.Record
 	brokerChan     chan system.CoreGraph
 	maxMessageSize int64
+	maxBatchSize   int64
+	auth           []Authenticator
+	policy         Policy
+	lenient        bool
+	limiter        *rateLimiter
+	describe       MergeDescriber
+	graphLock      sync.RWMutex
+	graph          system.CoreGraph // latest interpreted, for dry runs
 }
 
 // New creates a new pipeviz ingestor mux, ready to be kicked off.
@@ -34,13 +55,45 @@ func New(j mlog.Store, s *gjs.Schema, ic chan *mlog.Record, bc chan system.CoreG
 		interpretChan:  ic,
 		brokerChan:     bc,
 		maxMessageSize: max,
+		maxBatchSize:   DefaultMaxBatchSize,
 	}
 }
 
+// SetAuth sets the authenticators used to identify the producer of each
+// incoming message. Messages from producers that cannot be identified by one
+// of them are rejected.
+//
+// If no authenticators are set (the default), all messages are accepted.
+func (s *Ingestor) SetAuth(auth ...Authenticator) {
+	s.auth = auth
+}
+
+// SetPolicy sets the policy restricting what each producer may assert.
+// Messages that violate it are rejected.
+//
+// If no policy is set (the default), producers may assert anything.
+func (s *Ingestor) SetPolicy(p Policy) {
+	s.policy = p
+}
+
+// SetLenient determines whether messages that pass schema validation, but
+// fail semantic validation, are accepted. If so, the semantic errors are
+// logged, and reported as warnings to batch and streaming producers.
+//
+// By default, such messages are rejected, just as those failing schema
+// validation are.
+func (s *Ingestor) SetLenient(lenient bool) {
+	s.lenient = lenient
+}
+
 // RunHTTPIngestor sets up and runs the http listener that receives messages, validates
 // them against the provided schema, persists those that pass validation, then sends
 // them along to the interpretation layer via the server's interpret channel.
 //
+// Messages may be POSTed individually to /, in batches to /batch, or streamed
+// over a websocket opened at /stream. A message POSTed to /dry-run is
+// validated and previewed, but not persisted.
+//
 // This blocks on the http listening loop, so it should typically be called in its own goroutine.
 //
 // Closes the provided interpretation channel if/when the http server terminates.
@@ -86,20 +139,38 @@ func (s *Ingestor) RunHTTPIngestor(addr, key, cert string) error {
 		})
 	}
 
-	// Middleware to limit body length to MaxMessageSize
+	// Middleware to limit body length to MaxMessageSize, or the batch size for batches
 	mb.Use(func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			r.Body = http.MaxBytesReader(w, r.Body, s.maxMessageSize)
+			max := s.maxMessageSize
+			if r.URL.Path == "/batch" {
+				max = s.maxBatchSize
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
 			h.ServeHTTP(w, r)
 		})
 	})
 
 	mb.Post("/", s.handleMessage)
+	mb.Post("/batch", s.handleBatch)
+	mb.Get("/stream", s.handleStream)
+	mb.Post("/dry-run", s.handleDryRun)
+	s.publishMetrics()
 
+	srv := &graceful.Server{Addr: addr, Handler: mb}
 	if useTLS {
-		err = graceful.ListenAndServeTLS(addr, cert, key, mb)
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS10}
+		// Request, but don't require, client certs; producers may also
+		// authenticate by other means.
+		for _, a := range s.auth {
+			if ca, ok := a.(*CertAuth); ok {
+				srv.TLSConfig.ClientCAs = ca.Roots
+				srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		err = srv.ListenAndServeTLS(cert, key)
 	} else {
-		err = graceful.ListenAndServe(addr, mb)
+		err = srv.ListenAndServe()
 	}
 
 	if err != nil {
@@ -121,53 +192,356 @@ func (s *Ingestor) handleMessage(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		// Too long, or otherwise malformed request body
-		w.WriteHeader(400)
-		w.Write([]byte(err.Error()))
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeBadRequest, Message: err.Error()})
+		return
+	}
+
+	producer, ok := s.authorize(w, r, b)
+	if !ok {
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > MaxIdempotencyKeyLen {
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeBadRequest, Message: "Idempotency-Key header is too long"})
 		return
 	}
 
+	o := s.ingest(r, requestNote(r, 0), producer, b, key)
+	if o.RetryAfter > 0 {
+		retryAfter(w, o.RetryAfter)
+	}
+	if o.Record == nil {
+		writeErrors(w, o.Status, o.Errors...)
+		return
+	}
+
+	if !o.Created {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(o.Status)
+
+	// super-sloppy write back to client, but does the trick
+	_, err = w.Write([]byte(strconv.FormatUint(o.Record.Index, 10)))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system": "ingestor",
+			"err":    err,
+		}).Warn("Failed to write msgid back to client; continuing anyway.")
+	}
+
+	if o.Created {
+		// Records may reach the interpret channel in a different order than they
+		// went into the log; the sequencer in Interpret restores mlog order.
+		// Admission reserved room, so this does not block.
+		s.interpretChan <- o.Record
+	}
+}
+
+// outcome is the result of ingesting a single message.
+type outcome struct {
+	// The http status code corresponding to the outcome
+	Status int
+	// The record for the message, if it was accepted
+	Record *mlog.Record
+	// False if the record already existed, as the message was a retry
+	Created bool
+	// Reasons the message was rejected
+	Errors []errdoc.FieldError
+	// Semantic errors in an accepted message, if the ingestor is lenient
+	Warnings []errdoc.FieldError
+	// If non-zero, how long the producer should wait before retrying
+	RetryAfter time.Duration
+}
+
+// ingest validates and checks the policy for a single message from an
+// authenticated producer, then admits it and persists it to the mlog. If the
+// message's envelope has no idempotency key, the provided key, if any, is
+// used. Problems with the message are noted in the provided log.
+//
+// It is the caller's responsibility to send newly created records along for
+// interpretation.
+func (s *Ingestor) ingest(r *http.Request, note logNote, producer string, b []byte, key string) outcome {
 	result, err := s.schema.Validate(gjs.NewStringLoader(string(b)))
 	if err != nil {
 		// Malformed JSON, likely
-		// TODO add a body
-		w.WriteHeader(400)
-		w.Write([]byte(err.Error()))
+		return outcome{Status: 400, Errors: []errdoc.FieldError{{Code: errdoc.CodeMalformedJSON, Message: err.Error()}}}
+	}
+
+	if !result.Valid() {
+		// Invalid results, so 422 for malformed entity
+		return outcome{Status: 422, Errors: schemaErrors(result)}
+	}
+
+	errs, warnings := s.checkSemantics(note, b)
+	if len(errs) > 0 {
+		return outcome{Status: 422, Errors: errs}
+	}
+
+	if violations := s.checkPolicy(note, producer, b); len(violations) > 0 {
+		return outcome{Status: 403, Errors: violations}
+	}
+
+	if status, wait := s.admission(r, note, producer, 1); status != 0 {
+		return outcome{Status: status, Errors: []errdoc.FieldError{admissionErrors[status]}, RetryAfter: wait}
+	}
+
+	if k := idempotencyKey(b); k != "" {
+		key = k
+	}
+
+	// Index of message gets written by the LogStore
+	o := outcome{Status: 202, Created: true, Warnings: warnings} // use 202 because it's a little more correct
+	if key == "" {
+		o.Record, err = s.mlog.NewEntry(b, r.RemoteAddr, producer)
+	} else {
+		var records []*mlog.Record
+		var created []bool
+		records, created, err = s.mlog.NewEntries([][]byte{b}, []string{key}, r.RemoteAddr, producer)
+		if err == nil {
+			o.Record, o.Created = records[0], created[0]
+		}
+	}
+	if err != nil {
+		s.release(1)
+		// should we tell the client this?
+		return outcome{Status: 500, Errors: []errdoc.FieldError{{Code: errdoc.CodePersistFailed, Message: "Failed to persist message to mlog"}}}
+	}
+
+	if !o.Created {
+		// A retry of a message we already have; hand back the original index.
+		// It will not be merged again, so gives up its place in the queue.
+		s.release(1)
+		note(logrus.Fields{"duplicate-of": o.Record.Index})
+		o.Status = 200
+	}
+	return o
+}
+
+// authorize identifies the producer of the request. If that fails, a 401 is
+// written back to the client, and the reason is attached to the request log.
+func (s *Ingestor) authorize(w http.ResponseWriter, r *http.Request, body []byte) (string, bool) {
+	producer, err := s.authenticate(r, body)
+	if err != nil {
+		log.AddFields(r, logrus.Fields{"err": err})
+		writeErrors(w, 401, errdoc.FieldError{Code: errdoc.CodeUnauthenticated, Message: "Producer could not be authenticated"})
+		return "", false
+	}
+
+	if producer != "" {
+		log.AddFields(r, logrus.Fields{"producer": producer})
+	}
+	return producer, true
+}
+
+// checkSemantics validates the semantics of a message that has passed schema
+// validation. Any errors found are noted in the log, and returned either as
+// errors or, if the ingestor is lenient, as warnings.
+func (s *Ingestor) checkSemantics(note logNote, msg []byte) (errs, warnings []errdoc.FieldError) {
+	m := Message{}
+	json.Unmarshal(msg, &m)
+
+	problems := m.Validate()
+	if len(problems) == 0 {
+		return nil, nil
+	}
+
+	var ps []string
+	for _, p := range problems {
+		ps = append(ps, p.String())
+	}
+	note(logrus.Fields{"semantic-errors": ps})
+
+	if s.lenient {
+		return nil, problems
+	}
+	return problems, nil
+}
+
+// checkPolicy reports the ways in which the message violates the ingestor's
+// policy, if it has one. Any violations are noted in the log.
+func (s *Ingestor) checkPolicy(note logNote, producer string, msg []byte) []errdoc.FieldError {
+	if s.policy == nil {
+		return nil
+	}
+
+	violations := s.policy.Check(producer, msg)
+	if len(violations) > 0 {
+		var vs []string
+		for _, v := range violations {
+			vs = append(vs, v.String())
+		}
+		note(logrus.Fields{"violations": vs})
+	}
+	return violations
+}
+
+// A logNote notes fields about a message in the log.
+type logNote func(logrus.Fields)
+
+// requestNote notes fields about the message at the provided position in a
+// batch in the request log. The batch may carry several messages, so each
+// field is suffixed with the message's position, counting from 1; a position
+// of 0 is a message sent on its own, whose fields are noted as they are.
+func requestNote(r *http.Request, pos int) logNote {
+	return func(fields logrus.Fields) {
+		if pos == 0 {
+			log.AddFields(r, fields)
+			return
+		}
+
+		suffixed := make(logrus.Fields, len(fields))
+		for k, v := range fields {
+			suffixed[k+"."+strconv.Itoa(pos)] = v
+		}
+		log.AddFields(r, suffixed)
+	}
+}
+
+// MaxIdempotencyKeyLen is the maximum length of an idempotency key, matching
+// the limit the schema places on the key in the message envelope.
+const MaxIdempotencyKeyLen = 256
+
+// idempotencyKey returns the idempotency key in the envelope of the message,
+// if any. The message is assumed to have passed schema validation.
+func idempotencyKey(msg []byte) string {
+	var env struct {
+		Key string `json:"idempotency-key"`
+	}
+	json.Unmarshal(msg, &env)
+	return env.Key
+}
+
+// batchResult reports the outcome for a single message in a batch: either the
+// index it was persisted at, or the reasons it was rejected. Duplicate is set
+// when the message's idempotency key matched an earlier message, whose index
+// is reported instead.
+type batchResult struct {
+	Line      int                 `json:"line"`
+	Index     uint64              `json:"index,omitempty"`
+	Duplicate bool                `json:"duplicate,omitempty"`
+	Errors    []errdoc.FieldError `json:"errors,omitempty"`
+	Warnings  []errdoc.FieldError `json:"warnings,omitempty"`
+}
+
+// handleBatch accepts newline-delimited JSON messages. Each is validated
+// independently, then all valid messages are persisted to the mlog in a single
+// operation, with contiguous indices. Blank lines are ignored. Idempotency
+// keys are taken only from each message's envelope; the Idempotency-Key
+// header does not apply to batches.
+//
+// The response is a JSON array with a result for each message, in order. If
+// no message in the batch was valid, a 422 is returned, or a 403 if any were
+// rejected by the ingestor's policy.
+func (s *Ingestor) handleBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// The whole batch is needed to check a signature over it
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		// Too long, or otherwise malformed request body
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeBadRequest, Message: err.Error()})
 		return
 	}
 
-	if result.Valid() {
-		// Index of message gets written by the LogStore
-		record, err := s.mlog.NewEntry(b, r.RemoteAddr)
+	producer, ok := s.authorize(w, r, body)
+	if !ok {
+		return
+	}
+
+	var results []batchResult
+	var valid [][]byte
+	var keys []string
+	var validIdx []int
+	var forbidden bool
+
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 0, 64<<10), int(s.maxMessageSize)+1)
+	for line := 1; sc.Scan(); line++ {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		res := batchResult{Line: line}
+		result, err := s.schema.Validate(gjs.NewStringLoader(string(b)))
 		if err != nil {
-			w.WriteHeader(500)
-			// should we tell the client this?
-			w.Write([]byte("Failed to persist message to mlog"))
+			res.Errors = []errdoc.FieldError{{Code: errdoc.CodeMalformedJSON, Message: err.Error()}}
+		} else if !result.Valid() {
+			res.Errors = schemaErrors(result)
+		} else if errs, warnings := s.checkSemantics(requestNote(r, line), b); len(errs) > 0 {
+			res.Errors = errs
+		} else if violations := s.checkPolicy(requestNote(r, line), producer, b); len(violations) > 0 {
+			res.Errors = violations
+			forbidden = true
+		} else {
+			res.Warnings = warnings
+			// The scanner reuses its buffer, so the message must be copied out
+			valid = append(valid, append([]byte(nil), b...))
+			keys = append(keys, idempotencyKey(b))
+			validIdx = append(validIdx, len(results))
+		}
+		results = append(results, res)
+	}
+
+	if err := sc.Err(); err != nil {
+		// Too long, or otherwise malformed request body
+		writeErrors(w, 400, errdoc.FieldError{Code: errdoc.CodeBadRequest, Message: err.Error()})
+		return
+	}
+
+	status := 422
+	if forbidden {
+		status = 403
+	}
+	if len(valid) > 0 {
+		if !s.admit(w, r, producer, len(valid)) {
 			return
 		}
 
-		// super-sloppy write back to client, but does the trick
-		w.WriteHeader(202) // use 202 because it's a little more correct
-		_, err = w.Write([]byte(strconv.FormatUint(record.Index, 10)))
+		records, created, err := s.mlog.NewEntries(valid, keys, r.RemoteAddr, producer)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"system": "ingestor",
-				"err":    err,
-			}).Warn("Failed to write msgid back to client; continuing anyway.")
+			s.release(len(valid))
+			writeErrors(w, 500, errdoc.FieldError{Code: errdoc.CodePersistFailed, Message: "Failed to persist messages to mlog"})
+			return
 		}
 
-		// FIXME passing directly from here means it's possible for messages to arrive
-		// at the interpretation layer in a different order than they went into the log
-		// ...especially if go scheduler changes become less cooperative https://groups.google.com/forum/#!topic/golang-nuts/DbmqfDlAR0U (...?)
-
-		s.interpretChan <- record
-	} else {
-		// Invalid results, so write back 422 for malformed entity
-		w.WriteHeader(422)
-		var resp []string
-		for _, desc := range result.Errors() {
-			resp = append(resp, desc.String())
+		for k, record := range records {
+			results[validIdx[k]].Index = record.Index
+			results[validIdx[k]].Duplicate = !created[k]
+			if !created[k] {
+				s.release(1)
+			}
 		}
-		w.Write([]byte(strings.Join(resp, "\n")))
+		status = 202
+
+		// Merges still happen one record at a time; as with single messages,
+		// the sequencer keeps them in mlog order.
+		defer func() {
+			for k, record := range records {
+				if created[k] {
+					s.interpretChan <- record
+				}
+			}
+		}()
+	}
+
+	if results == nil {
+		results = []batchResult{}
+	}
+	j, err := json.Marshal(results)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(j); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system": "ingestor",
+			"err":    err,
+		}).Warn("Failed to write batch results back to client; continuing anyway.")
 	}
 }
 
@@ -178,16 +552,57 @@ func (s *Ingestor) handleMessage(w http.ResponseWriter, r *http.Request) {
 // The provided CoreGraph operates as the initial state into which received
 // messages will be successively merged.
 //
+// Records are merged in strict mlog index order, beginning with the index
+// immediately following the provided graph's MsgID(), regardless of the order
+// in which they arrive on the interpret channel.
+//
 // When the interpret channel is closed (and emptied), this function also closes
 // the broker channel.
 func (s *Ingestor) Interpret(g system.CoreGraph) {
-	for m := range s.interpretChan {
-		// TODO msgid here should be strictly sequential; check, and add error handling if not
-		im := Message{}
-		json.Unmarshal(m.Message, &im)
-		g = g.Merge(m.Index, im.UnificationForm())
+	s.setGraph(g)
+	sq := newSequencer(s.mlog, g.MsgID()+1, DefaultGapWait)
+	for m := range sq.run(s.interpretChan) {
+		if m.Index != g.MsgID()+1 {
+			// The sequencer makes this impossible, but the guarantee is important
+			// enough that it's worth checking anyway.
+			logrus.WithFields(logrus.Fields{
+				"system":   "interpret",
+				"msgid":    m.Index,
+				"expected": g.MsgID() + 1,
+			}).Error("Record arrived out of sequence; refusing to merge")
+			continue
+		}
 
+		g = mergeRecord(g, m)
+		s.release(1)
+		s.setGraph(g)
 		s.brokerChan <- g
 	}
 	close(s.brokerChan)
 }
+
+// Replay merges records retrieved from the mlog into the provided graph,
+// beginning with the index immediately following the graph's MsgID() and
+// ending with the provided index, inclusive.
+//
+// If a record cannot be retrieved, the graph as of the preceding record is
+// returned along with the error.
+func Replay(g system.CoreGraph, get mlog.RecordGetter, to uint64) (system.CoreGraph, error) {
+	for i := g.MsgID() + 1; i <= to; i++ {
+		rec, err := get(i)
+		if err != nil {
+			return g, err
+		}
+
+		g = mergeRecord(g, rec)
+	}
+
+	return g, nil
+}
+
+// mergeRecord interprets a single persisted record and merges it into the graph.
+func mergeRecord(g system.CoreGraph, rec *mlog.Record) system.CoreGraph {
+	im := Message{}
+	json.Unmarshal(rec.Message, &im)
+	return g.MergeAt(rec.Index, rec.Time(), im.UnificationForm())
+}
@@ -0,0 +1,241 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/log"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/schema"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func newTestIngestor(t *testing.T) *Ingestor {
+	src, err := schema.Master()
+	if err != nil {
+		t.Fatal("Failed to open master schema:", err)
+	}
+	sch, err := gjs.NewSchema(gjs.NewStringLoader(string(src)))
+	if err != nil {
+		t.Fatal("Failed to create schema object:", err)
+	}
+
+	return New(mem.NewMemStore(), sch, make(chan *mlog.Record, 100), make(chan system.CoreGraph), 5<<20)
+}
+
+func postBatch(t *testing.T, s *Ingestor, body string) (int, []batchResult) {
+	srv := httptest.NewServer(http.HandlerFunc(s.handleBatch))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("POST failed:", err)
+	}
+	defer resp.Body.Close()
+
+	var results []batchResult
+	if resp.StatusCode == 202 || resp.StatusCode == 422 || resp.StatusCode == 403 {
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal("Failed to decode batch results:", err)
+		}
+	}
+	return resp.StatusCode, results
+}
+
+func TestBatch(t *testing.T) {
+	s := newTestIngestor(t)
+	s.mlog.NewEntry([]byte(`{"environments":[{"address":{"hostname":"first"}}]}`), "127.0.0.1", "")
+
+	status, results := postBatch(t, s, strings.Join([]string{
+		`{"environments":[{"address":{"hostname":"a"}}]}`,
+		``,
+		`{"environments":[{"os":"plan9"}]}`,
+		`{not json`,
+		`{"environments":[{"address":{"hostname":"b"}}]}`,
+	}, "\n"))
+
+	if status != 202 {
+		t.Fatalf("Expected 202 for batch with valid messages, got %v", status)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected a result for each of the four messages, got %v", len(results))
+	}
+
+	expect := []struct {
+		line  int
+		index uint64
+		valid bool
+	}{{1, 2, true}, {3, 0, false}, {4, 0, false}, {5, 3, true}}
+	for k, e := range expect {
+		res := results[k]
+		if res.Line != e.line || res.Index != e.index || (len(res.Errors) == 0) != e.valid {
+			t.Errorf("Result %v: expected line %v, index %v, valid %v; got %+v", k, e.line, e.index, e.valid, res)
+		}
+	}
+
+	if count, _ := s.mlog.Count(); count != 3 {
+		t.Errorf("Expected only the two valid messages to be appended to the mlog, but it has %v records", count)
+	}
+	for _, idx := range []uint64{2, 3} {
+		if rec := <-s.interpretChan; rec.Index != idx {
+			t.Errorf("Expected batch records to be sent for interpretation in order, got %v instead of %v", rec.Index, idx)
+		}
+	}
+
+	status, results = postBatch(t, s, `{"environments":[{"os":"plan9"}]}`)
+	if status != 422 || len(results) != 1 || len(results[0].Errors) == 0 {
+		t.Errorf("Expected 422 with errors for batch with no valid messages, got %v %+v", status, results)
+	}
+	if count, _ := s.mlog.Count(); count != 3 {
+		t.Error("Nothing should be appended to the mlog for a batch with no valid messages")
+	}
+}
+
+// logCapture records the log entries it fires on.
+type logCapture struct {
+	sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (lc *logCapture) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel, logrus.WarnLevel}
+}
+
+func (lc *logCapture) Fire(e *logrus.Entry) error {
+	lc.Lock()
+	lc.entries = append(lc.entries, e)
+	lc.Unlock()
+	return nil
+}
+
+// capture installs a logCapture on the standard logger, at info level, until
+// the returned func is called.
+func capture() (*logCapture, func()) {
+	std := logrus.StandardLogger()
+	hooks, level := std.Hooks, std.Level
+	lc := &logCapture{}
+	std.Level = logrus.InfoLevel
+	std.Hooks = make(logrus.LevelHooks)
+	std.Hooks.Add(lc)
+	return lc, func() { std.Hooks, std.Level = hooks, level }
+}
+
+// captured returns the entries recorded so far with any of the given
+// messages, in order.
+func (lc *logCapture) captured(msgs ...string) []*logrus.Entry {
+	lc.Lock()
+	defer lc.Unlock()
+	var es []*logrus.Entry
+	for _, e := range lc.entries {
+		for _, msg := range msgs {
+			if e.Message == msg {
+				es = append(es, e)
+			}
+		}
+	}
+	return es
+}
+
+func TestBatchLogFields(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetPolicy(Policy{"": {Sections: []string{"environments", "logic-states"}, Hosts: []string{"a"}}})
+
+	lc, restore := capture()
+	defer restore()
+
+	body := strings.Join([]string{
+		`{"logic-states":[{"path":"/a","id":{"commit":"abcd"},"environment":{"address":{"hostname":"a"}}}]}`,
+		`{"environments":[{"address":{"hostname":"a"}}]}`,
+		`{"environments":[{"address":{"hostname":"a"},"logic-states":[{"path":"/b","id":{"commit":"xyz"}}]}]}`,
+		`{"environments":[{"address":{"hostname":"b"}}]}`,
+	}, "\n")
+	h := log.NewHTTPLogger("ingestor")(http.HandlerFunc(s.handleBatch))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+
+	entries := lc.captured("Request processing complete")
+	if len(entries) == 0 {
+		t.Fatal("Expected the request to be logged")
+	}
+	done := entries[len(entries)-1]
+	expect := map[string][]string{
+		"semantic-errors.1": {"logic-states[0].id.commit: must be a 40-character hexadecimal sha1"},
+		"semantic-errors.3": {"environments[0].logic-states[0].id.commit: must be a 40-character hexadecimal sha1"},
+		"violations.4":      {`environments[0].address: environment "b" is not a permitted host for this producer`},
+	}
+	for k, v := range expect {
+		if !reflect.DeepEqual(done.Data[k], v) {
+			t.Errorf("Expected log field %q to hold %q, got %v", k, v, done.Data[k])
+		}
+	}
+	for _, k := range []string{"semantic-errors", "violations", "semantic-errors.2", "violations.2"} {
+		if v, exists := done.Data[k]; exists {
+			t.Errorf("Expected no log field %q, got %v", k, v)
+		}
+	}
+}
+
+func TestIdempotentMessage(t *testing.T) {
+	s := newTestIngestor(t)
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func(body, key string) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	msg := `{"environments":[{"address":{"hostname":"a"}}]}`
+	if status, idx := post(msg, "abc"); status != 202 || idx != "1" {
+		t.Errorf("Expected first message to be accepted at index 1, got %v %q", status, idx)
+	}
+	if status, idx := post(msg, "abc"); status != 200 || idx != "1" {
+		t.Errorf("Expected retried message to return original index 1 with 200, got %v %q", status, idx)
+	}
+	if status, idx := post(msg, ""); status != 202 || idx != "2" {
+		t.Errorf("Expected message without a key to be appended at index 2, got %v %q", status, idx)
+	}
+
+	// The envelope key takes precedence over the header
+	keyed := `{"idempotency-key":"def","environments":[{"address":{"hostname":"a"}}]}`
+	if status, idx := post(keyed, "abc"); status != 202 || idx != "3" {
+		t.Errorf("Expected message with new envelope key to be appended at index 3, got %v %q", status, idx)
+	}
+	if status, idx := post(keyed, ""); status != 200 || idx != "3" {
+		t.Errorf("Expected retry with envelope key to return original index 3, got %v %q", status, idx)
+	}
+
+	if len(s.interpretChan) != 3 {
+		t.Errorf("Expected only new records to be sent for interpretation, got %v", len(s.interpretChan))
+	}
+
+	// Duplicates within and across batches
+	status, results := postBatch(t, s, strings.Join([]string{keyed, `{"idempotency-key":"ghi","environments":[{"address":{"hostname":"b"}}]}`, `{"idempotency-key":"ghi","environments":[{"address":{"hostname":"b"}}]}`}, "\n"))
+	if status != 202 {
+		t.Fatalf("Expected 202 for batch, got %v", status)
+	}
+	expect := []batchResult{{Line: 1, Index: 3, Duplicate: true}, {Line: 2, Index: 4}, {Line: 3, Index: 4, Duplicate: true}}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("Expected batch results %v, got %v", expect, results)
+	}
+	if n, _ := s.mlog.Count(); n != 4 {
+		t.Errorf("Expected 4 records in the mlog, found %v", n)
+	}
+}
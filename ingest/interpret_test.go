@@ -11,6 +11,7 @@ import (
 	"github.com/pipeviz/pipeviz/fixtures"
 	"github.com/pipeviz/pipeviz/ingest"
 	"github.com/pipeviz/pipeviz/schema"
+	"github.com/pipeviz/pipeviz/types/system"
 )
 
 var (
@@ -46,7 +47,7 @@ func init() {
 }
 
 // Reads all message fixtures from fixtures/ein and validates them
-// against the master message schema (schema.json).
+// against the master message schema (schema.json), and semantically.
 func TestMessageValidity(t *testing.T) {
 	files, err := ioutil.ReadDir("../fixtures/ein/")
 	if err != nil {
@@ -76,6 +77,108 @@ func TestMessageValidity(t *testing.T) {
 				t.Errorf("%s\n", strings.Replace(desc.String(), "root", f.Name(), 1))
 			}
 		}
+
+		m := ingest.Message{}
+		json.Unmarshal(src, &m)
+		for _, e := range m.Validate() {
+			t.Errorf("%s: %s", f.Name(), e)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	valid := `{"tombstones": {
+		"environments": [{"address": {"hostname": "foo"}}],
+		"processes": [{"pid": 42, "environment": {"address": {"hostname": "foo"}}}],
+		"logic-states": [{"path": "/bar", "environment": {"address": {"hostname": "foo"}}}],
+		"commits": [{"sha1": "0000000000000000000000000000000000000001"}],
+		"commit-meta": [{"sha1": "0000000000000000000000000000000000000001", "branches": ["baz"]}]
+	}}`
+
+	result, err := masterSchema.Validate(gjs.NewStringLoader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range result.Errors() {
+		t.Errorf("Valid tombstone message failed validation: %s", desc)
+	}
+
+	invalid := []string{
+		`{"tombstones": {"processes": [{"pid": 42}]}}`,
+		`{"tombstones": {"environments": [{"nick": "foo"}]}}`,
+		`{"tombstones": {"tombstones": {}}}`,
+		`{"tombstones": {"commits": [{"sha1": "01", "author": "someone"}]}}`,
+	}
+	for _, src := range invalid {
+		result, err := masterSchema.Validate(gjs.NewStringLoader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Valid() {
+			t.Errorf("Expected tombstone message to fail validation: %s", src)
+		}
+	}
+
+	m := &ingest.Message{}
+	if err := json.Unmarshal([]byte(valid), m); err != nil {
+		t.Fatal(err)
+	}
+
+	uifs := m.UnificationForm()
+	if len(uifs) != 5 {
+		t.Fatalf("Expected five unify instructions from the tombstones, got %v", len(uifs))
+	}
+	for _, u := range uifs {
+		if _, ok := u.(system.Tombstone); !ok {
+			t.Errorf("Expected all unify instructions from tombstones to be wrapped in system.Tombstone, got %T", u)
+		}
+	}
+}
+
+func TestAuthoritative(t *testing.T) {
+	valid := `{"authoritative": [
+		{"environment": {"address": {"hostname": "foo"}}, "kinds": ["processes", "logic-states"]}
+	]}`
+
+	result, err := masterSchema.Validate(gjs.NewStringLoader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range result.Errors() {
+		t.Errorf("Valid authoritative message failed validation: %s", desc)
+	}
+
+	invalid := []string{
+		`{"authoritative": [{"environment": {"address": {"hostname": "foo"}}}]}`,
+		`{"authoritative": [{"environment": {"address": {"hostname": "foo"}}, "kinds": []}]}`,
+		`{"authoritative": [{"environment": {"address": {"hostname": "foo"}}, "kinds": ["commits"]}]}`,
+		`{"authoritative": [{"kinds": ["processes"]}]}`,
+	}
+	for _, src := range invalid {
+		result, err := masterSchema.Validate(gjs.NewStringLoader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Valid() {
+			t.Errorf("Expected authoritative message to fail validation: %s", src)
+		}
+	}
+
+	m := &ingest.Message{}
+	if err := json.Unmarshal([]byte(valid), m); err != nil {
+		t.Fatal(err)
+	}
+
+	uifs := m.UnificationForm()
+	if len(uifs) != 1 {
+		t.Fatalf("Expected one unify instruction from the authoritative scope, got %v", len(uifs))
+	}
+	as, ok := uifs[0].(system.AuthoritativeScope)
+	if !ok {
+		t.Fatalf("Expected unify instruction to be a system.AuthoritativeScope, got %T", uifs[0])
+	}
+	if len(as.VTypes) != 3 || as.EType != "envlink" {
+		t.Errorf("Expected scope over process, comm and logic-state via envlink, got %v via %v", as.VTypes, as.EType)
 	}
 }
 
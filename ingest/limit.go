@@ -0,0 +1,215 @@
+package ingest
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+)
+
+// SaturatedRetryAfter is the delay suggested to clients turned away because
+// the interpretation queue is full.
+const SaturatedRetryAfter = time.Second
+
+// metrics are published as expvars under "ingest".
+var metrics = expvar.NewMap("ingest")
+
+// rateLimiter is a set of token buckets, one per key, that each refill at a
+// fixed rate up to a maximum burst.
+//
+// A full bucket is no different from one that does not exist yet, so buckets
+// are swept away once they have refilled, and have gone unused for a further
+// refill period. Keys that come and go, such as remote hosts, do not pile up.
+type rateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// refill is the time it takes an empty bucket to fill.
+func (l *rateLimiter) refill() time.Duration {
+	return time.Duration(l.burst / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that have been full and unused for at least a
+// refill period. It does the work at most once per refill period.
+func (l *rateLimiter) sweep(now time.Time) {
+	refill := l.refill()
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	l.swept = now
+
+	for key, b := range l.buckets {
+		full := b.last.Add(time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second)))
+		if now.Sub(full) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// take attempts to remove n tokens from the bucket for the key. If there are
+// not enough, nothing is removed, and the time until there will be is
+// returned. Requests for more than the burst are treated as requests for the
+// full burst, so that they can eventually succeed.
+func (l *rateLimiter) take(key string, n int, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweep(now)
+	want := math.Min(float64(n), l.burst)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < want {
+		return false, time.Duration((want - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens -= want
+	return true, 0
+}
+
+// SetRateLimit limits each producer to the given number of messages per
+// second, with bursts of up to the given size. Producers are distinguished
+// by their authenticated identity, or by remote host if they have none.
+//
+// A rate of zero (the default) disables rate limiting.
+func (s *Ingestor) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		s.limiter = nil
+		return
+	}
+	s.limiter = newRateLimiter(rate, burst)
+}
+
+// admission decides whether n messages from the producer may be accepted
+// now. If not, it returns the status with which to turn them away, and how
+// long the client should wait before trying again.
+//
+// Messages are turned away with a 503 if the interpretation queue does not
+// have room for them, or a 429 if the producer has exceeded its rate limit.
+// Tokens are only taken from the producer once there is room, so a producer
+// turned away with a 503 may retry without having used up its rate.
+//
+// Admitted messages hold a place in the queue until they are merged. Callers
+// must release the places of any that will not be: see release.
+//
+// Admission comes after validation and policy checks, for single messages and
+// batches alike, so rejected messages neither consume a producer's tokens nor
+// wait on the queue.
+func (s *Ingestor) admission(r *http.Request, note logNote, producer string, n int) (int, time.Duration) {
+	if !s.reserve(n) {
+		metrics.Add("Saturated", 1)
+		note(logrus.Fields{"queue-depth": s.queueDepth()})
+		return 503, SaturatedRetryAfter
+	}
+
+	if s.limiter != nil {
+		key := producer
+		if key == "" {
+			key, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+
+		if ok, wait := s.limiter.take(key, n, time.Now()); !ok {
+			s.release(n)
+			metrics.Add("RateLimited", 1)
+			note(logrus.Fields{"retry-after": wait.String()})
+			return 429, wait
+		}
+	}
+
+	return 0, 0
+}
+
+// reserve takes places in the queue for n messages, if there is room for
+// them. The queue counts every message from admission until it is merged,
+// whether it is waiting on the interpret channel or in the sequencer.
+//
+// There must be room for the whole batch, unless it is larger than the queue
+// itself, in which case an empty queue will have to do.
+func (s *Ingestor) reserve(n int) bool {
+	max := int64(cap(s.interpretChan))
+	depth := atomic.AddInt64(&s.backlog, int64(n))
+	if depth > max && depth > int64(n) {
+		atomic.AddInt64(&s.backlog, -int64(n))
+		return false
+	}
+	return true
+}
+
+// release gives up the places in the queue held by n messages, either because
+// they have been merged, or because they never will be: they were duplicates,
+// or could not be persisted.
+func (s *Ingestor) release(n int) {
+	atomic.AddInt64(&s.backlog, -int64(n))
+}
+
+// queueDepth is the number of admitted messages that have not yet been merged.
+func (s *Ingestor) queueDepth() int64 {
+	return atomic.LoadInt64(&s.backlog)
+}
+
+// admit is admission for http handlers; if the messages are not admitted,
+// the response, with a Retry-After header, is written back to the client.
+func (s *Ingestor) admit(w http.ResponseWriter, r *http.Request, producer string, n int) bool {
+	status, wait := s.admission(r, requestNote(r, 0), producer, n)
+	if status == 0 {
+		return true
+	}
+
+	retryAfter(w, wait)
+	writeErrors(w, status, admissionErrors[status])
+	return false
+}
+
+var admissionErrors = map[int]errdoc.FieldError{
+	429: {Code: errdoc.CodeRateLimited, Message: "Rate limit exceeded"},
+	503: {Code: errdoc.CodeQueueFull, Message: "Interpretation queue is full"},
+}
+
+// retryAfter sets the Retry-After header, in whole seconds, rounding up.
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// publishMetrics publishes the depth and capacity of the ingestor's
+// interpretation queue as expvars.
+func (s *Ingestor) publishMetrics() {
+	metrics.Set("QueueDepth", expvar.Func(func() interface{} { return s.queueDepth() }))
+	metrics.Set("QueueCapacity", expvar.Func(func() interface{} { return cap(s.interpretChan) }))
+}
@@ -0,0 +1,240 @@
+package ingest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/represent"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", 1, now); !ok {
+			t.Fatalf("Expected take %v within burst to succeed", i)
+		}
+	}
+	ok, wait := l.take("a", 1, now)
+	if ok {
+		t.Fatal("Expected take beyond burst to fail")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for a token at 2/s, got %v", wait)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := l.take("b", 1, now); !ok {
+		t.Error("Expected a different key to be unaffected")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.take("a", 2, now); !ok {
+		t.Error("Expected two tokens to have refilled after 1s")
+	}
+
+	// Requests larger than the burst need only a full bucket
+	now = now.Add(time.Hour)
+	if ok, _ := l.take("a", 10, now); !ok {
+		t.Error("Expected oversized take to succeed with a full bucket")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(2, 4) // refills in 2s
+	now := time.Now()
+
+	l.take("idle", 1, now)
+	l.take("busy", 1, now)
+	for i := 1; i <= 8; i++ {
+		// Keeps the busy bucket from ever filling
+		l.take("busy", 1, now.Add(time.Duration(i)*500*time.Millisecond))
+	}
+
+	// The idle bucket was full after 0.5s, and unused for 2s after that
+	now = now.Add(4 * time.Second)
+	l.take("other", 1, now)
+	if _, exists := l.buckets["idle"]; exists {
+		t.Error("Expected bucket that has sat full and unused to be swept")
+	}
+	if _, exists := l.buckets["busy"]; !exists {
+		t.Error("Expected bucket in use not to be swept")
+	}
+
+	for i := 0; i < 1000; i++ {
+		l.take(strconv.Itoa(i), 1, now)
+	}
+	l.take("other", 1, now.Add(time.Minute))
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected all but the most recently used bucket to be swept, %v remain", len(l.buckets))
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	s := newTestIngestor(t)
+	s.interpretChan = make(chan *mlog.Record, 3)
+	s.SetRateLimit(1, 2)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func() *http.Response {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"environments":[{"address":{"hostname":"a"}}]}`))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := post(); resp.StatusCode != 202 {
+			t.Fatalf("Expected message %v to be accepted, got %v", i, resp.StatusCode)
+		}
+	}
+
+	resp := post()
+	if resp.StatusCode != 429 {
+		t.Errorf("Expected 429 once over the rate limit, got %v", resp.StatusCode)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "1" {
+		t.Errorf("Expected Retry-After of 1s, got %q", ra)
+	}
+
+	// The rate limited message gave up its place in the queue
+	s.SetRateLimit(0, 0)
+	if resp := post(); resp.StatusCode != 202 {
+		t.Errorf("Expected message to be accepted with room in the queue, got %v", resp.StatusCode)
+	}
+
+	// Nothing is merging records, so the queue now holds three
+	s.SetRateLimit(1, 1)
+	for i := 0; i < 3; i++ {
+		resp = post()
+		if resp.StatusCode != 503 {
+			t.Errorf("Expected 503 with a full queue, got %v", resp.StatusCode)
+		}
+		if ra := resp.Header.Get("Retry-After"); ra == "" {
+			t.Error("Expected Retry-After with 503")
+		}
+	}
+
+	// Merging makes room; the producer's token was not spent on the 503s
+	<-s.interpretChan
+	s.release(1)
+	if resp := post(); resp.StatusCode != 202 {
+		t.Errorf("Expected message to be accepted once the queue had room, got %v", resp.StatusCode)
+	}
+	if n, _ := s.mlog.Count(); n != 4 {
+		t.Errorf("Expected rejected messages not to be persisted, found %v in mlog", n)
+	}
+}
+
+func TestAdmissionCountsSequencedRecords(t *testing.T) {
+	s := newTestIngestor(t)
+	s.interpretChan = make(chan *mlog.Record, 2)
+	go s.Interpret(represent.NewGraph())
+	defer func() {
+		close(s.interpretChan)
+		for range s.brokerChan {
+		}
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func() int {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"environments":[{"address":{"hostname":"a"}}]}`))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for", what)
+			}
+		}
+	}
+
+	// The first record is merged, then the interpreter blocks on the broker
+	post()
+	waitFor("first record to be merged", func() bool {
+		g := s.latestGraph()
+		return g != nil && g.MsgID() == 1
+	})
+	if depth := s.queueDepth(); depth != 0 {
+		t.Errorf("Expected merged record to leave the queue, depth is %v", depth)
+	}
+
+	// The sequencer drains these from the interpret channel, but they are
+	// still waiting to be merged
+	for i := 0; i < 2; i++ {
+		if status := post(); status != 202 {
+			t.Fatalf("Expected message %v to be accepted, got %v", i, status)
+		}
+	}
+	waitFor("sequencer to drain the interpret channel", func() bool { return len(s.interpretChan) == 0 })
+
+	if status := post(); status != 503 {
+		t.Errorf("Expected 503 with records waiting in the sequencer, got %v", status)
+	}
+	s.publishMetrics()
+	if depth := metrics.Get("QueueDepth").String(); depth != "2" {
+		t.Errorf("Expected QueueDepth metric of 2, got %v", depth)
+	}
+}
+
+func TestAdmissionAfterValidation(t *testing.T) {
+	s := newTestIngestor(t)
+	s.interpretChan = make(chan *mlog.Record, 2)
+	s.SetRateLimit(1, 1)
+
+	single := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer single.Close()
+	batch := httptest.NewServer(http.HandlerFunc(s.handleBatch))
+	defer batch.Close()
+
+	post := func(url, body string) int {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Invalid messages are rejected as such, on either path, without using up
+	// the producer's one token
+	for i := 0; i < 3; i++ {
+		if status := post(single.URL, `{"environments":[{}]}`); status != 422 {
+			t.Errorf("Expected invalid message to be rejected with 422, got %v", status)
+		}
+		if status := post(batch.URL, `{"environments":[{}]}`+"\n"+`not json`); status != 422 {
+			t.Errorf("Expected batch of invalid messages to be rejected with 422, got %v", status)
+		}
+	}
+
+	if status := post(single.URL, `{"environments":[{"address":{"hostname":"a"}}]}`); status != 202 {
+		t.Fatalf("Expected valid message to be admitted after invalid ones, got %v", status)
+	}
+
+	// Now out of tokens; invalid messages are still 422s
+	if status := post(single.URL, `{"environments":[{}]}`); status != 422 {
+		t.Errorf("Expected invalid message to be rejected with 422 when it would not be admitted, got %v", status)
+	}
+	if status := post(batch.URL, `{"environments":[{}]}`); status != 422 {
+		t.Errorf("Expected invalid batch to be rejected with 422 when it would not be admitted, got %v", status)
+	}
+	if status := post(single.URL, `{"environments":[{"address":{"hostname":"b"}}]}`); status != 429 {
+		t.Errorf("Expected valid message to be rate limited, got %v", status)
+	}
+}
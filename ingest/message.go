@@ -2,8 +2,10 @@ package ingest
 
 import (
 	"errors"
+	"strconv"
 
 	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
 	"github.com/pipeviz/pipeviz/types/semantic"
 	"github.com/pipeviz/pipeviz/types/system"
 )
@@ -26,6 +28,14 @@ type Message struct {
 	C   []semantic.Commit        `json:"commits,omitempty"`
 	Cm  []semantic.CommitMeta    `json:"commit-meta,omitempty"`
 	Yp  []semantic.PkgYum        `json:"yum-pkg,omitempty"`
+	// Things to be removed from the graph. Only the data needed to identify
+	// each thing is required.
+	Tomb *Message `json:"tombstones,omitempty"`
+	// Scopes for which this message is a complete report. Things within a
+	// scope that the message does not mention are removed from the graph.
+	Auth []semantic.EnvScope `json:"authoritative,omitempty"`
+	// Identifies the message across retries by its producer.
+	Key string `json:"idempotency-key,omitempty"`
 }
 
 // UnificationForm translates all data in the message into the standard
@@ -71,9 +81,74 @@ func (m Message) UnificationForm() []system.UnifyInstructionForm {
 		ret = append(ret, e.UnificationForm()...)
 	}
 
+	if m.Tomb != nil {
+		logEntry.Debug("Preparing to translate tombstones into UnifyInstructionForm")
+		for _, u := range m.Tomb.UnificationForm() {
+			ret = append(ret, system.Tombstone{UnifyInstructionForm: u})
+		}
+	}
+
+	for _, e := range m.Auth {
+		logEntry.WithField("vtype", "environment").Debug("Preparing to translate authoritative scope into UnifyInstructionForm")
+		ret = append(ret, e.UnificationForm()...)
+	}
+
 	return ret
 }
 
+// Validate reports problems with the message that its schema cannot express,
+// such as malformed sha1s, or data that cannot be linked to an environment.
+// Such data is dropped, or left unconnected, when the message is merged.
+func (m Message) Validate() []errdoc.FieldError {
+	return m.validate(nil)
+}
+
+func (m Message) validate(prefix []string) []errdoc.FieldError {
+	var errs []errdoc.FieldError
+	check := func(section string, k int, v semantic.Validator) {
+		for _, e := range v.Validate() {
+			path := append(append(append([]string(nil), prefix...), section, strconv.Itoa(k)), e.Path...)
+			errs = append(errs, errdoc.FieldError{
+				Code:    errdoc.CodeSemanticError,
+				Pointer: jsonPointer(path),
+				Section: sectionPath(path),
+				Message: e.Message,
+			})
+		}
+	}
+
+	for k, e := range m.Env {
+		check("environments", k, e)
+	}
+	for k, e := range m.Ls {
+		check("logic-states", k, e)
+	}
+	for k, e := range m.Pds {
+		check("datasets", k, e)
+	}
+	for k, e := range m.P {
+		check("processes", k, e)
+	}
+	for k, e := range m.C {
+		check("commits", k, e)
+	}
+	for k, e := range m.Cm {
+		check("commit-meta", k, e)
+	}
+	for k, e := range m.Yp {
+		check("yum-pkg", k, e)
+	}
+	for k, e := range m.Auth {
+		check("authoritative", k, e)
+	}
+
+	if m.Tomb != nil {
+		errs = append(errs, m.Tomb.validate(append(prefix, "tombstones"))...)
+	}
+
+	return errs
+}
+
 // Add adds an object to the data in the message.
 //
 // The semantics here are generally additive - if it makes sense for one object to be merged into
@@ -141,6 +216,8 @@ func (m *Message) Add(d system.Unifier) error {
 			m.Yp = make([]semantic.PkgYum, 0)
 		}
 		m.Yp = append(m.Yp, obj)
+	case semantic.EnvScope:
+		m.Auth = append(m.Auth, obj)
 	default:
 		return errors.New("type not supported")
 	}
@@ -0,0 +1,144 @@
+package ingest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+)
+
+const zeroSha1 = "0000000000000000000000000000000000000000"
+
+func TestMessageValidate(t *testing.T) {
+	tt := []struct {
+		name   string
+		msg    string
+		errors []string
+	}{
+		{
+			name: "valid",
+			msg:  `{"environments": [{"address": {"hostname": "a"}, "logic-states": [{"path": "/a", "id": {"commit": "` + zeroSha1 + `"}}]}], "processes": [{"pid": 1, "environment": {"nick": "a"}}]}`,
+		},
+		{
+			name:   "short logic state commit",
+			msg:    `{"logic-states": [{"path": "/a", "id": {"commit": "abcd"}, "environment": {"address": {"hostname": "a"}}}]}`,
+			errors: []string{"logic-states[0].id.commit: must be a 40-character hexadecimal sha1"},
+		},
+		{
+			name:   "nested logic state commit",
+			msg:    `{"environments": [{"address": {"hostname": "a"}, "logic-states": [{"path": "/a", "id": {"commit": "xyz"}}]}]}`,
+			errors: []string{"environments[0].logic-states[0].id.commit: must be a 40-character hexadecimal sha1"},
+		},
+		{
+			name: "bad commit and parent",
+			msg:  `{"commits": [{"sha1": "abc", "parents": ["` + zeroSha1 + `", "12"]}]}`,
+			errors: []string{
+				"commits[0].sha1: must be a 40-character hexadecimal sha1",
+				"commits[0].parents[1]: must be a 40-character hexadecimal sha1",
+			},
+		},
+		{
+			name:   "process without environment",
+			msg:    `{"processes": [{"pid": 1}]}`,
+			errors: []string{"processes[0].environment: must identify an environment by address or nick"},
+		},
+		{
+			name:   "environment without identity",
+			msg:    `{"environments": [{"os": "linux"}]}`,
+			errors: []string{"environments[0]: must have an address or nick"},
+		},
+		{
+			name: "empty yum package",
+			msg:  `{"yum-pkg": [{"name": "bash", "version": "4.2", "release": "1", "epoch": 0, "arch": "x86_64"}, {"name": "", "version": "", "release": "", "epoch": 0, "arch": "noarch"}]}`,
+			errors: []string{
+				"yum-pkg[1].name: must not be empty",
+				"yum-pkg[1].version: must not be empty",
+			},
+		},
+		{
+			name:   "scope without environment",
+			msg:    `{"authoritative": [{"environment": {"address": {"hostname": "a"}}, "kinds": ["processes"]}, {"environment": {}, "kinds": ["datasets"]}]}`,
+			errors: []string{"authoritative[1].environment: must identify an environment by address or nick"},
+		},
+		{
+			name:   "tombstoned commit meta",
+			msg:    `{"tombstones": {"commit-meta": [{"sha1": "1"}]}}`,
+			errors: []string{"tombstones.commit-meta[0].sha1: must be a 40-character hexadecimal sha1"},
+		},
+	}
+
+	for _, c := range tt {
+		m := Message{}
+		if err := json.Unmarshal([]byte(c.msg), &m); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		var errors []string
+		for _, e := range m.Validate() {
+			if e.Code != errdoc.CodeSemanticError {
+				t.Errorf("%s: expected code %q, got %q", c.name, errdoc.CodeSemanticError, e.Code)
+			}
+			errors = append(errors, e.String())
+		}
+		if !reflect.DeepEqual(errors, c.errors) {
+			t.Errorf("%s: expected errors %q, got %q", c.name, c.errors, errors)
+		}
+	}
+
+	m := Message{}
+	json.Unmarshal([]byte(`{"commits": [{"sha1": "abc", "parents": ["12"]}]}`), &m)
+	if p := m.Validate()[1].Pointer; p != "/commits/0/parents/0" {
+		t.Errorf("Expected pointer to the bad parent, got %q", p)
+	}
+}
+
+func TestSemanticValidation(t *testing.T) {
+	s := newTestIngestor(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	msg := `{"processes": [{"pid": 1, "logic-states": ["/a"]}]}`
+	post := func() (int, errdoc.ErrorDoc) {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(msg))
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, errdoc.Parse(resp.StatusCode, b)
+	}
+
+	status, doc := post()
+	if status != 422 {
+		t.Fatalf("Expected 422 for semantically invalid message, got %v", status)
+	}
+	if len(doc.Errors) != 1 || doc.Errors[0].Code != errdoc.CodeSemanticError || doc.Errors[0].Pointer != "/processes/0/environment" {
+		t.Errorf("Expected one semantic error at the process's environment, got %+v", doc.Errors)
+	}
+
+	status, results := postBatch(t, s, `{"environments": [{"address": {"hostname": "a"}}]}`+"\n"+msg)
+	if status != 202 || len(results) != 2 || results[0].Errors != nil || len(results[1].Errors) != 1 {
+		t.Errorf("Expected batch to reject only the semantically invalid message, got %v %+v", status, results)
+	}
+	<-s.interpretChan
+
+	s.SetLenient(true)
+	if status, _ := post(); status != 202 {
+		t.Errorf("Expected lenient ingestor to accept message, got %v", status)
+	}
+	<-s.interpretChan
+
+	status, results = postBatch(t, s, msg)
+	if status != 202 || len(results) != 1 || results[0].Errors != nil || len(results[0].Warnings) != 1 {
+		t.Errorf("Expected lenient ingestor to accept batch message with a warning, got %v %+v", status, results)
+	}
+	if n, _ := s.mlog.Count(); n != 3 {
+		t.Errorf("Expected three messages in the mlog, found %v", n)
+	}
+}
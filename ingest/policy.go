@@ -0,0 +1,218 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+	"github.com/pipeviz/pipeviz/types/semantic"
+)
+
+// ProducerSelf may be used in a producer's list of hosts to stand for the
+// producer's own name, for producers identified by the host they run on.
+const ProducerSelf = "$producer"
+
+// Policy restricts what each producer may assert in the messages it sends,
+// keyed by producer name. Producers that do not appear in the policy may not
+// send anything.
+type Policy map[string]ProducerPolicy
+
+// ProducerPolicy describes what a single producer may assert.
+type ProducerPolicy struct {
+	// The top-level message sections the producer may send, e.g. "commits".
+	Sections []string `json:"sections"`
+	// If non-empty, every environment the producer describes or refers to must
+	// have a hostname or ip address in this list.
+	//
+	// An environment referred to only by its nick is permitted if the same
+	// message also describes an environment with that nick, at a permitted
+	// address. Nicks are not checked against this list, as they need not be
+	// unique, and any other reference by nick is rejected.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// LoadPolicy reads a policy from a JSON file, of the form:
+//
+//	{
+//	    "yum-agent": {"sections": ["yum-pkg", "logic-states"], "hosts": ["$producer"]},
+//	    "github": {"sections": ["commits", "commit-meta"]}
+//	}
+func LoadPolicy(path string) (Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return p, nil
+}
+
+// Check reports the ways in which the given message, sent by the given
+// producer, violates the policy, located at the section of the message in
+// which they occur. No violations means the message is permitted.
+//
+// The message is assumed to have already passed schema validation.
+func (p Policy) Check(producer string, msg []byte) []errdoc.FieldError {
+	pp, exists := p[producer]
+	if !exists {
+		return []errdoc.FieldError{{
+			Code:    errdoc.CodePolicyViolation,
+			Message: fmt.Sprintf("producer %q is not permitted to send messages", producer),
+		}}
+	}
+
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &sections); err != nil {
+		return []errdoc.FieldError{{Code: errdoc.CodeMalformedJSON, Message: err.Error()}}
+	}
+	m := Message{}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return []errdoc.FieldError{{Code: errdoc.CodeMalformedJSON, Message: err.Error()}}
+	}
+
+	c := policyCheck{
+		allowed: make(map[string]bool),
+		hosts:   make(map[string]bool),
+		nicks:   make(map[string]bool),
+	}
+	for _, s := range pp.Sections {
+		c.allowed[s] = true
+	}
+	for _, h := range pp.Hosts {
+		if h == ProducerSelf {
+			h = producer
+		}
+		c.hosts[h] = true
+	}
+
+	for _, name := range sortedKeys(sections) {
+		// Part of the envelope, rather than an assertion
+		if name != "idempotency-key" {
+			c.section(nil, name)
+		}
+	}
+	// Tombstones are themselves a message, whose sections must also be permitted
+	if raw, exists := sections["tombstones"]; exists {
+		var tsections map[string]json.RawMessage
+		json.Unmarshal(raw, &tsections)
+		for _, name := range sortedKeys(tsections) {
+			c.section([]string{"tombstones"}, name)
+		}
+	}
+	c.message(nil, m)
+
+	return c.violations
+}
+
+// policyCheck accumulates the violations found in a single message.
+type policyCheck struct {
+	allowed map[string]bool
+	hosts   map[string]bool
+	// Nicks of environments in the message at permitted addresses
+	nicks      map[string]bool
+	violations []errdoc.FieldError
+}
+
+func (c *policyCheck) violate(path []string, format string, a ...interface{}) {
+	c.violations = append(c.violations, errdoc.FieldError{
+		Code:    errdoc.CodePolicyViolation,
+		Pointer: jsonPointer(path),
+		Section: sectionPath(path),
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (c *policyCheck) section(prefix []string, name string) {
+	if !c.allowed[name] {
+		c.violate(append(prefix, name), "section not permitted for this producer")
+	}
+}
+
+func (c *policyCheck) permitted(a semantic.Address) bool {
+	if len(c.hosts) == 0 {
+		return true
+	}
+
+	for _, h := range []string{a.Hostname, a.Ipv4, a.Ipv6} {
+		if h != "" && c.hosts[h] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *policyCheck) address(path []string, a semantic.Address) {
+	if !c.permitted(a) {
+		c.violate(path, "environment %s is not a permitted host for this producer", describeAddress(a))
+	}
+}
+
+// link checks an envlink, resolving a nick-only link against the environments
+// described in the message.
+func (c *policyCheck) link(path []string, l semantic.EnvLink) {
+	if l.Address == (semantic.Address{}) && l.Nick != "" && len(c.hosts) > 0 {
+		if !c.nicks[l.Nick] {
+			c.violate(path, "environment with nick %q is not described at a permitted host in this message", l.Nick)
+		}
+		return
+	}
+	c.address(path, l.Address)
+}
+
+// message checks the environments referred to by the message, including its
+// tombstones.
+func (c *policyCheck) message(prefix []string, m Message) {
+	at := func(section string, k int, field string) []string {
+		return append(append([]string(nil), prefix...), section, strconv.Itoa(k), field)
+	}
+
+	for k, e := range m.Env {
+		c.address(at("environments", k, "address"), e.Address)
+		if e.Nick != "" && c.permitted(e.Address) {
+			c.nicks[e.Nick] = true
+		}
+	}
+	for k, l := range m.Ls {
+		c.link(at("logic-states", k, "environment"), l.Environment)
+	}
+	for k, d := range m.Pds {
+		c.link(at("datasets", k, "environment"), d.Environment)
+	}
+	for k, p := range m.P {
+		c.link(at("processes", k, "environment"), p.Environment)
+	}
+	for k, s := range m.Auth {
+		c.link(at("authoritative", k, "environment"), s.Environment)
+	}
+
+	if m.Tomb != nil {
+		c.message(append(append([]string(nil), prefix...), "tombstones"), *m.Tomb)
+	}
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describeAddress(a semantic.Address) string {
+	switch {
+	case a.Hostname != "":
+		return fmt.Sprintf("%q", a.Hostname)
+	case a.Ipv4 != "":
+		return fmt.Sprintf("%q", a.Ipv4)
+	case a.Ipv6 != "":
+		return fmt.Sprintf("%q", a.Ipv6)
+	}
+	return "without an address"
+}
@@ -0,0 +1,160 @@
+package ingest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+)
+
+var testPolicy = Policy{
+	"web01":   {Sections: []string{"yum-pkg", "logic-states"}, Hosts: []string{ProducerSelf, "10.0.0.1"}},
+	"github":  {Sections: []string{"commits", "commit-meta"}},
+	"janitor": {Sections: []string{"tombstones", "environments"}},
+	// Nicks are never in the list of hosts; see ProducerPolicy
+	"janitor-web01": {Sections: []string{"environments", "processes"}, Hosts: []string{"web01", "db"}},
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tt := []struct {
+		name       string
+		producer   string
+		msg        string
+		violations []string
+	}{
+		{
+			name:     "permitted sections",
+			producer: "github",
+			msg:      `{"commits": [{"sha1": "abc"}], "commit-meta": [{"sha1": "abc"}]}`,
+		},
+		{
+			name:       "forbidden section",
+			producer:   "github",
+			msg:        `{"commits": [{"sha1": "abc"}], "processes": [{"pid": 1}], "environments": [{"address": {"hostname": "web01"}}]}`,
+			violations: []string{"environments: section not permitted for this producer", "processes: section not permitted for this producer"},
+		},
+		{
+			name:       "unknown producer",
+			producer:   "stranger",
+			msg:        `{"commits": [{"sha1": "abc"}]}`,
+			violations: []string{`producer "stranger" is not permitted to send messages`},
+		},
+		{
+			name:     "own host",
+			producer: "web01",
+			msg:      `{"logic-states": [{"path": "/a", "environment": {"address": {"hostname": "web01"}}}, {"path": "/b", "environment": {"address": {"ipv4": "10.0.0.1"}}}]}`,
+		},
+		{
+			name:     "other host",
+			producer: "web01",
+			msg:      `{"logic-states": [{"path": "/a", "environment": {"address": {"hostname": "web02"}}}, {"path": "/b", "environment": {"nick": "somewhere"}}]}`,
+			violations: []string{
+				`logic-states[0].environment: environment "web02" is not a permitted host for this producer`,
+				`logic-states[1].environment: environment with nick "somewhere" is not described at a permitted host in this message`,
+			},
+		},
+		{
+			name:     "nick of own host",
+			producer: "janitor-web01",
+			msg:      `{"environments": [{"address": {"hostname": "web01"}, "nick": "db"}], "processes": [{"pid": 1, "environment": {"nick": "db"}}]}`,
+		},
+		{
+			name:     "nick of other host",
+			producer: "janitor-web01",
+			msg:      `{"environments": [{"address": {"hostname": "web02"}, "nick": "db"}], "processes": [{"pid": 1, "environment": {"nick": "db"}}]}`,
+			violations: []string{
+				`environments[0].address: environment "web02" is not a permitted host for this producer`,
+				`processes[0].environment: environment with nick "db" is not described at a permitted host in this message`,
+			},
+		},
+		{
+			name:     "nick without host restrictions",
+			producer: "janitor",
+			msg:      `{"tombstones": {"environments": [{"nick": "db"}]}}`,
+		},
+		{
+			name:       "tombstone sections",
+			producer:   "janitor",
+			msg:        `{"tombstones": {"environments": [{"address": {"hostname": "web01"}}], "processes": [{"pid": 1, "environment": {"address": {"hostname": "web01"}}}]}}`,
+			violations: []string{"tombstones.processes: section not permitted for this producer"},
+		},
+	}
+
+	for _, c := range tt {
+		var violations []string
+		for _, v := range testPolicy.Check(c.producer, []byte(c.msg)) {
+			if v.Code != errdoc.CodePolicyViolation {
+				t.Errorf("%s: expected code %q, got %q", c.name, errdoc.CodePolicyViolation, v.Code)
+			}
+			violations = append(violations, v.String())
+		}
+		if !reflect.DeepEqual(violations, c.violations) {
+			t.Errorf("%s: expected violations %q, got %q", c.name, c.violations, violations)
+		}
+	}
+}
+
+func TestPolicyPointers(t *testing.T) {
+	msg := `{"tombstones": {"processes": [{"pid": 1, "environment": {"address": {"hostname": "web02"}}}]}}`
+	v := Policy{"p": {Sections: []string{"tombstones", "processes"}, Hosts: []string{"web01"}}}.Check("p", []byte(msg))
+	if len(v) != 1 || v[0].Pointer != "/tombstones/processes/0/environment" || v[0].Section != "tombstones.processes[0].environment" {
+		t.Errorf("Expected one violation located at the tombstoned process's environment, got %+v", v)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := writeKeyFile(t, `{"github": {"sections": ["commits"]}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, Policy{"github": {Sections: []string{"commits"}}}) {
+		t.Errorf("Unexpected policy loaded: %v", p)
+	}
+
+	path = writeKeyFile(t, `{"github": ["commits"]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err = LoadPolicy(path); err == nil {
+		t.Error("Expected error loading malformed policy")
+	}
+}
+
+func TestPolicyEnforced(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetAuth(&TokenAuth{tokens: map[string]string{"github": "abc"}})
+	s.SetPolicy(testPolicy)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer abc")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("POST failed:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post(`{"environments": [{"address": {"hostname": "a"}}]}`); status != 403 {
+		t.Errorf("Expected 403 for forbidden section, got %v", status)
+	}
+	if status := post(`{"commits": [{"sha1": "abc"}]}`); status != 422 {
+		t.Errorf("Expected schema validation to precede policy, got %v", status)
+	}
+	if status := post(`{"commit-meta": [{"sha1": "0000000000000000000000000000000000000000"}]}`); status != 202 {
+		t.Errorf("Expected 202 for permitted message, got %v", status)
+	}
+	if n, _ := s.mlog.Count(); n != 1 {
+		t.Errorf("Expected only the permitted message in the mlog, found %v", n)
+	}
+}
@@ -0,0 +1,139 @@
+package ingest
+
+import (
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/mlog"
+)
+
+// DefaultGapWait is the default amount of time the sequencer will wait for
+// an out-of-order record to arrive before going to the mlog to retrieve it.
+const DefaultGapWait = 50 * time.Millisecond
+
+// sequencer sits between the HTTP workers and the interpreter. Workers may
+// deliver persisted records in any order; the sequencer tails the mlog by
+// index, emitting records strictly in index order.
+//
+// Records that arrive ahead of their turn are buffered. If the gap is not
+// filled by a worker within the gap wait period, the sequencer reads the
+// missing index directly from the mlog. If the mlog cannot produce that
+// index, the sequencer keeps waiting - it never skips an index.
+type sequencer struct {
+	mlog    mlog.Store
+	next    uint64
+	pending map[uint64]*mlog.Record
+	wait    time.Duration
+}
+
+// newSequencer creates a sequencer that will emit records beginning at the
+// provided index.
+func newSequencer(j mlog.Store, next uint64, wait time.Duration) *sequencer {
+	return &sequencer{
+		mlog:    j,
+		next:    next,
+		pending: make(map[uint64]*mlog.Record),
+		wait:    wait,
+	}
+}
+
+// run consumes records from the input channel and returns a channel on which
+// they are emitted in strict index order. The output channel is closed once
+// the input channel is closed and every record that can be emitted in order
+// has been.
+func (sq *sequencer) run(in <-chan *mlog.Record) <-chan *mlog.Record {
+	out := make(chan *mlog.Record, cap(in))
+
+	go func() {
+		defer close(out)
+
+		for {
+			sq.flush(out)
+
+			var gap <-chan time.Time
+			if len(sq.pending) > 0 {
+				gap = time.After(sq.wait)
+			}
+
+			select {
+			case rec, open := <-in:
+				if !open {
+					// Input is done; fill whatever gaps the mlog can fill, then quit.
+					for len(sq.pending) > 0 && sq.fill() {
+						sq.flush(out)
+					}
+
+					if len(sq.pending) > 0 {
+						logrus.WithFields(logrus.Fields{
+							"system":  "sequencer",
+							"missing": sq.next,
+							"pending": len(sq.pending),
+						}).Error("Input closed with an unfillable gap in the mlog; buffered records after the gap were not interpreted")
+					}
+					return
+				}
+				sq.accept(rec)
+			case <-gap:
+				sq.fill()
+			}
+		}
+	}()
+
+	return out
+}
+
+// accept places a record into the pending buffer, discarding it if its
+// index has already been emitted.
+func (sq *sequencer) accept(rec *mlog.Record) {
+	if rec.Index < sq.next {
+		logrus.WithFields(logrus.Fields{
+			"system": "sequencer",
+			"msgid":  rec.Index,
+			"next":   sq.next,
+		}).Warn("Received record with an index that was already sequenced; discarding")
+		return
+	}
+
+	sq.pending[rec.Index] = rec
+}
+
+// flush emits all buffered records that are contiguous from the next index.
+func (sq *sequencer) flush(out chan<- *mlog.Record) {
+	for {
+		rec, exists := sq.pending[sq.next]
+		if !exists {
+			return
+		}
+
+		out <- rec
+		delete(sq.pending, sq.next)
+		sq.next++
+	}
+}
+
+// fill attempts to retrieve the next expected index directly from the mlog.
+// Returns true if the record was retrieved and buffered.
+func (sq *sequencer) fill() bool {
+	if _, exists := sq.pending[sq.next]; exists {
+		return true
+	}
+
+	rec, err := sq.mlog.Get(sq.next)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system":  "sequencer",
+			"missing": sq.next,
+			"pending": len(sq.pending),
+			"err":     err,
+		}).Warn("Gap in record sequence could not be filled from the mlog; will not skip, waiting")
+		return false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"system": "sequencer",
+		"msgid":  sq.next,
+	}).Debug("Filled gap in record sequence from the mlog")
+
+	sq.pending[sq.next] = rec
+	return true
+}
@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	gjs "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/xeipuuv/gojsonschema"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/schema"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func init() {
+	// The stress test generates a lot of merges; keep the output readable.
+	logrus.SetLevel(logrus.WarnLevel)
+}
+
+// Drains the sequencer's output into a slice of indices.
+func collect(c <-chan *mlog.Record) (idx []uint64) {
+	for rec := range c {
+		idx = append(idx, rec.Index)
+	}
+	return
+}
+
+func TestSequencerReorders(t *testing.T) {
+	j := mem.NewMemStore()
+	var recs []*mlog.Record
+	for i := 0; i < 5; i++ {
+		rec, _ := j.NewEntry([]byte("{}"), "127.0.0.1", "")
+		recs = append(recs, rec)
+	}
+
+	in := make(chan *mlog.Record, 5)
+	for _, k := range []int{3, 1, 4, 0, 2} {
+		in <- recs[k]
+	}
+	close(in)
+
+	idx := collect(newSequencer(j, 1, time.Millisecond).run(in))
+	if len(idx) != 5 {
+		t.Fatalf("Expected five records out of sequencer, got %v", len(idx))
+	}
+	for k, i := range idx {
+		if i != uint64(k+1) {
+			t.Errorf("Records emitted out of order: %v", idx)
+			break
+		}
+	}
+}
+
+func TestSequencerFillsGapFromMlog(t *testing.T) {
+	j := mem.NewMemStore()
+	var recs []*mlog.Record
+	for i := 0; i < 3; i++ {
+		rec, _ := j.NewEntry([]byte("{}"), "127.0.0.1", "")
+		recs = append(recs, rec)
+	}
+
+	// Record 2 never arrives on the channel; it must be read from the mlog.
+	in := make(chan *mlog.Record, 3)
+	in <- recs[2]
+	in <- recs[0]
+
+	out := newSequencer(j, 1, time.Millisecond).run(in)
+	for k := uint64(1); k <= 3; k++ {
+		select {
+		case rec := <-out:
+			if rec.Index != k {
+				t.Fatalf("Expected record %v, got %v", k, rec.Index)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for record %v; gap was not filled from mlog", k)
+		}
+	}
+	close(in)
+}
+
+func TestSequencerRefusesToSkip(t *testing.T) {
+	j := mem.NewMemStore()
+	// Only a single real entry; index 2 does not exist in the mlog at all.
+	j.NewEntry([]byte("{}"), "127.0.0.1", "")
+
+	in := make(chan *mlog.Record, 2)
+	in <- &mlog.Record{Index: 3}
+	in <- &mlog.Record{Index: 1}
+	close(in)
+
+	idx := collect(newSequencer(j, 1, time.Millisecond).run(in))
+	if len(idx) != 1 || idx[0] != 1 {
+		t.Errorf("Sequencer should emit only record 1 and refuse to skip missing index 2; emitted %v", idx)
+	}
+}
+
+func TestSequencerDiscardsStale(t *testing.T) {
+	j := mem.NewMemStore()
+	j.NewEntry([]byte("{}"), "127.0.0.1", "")
+	j.NewEntry([]byte("{}"), "127.0.0.1", "")
+
+	in := make(chan *mlog.Record, 3)
+	in <- &mlog.Record{Index: 1}
+	in <- &mlog.Record{Index: 2}
+	in <- &mlog.Record{Index: 1}
+	close(in)
+
+	idx := collect(newSequencer(j, 1, time.Millisecond).run(in))
+	if len(idx) != 2 {
+		t.Errorf("Duplicate/stale record should have been discarded; emitted %v", idx)
+	}
+}
+
+// Fires a large number of concurrent POSTs at the ingestor, then verifies
+// that every graph produced by the interpreter has a MsgID exactly one
+// greater than the graph before it.
+func TestConcurrentIngestionIsSequential(t *testing.T) {
+	total := 2000
+	if testing.Short() {
+		total = 200
+	}
+
+	src, err := schema.Master()
+	if err != nil {
+		t.Fatal("Failed to open master schema:", err)
+	}
+	sch, err := gjs.NewSchema(gjs.NewStringLoader(string(src)))
+	if err != nil {
+		t.Fatal("Failed to create schema object:", err)
+	}
+
+	ic := make(chan *mlog.Record, 1000)
+	bc := make(chan system.CoreGraph, 0)
+	s := New(mem.NewMemStore(), sch, ic, bc, 5<<20)
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleMessage))
+	defer srv.Close()
+
+	go s.Interpret(represent.NewGraph())
+
+	var ids []uint64
+	done := make(chan struct{})
+	go func() {
+		for g := range bc {
+			ids = append(ids, g.MsgID())
+			if len(ids) == total {
+				break
+			}
+		}
+		close(done)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	// cap the number of in-flight sockets, but let all the goroutines race
+	sem := make(chan struct{}, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			msg := fmt.Sprintf(`{"environments":[{"address":{"hostname":"host%d"}}]}`, i%50)
+			resp, err := client.Post(srv.URL, "application/json", strings.NewReader(msg))
+			if err != nil {
+				t.Error("POST failed:", err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 202 {
+				t.Errorf("Expected 202 response, got %v", resp.StatusCode)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Timed out waiting on interpreter; received %v of %v graphs", len(ids), total)
+	}
+
+	for k, id := range ids {
+		if id != uint64(k+1) {
+			t.Fatalf("Graph %v had MsgID %v; merges were not strictly sequential", k+1, id)
+		}
+	}
+}
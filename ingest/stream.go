@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/pipeviz/pipeviz/ingest/errdoc"
+	"github.com/pipeviz/pipeviz/log"
+)
+
+const (
+	// Time allowed to write an ack or ping to the producer.
+	streamWriteWait = 10 * time.Second
+	// Time allowed between reads from the producer; pongs count.
+	streamPongWait = 60 * time.Second
+	// Send pings to the producer with this period; less than streamPongWait.
+	streamPingPeriod = (streamPongWait * 9) / 10
+)
+
+var streamUpgrader = websocket.Upgrader{ReadBufferSize: 8192, WriteBufferSize: 256}
+
+// StreamAck is sent back to a streaming producer for each message it sends,
+// in the same order as the messages. Status is the http status code the
+// message would have received if POSTed on its own.
+type StreamAck struct {
+	// Position of the message in the stream, starting at 1
+	Seq       uint64              `json:"seq"`
+	Status    int                 `json:"status"`
+	Index     uint64              `json:"index,omitempty"`
+	Duplicate bool                `json:"duplicate,omitempty"`
+	Errors    []errdoc.FieldError `json:"errors,omitempty"`
+	Warnings  []errdoc.FieldError `json:"warnings,omitempty"`
+	// Seconds to wait before retrying the message, if it was turned away
+	RetryAfter int64 `json:"retry-after,omitempty"`
+}
+
+// handleStream upgrades the connection to a websocket, over which the
+// producer sends messages as text frames, one message per frame. Each is
+// ingested exactly as a message POSTed on its own would be, and acked with
+// a StreamAck.
+//
+// The producer is authenticated once, when the stream is opened. As there is
+// no body at that point, producers using HMAC authentication sign a timestamp
+// instead; see HMACAuth. Idempotency keys are taken only from each message's
+// envelope.
+//
+// A stream may be open indefinitely, so rather than being attached to the
+// request log, each message is logged on its own as it is acked. The producer
+// is pinged periodically, and the stream closed if it neither sends messages
+// nor answers pings.
+func (s *Ingestor) handleStream(w http.ResponseWriter, r *http.Request) {
+	producer, ok := s.authorize(w, r, nil)
+	if !ok {
+		return
+	}
+
+	ws, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		entry := logrus.WithFields(logrus.Fields{
+			"system": "ingestor",
+			"err":    err,
+		})
+
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			entry.Error("Error on attempting upgrade to websocket")
+		} else {
+			entry.Warn("Handshake error on websocket upgrade")
+		}
+		return
+	}
+	defer ws.Close()
+
+	ws.SetReadLimit(s.maxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(streamPongWait))
+	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(streamPongWait)); return nil })
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(streamPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Control frames may be written concurrently with acks
+				if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(streamWriteWait)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var seq, accepted uint64
+	for {
+		typ, b, err := ws.ReadMessage()
+		if err != nil {
+			// Closed by the producer, too long, or timed out
+			break
+		}
+		ws.SetReadDeadline(time.Now().Add(streamPongWait))
+		if typ != websocket.TextMessage {
+			continue
+		}
+		seq++
+
+		fields := logrus.Fields{}
+		o := s.ingest(r, func(f logrus.Fields) {
+			for k, v := range f {
+				fields[k] = v
+			}
+		}, producer, b, "")
+		s.logStreamed(r, producer, seq, o, fields)
+
+		ack := StreamAck{
+			Seq:        seq,
+			Status:     o.Status,
+			Duplicate:  o.Record != nil && !o.Created,
+			Errors:     o.Errors,
+			Warnings:   o.Warnings,
+			RetryAfter: int64(math.Ceil(o.RetryAfter.Seconds())),
+		}
+		if o.Record != nil {
+			ack.Index = o.Record.Index
+			accepted++
+		}
+
+		j, _ := json.Marshal(ack)
+		ws.SetWriteDeadline(time.Now().Add(streamWriteWait))
+		werr := ws.WriteMessage(websocket.TextMessage, j)
+
+		// As with single messages, the record is sent along after the
+		// producer has been told about it, even if telling it failed.
+		if o.Created {
+			s.interpretChan <- o.Record
+		}
+
+		if werr != nil {
+			logrus.WithFields(logrus.Fields{
+				"system": "ingestor",
+				"err":    werr,
+			}).Warn("Failed to write ack to streaming producer; closing stream.")
+			break
+		}
+	}
+
+	log.AddFields(r, logrus.Fields{
+		"messages": seq,
+		"accepted": accepted,
+	})
+}
+
+// logStreamed logs the outcome of a message received over a stream, with any
+// fields noted while ingesting it.
+func (s *Ingestor) logStreamed(r *http.Request, producer string, seq uint64, o outcome, fields logrus.Fields) {
+	entry := logrus.WithFields(fields).WithFields(logrus.Fields{
+		"system": "ingestor",
+		"remote": r.RemoteAddr,
+		"seq":    seq,
+		"status": o.Status,
+	})
+	if producer != "" {
+		entry = entry.WithField("producer", producer)
+	}
+	if o.Record != nil {
+		entry = entry.WithField("msgid", o.Record.Index)
+	}
+
+	switch o.Status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		entry.Warn("Streamed message rejected")
+	default:
+		entry.Info("Streamed message processed")
+	}
+}
@@ -0,0 +1,213 @@
+package ingest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/pipeviz/pipeviz/log"
+)
+
+// stubProducer opens a stream to the ingestor, sends each message, and
+// collects the acks.
+func stubProducer(t *testing.T, url string, hdr http.Header, msgs ...string) []StreamAck {
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), hdr)
+	if err != nil {
+		if resp != nil {
+			t.Fatalf("Failed to open stream; status %v", resp.StatusCode)
+		}
+		t.Fatal("Failed to open stream:", err)
+	}
+	defer ws.Close()
+
+	var acks []StreamAck
+	for _, m := range msgs {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+			t.Fatal("Failed to send message:", err)
+		}
+		var ack StreamAck
+		if err := ws.ReadJSON(&ack); err != nil {
+			t.Fatal("Failed to read ack:", err)
+		}
+		acks = append(acks, ack)
+	}
+	return acks
+}
+
+func TestStream(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetPolicy(Policy{"": {Sections: []string{"environments"}}})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	acks := stubProducer(t, srv.URL, nil,
+		`{"environments":[{"address":{"hostname":"a"}}]}`,
+		`{"environments":[{"os":"plan9"}]}`,
+		`{not json`,
+		`{"commit-meta":[{"sha1":"0000000000000000000000000000000000000000"}]}`,
+		`{"idempotency-key":"k","environments":[{"address":{"hostname":"b"}}]}`,
+		`{"idempotency-key":"k","environments":[{"address":{"hostname":"b"}}]}`,
+	)
+
+	expect := []struct {
+		status    int
+		index     uint64
+		duplicate bool
+		errors    bool
+	}{
+		{202, 1, false, false},
+		{422, 0, false, true},
+		{400, 0, false, true},
+		{403, 0, false, true},
+		{202, 2, false, false},
+		{200, 2, true, false},
+	}
+	if len(acks) != len(expect) {
+		t.Fatalf("Expected %v acks, got %v", len(expect), len(acks))
+	}
+	for i, e := range expect {
+		a := acks[i]
+		if a.Seq != uint64(i+1) || a.Status != e.status || a.Index != e.index || a.Duplicate != e.duplicate || (len(a.Errors) > 0) != e.errors {
+			t.Errorf("Ack %v: expected status %v, index %v, duplicate %v, errors %v; got %+v", i+1, e.status, e.index, e.duplicate, e.errors, a)
+		}
+	}
+
+	if len(s.interpretChan) != 2 {
+		t.Errorf("Expected two records sent for interpretation, got %v", len(s.interpretChan))
+	}
+	for i := uint64(1); i <= 2; i++ {
+		if rec := <-s.interpretChan; rec.Index != i {
+			t.Errorf("Expected record %v to be sent for interpretation, got %v", i, rec.Index)
+		}
+	}
+}
+
+func TestStreamLogsEachMessage(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetPolicy(Policy{"": {Sections: []string{"environments"}}})
+	lc, restore := capture()
+	defer restore()
+
+	srv := httptest.NewServer(log.NewHTTPLogger("ingestor")(http.HandlerFunc(s.handleStream)))
+	defer srv.Close()
+
+	stubProducer(t, srv.URL, nil,
+		`{"environments":[{"address":{"hostname":"a"}}]}`,
+		`{"commit-meta":[{"sha1":"0000000000000000000000000000000000000000"}]}`,
+		`{"idempotency-key":"k","environments":[{"address":{"hostname":"b"}}]}`,
+		`{"idempotency-key":"k","environments":[{"address":{"hostname":"b"}}]}`,
+	)
+
+	// Each message is acked only after it is logged
+	entries := lc.captured("Streamed message processed", "Streamed message rejected")
+	if len(entries) != 4 {
+		t.Fatalf("Expected each of 4 streamed messages to be logged, got %v entries", len(entries))
+	}
+	for i, e := range entries {
+		if e.Data["seq"] != uint64(i+1) {
+			t.Errorf("Expected log entry %v to have seq %v, got %v", i, i+1, e.Data["seq"])
+		}
+	}
+	if entries[1].Level != logrus.WarnLevel || entries[1].Data["violations"] == nil {
+		t.Errorf("Expected the rejected message to be logged as a warning with its violations, got %v %v", entries[1].Level, entries[1].Data)
+	}
+	if entries[3].Data["duplicate-of"] != uint64(2) {
+		t.Errorf("Expected the duplicate message to be logged with the original msgid, got %v", entries[3].Data)
+	}
+
+	// The request itself completes once the producer has gone away
+	var done []*logrus.Entry
+	for i := 0; i < 100 && len(done) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		done = lc.captured("Request processing complete")
+	}
+	if len(done) == 0 {
+		t.Fatal("Expected the stream request to be logged on completion")
+	}
+	if done[0].Data["messages"] != uint64(4) || done[0].Data["violations"] != nil || done[0].Data["duplicate-of"] != nil {
+		t.Errorf("Expected the stream request log to count messages without their fields, got %v", done[0].Data)
+	}
+}
+
+func TestStreamAuth(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetAuth(&TokenAuth{tokens: map[string]string{"agent": "abc"}})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != 401 {
+		t.Errorf("Expected unauthenticated stream to be refused with 401, got %v", resp)
+	}
+
+	acks := stubProducer(t, srv.URL, http.Header{"Authorization": {"Bearer abc"}}, `{"environments":[{"address":{"hostname":"a"}}]}`)
+	if !reflect.DeepEqual(acks, []StreamAck{{Seq: 1, Status: 202, Index: 1}}) {
+		t.Errorf("Unexpected acks from authenticated stream: %+v", acks)
+	}
+	if rec, _ := s.mlog.Get(1); rec == nil || rec.Producer != "agent" {
+		t.Errorf("Expected streamed record to have producer 'agent', got %+v", rec)
+	}
+}
+
+func TestStreamHMAC(t *testing.T) {
+	s := newTestIngestor(t)
+	s.SetAuth(&HMACAuth{secrets: map[string]string{"agent": "s3cret"}})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	dial := func(hdr http.Header) int {
+		ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), hdr)
+		if err == nil {
+			ws.Close()
+			return 101
+		}
+		if resp == nil {
+			t.Fatal("Failed to open stream:", err)
+		}
+		return resp.StatusCode
+	}
+	signed := func(at time.Time) http.Header {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		return http.Header{
+			"X-Pipeviz-Producer":  {"agent"},
+			"X-Pipeviz-Timestamp": {ts},
+			"X-Pipeviz-Signature": {sign("s3cret", "stream:"+ts)},
+		}
+	}
+
+	// A signature over the (empty) body would never change
+	if status := dial(http.Header{"X-Pipeviz-Producer": {"agent"}, "X-Pipeviz-Signature": {sign("s3cret", "")}}); status != 401 {
+		t.Errorf("Expected stream signed without a timestamp to be refused with 401, got %v", status)
+	}
+
+	hdr := signed(time.Now())
+	acks := stubProducer(t, srv.URL, hdr, `{"environments":[{"address":{"hostname":"a"}}]}`)
+	if !reflect.DeepEqual(acks, []StreamAck{{Seq: 1, Status: 202, Index: 1}}) {
+		t.Errorf("Unexpected acks from stream signed with a timestamp: %+v", acks)
+	}
+	if rec, _ := s.mlog.Get(1); rec == nil || rec.Producer != "agent" {
+		t.Errorf("Expected streamed record to have producer 'agent', got %+v", rec)
+	}
+
+	if status := dial(hdr); status != 401 {
+		t.Errorf("Expected replayed stream upgrade to be refused with 401, got %v", status)
+	}
+
+	forged := signed(time.Now())
+	forged.Set("X-Pipeviz-Timestamp", strconv.FormatInt(time.Now().Unix()+1, 10))
+	if status := dial(forged); status != 401 {
+		t.Errorf("Expected stream with a timestamp other than the one signed to be refused with 401, got %v", status)
+	}
+
+	for _, at := range []time.Time{time.Now().Add(-2 * MaxStreamSignatureAge), time.Now().Add(2 * MaxStreamSignatureAge)} {
+		if status := dial(signed(at)); status != 401 {
+			t.Errorf("Expected stream signed at %v to be refused with 401, got %v", at, status)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -10,7 +12,35 @@ import (
 
 // TODO this is kinda hacked together, give it a once-over check
 
+type fieldsKey struct{}
+
+// requestFields holds fields that handlers attach to the completion entry for
+// their request.
+type requestFields struct {
+	sync.Mutex
+	f logrus.Fields
+}
+
+// AddFields attaches the provided fields to the entry logged by the HTTPLogger
+// when processing of the request completes. It is a no-op if the request did
+// not pass through an HTTPLogger.
+func AddFields(r *http.Request, fields logrus.Fields) {
+	rf, ok := r.Context().Value(fieldsKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+
+	rf.Lock()
+	for k, v := range fields {
+		rf.f[k] = v
+	}
+	rf.Unlock()
+}
+
 // NewHTTPLogger returns an HTTPLogger, suitable for use as http middleware.
+//
+// Requests that are rejected for lack of authorization (401 or 403) are
+// logged at warning level, rather than info.
 func NewHTTPLogger(system string) func(h http.Handler) http.Handler {
 	middleware := func(h http.Handler) http.Handler {
 		entry := logrus.WithFields(logrus.Fields{
@@ -19,6 +49,8 @@ func NewHTTPLogger(system string) func(h http.Handler) http.Handler {
 
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			lw := mutil.WrapWriter(w)
+			rf := &requestFields{f: logrus.Fields{}}
+			r = r.WithContext(context.WithValue(r.Context(), fieldsKey{}, rf))
 
 			entry.WithFields(logrus.Fields{
 				"uri":    r.URL.String(),
@@ -33,13 +65,22 @@ func NewHTTPLogger(system string) func(h http.Handler) http.Handler {
 				lw.WriteHeader(http.StatusOK)
 			}
 
-			entry.WithFields(logrus.Fields{
+			rf.Lock()
+			done := entry.WithFields(rf.f).WithFields(logrus.Fields{
 				"status": lw.Status(),
 				"uri":    r.URL.String(),
 				"method": r.Method,
 				"remote": r.RemoteAddr,
 				"wall":   time.Now().Sub(t1).String(),
-			}).Info("Request processing complete")
+			})
+			rf.Unlock()
+
+			switch lw.Status() {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				done.Warn("Request rejected")
+			default:
+				done.Info("Request processing complete")
+			}
 		}
 
 		return http.HandlerFunc(fn)
@@ -5,6 +5,7 @@ package boltdb
 import (
 	"encoding/binary"
 	"errors"
+	"os"
 	"time"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/boltdb/bolt"
@@ -18,6 +19,14 @@ const (
 var (
 	// The name of the bucket to use.
 	bucketName = []byte("mlog")
+	// Buckets indexing records by scoped idempotency key, and the keys by the
+	// index of their record, for forgetting them.
+	keyBucketName   = []byte("idempotency")
+	orderBucketName = []byte("idempotency-order")
+
+	// ErrNotMlog is returned when a bolt database opened read-only does not
+	// contain a mlog.
+	ErrNotMlog = errors.New("bolt database does not contain a mlog")
 )
 
 // BoltStore represents a single BoltDB storage backend for the append-only log.
@@ -51,7 +60,42 @@ func NewBoltStore(path string) (mlog.Store, error) {
 	return store, nil
 }
 
-// init sets up the mlog bucket in the boltdb backend.
+// NewReadOnlyBoltStore opens an existing BoltDB-backed log store for reading.
+// Nothing is written to the file, nor is it created if it does not exist;
+// attempts to append to the store fail.
+func NewReadOnlyBoltStore(path string) (mlog.Store, error) {
+	// Bolt would otherwise create a missing file, and fail to initialize an
+	// empty one without giving up its lock
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.Size() == 0 {
+		return nil, ErrNotMlog
+	}
+
+	b, err := bolt.Open(path, fileMode, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a write txn, the bucket cannot be created; it must already exist
+	err = b.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketName) == nil {
+			return ErrNotMlog
+		}
+		return nil
+	})
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		conn: b,
+		path: path,
+	}, nil
+}
+
+// init sets up the mlog buckets in the boltdb backend.
 func (b *BoltStore) init() error {
 	tx, err := b.conn.Begin(true)
 	if err != nil {
@@ -59,10 +103,12 @@ func (b *BoltStore) init() error {
 	}
 
 	// Create all the buckets
-	if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
-		// already failed, error doesn't matter
-		_ = tx.Rollback()
-		return err
+	for _, name := range [][]byte{bucketName, keyBucketName, orderBucketName} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			// already failed, error doesn't matter
+			_ = tx.Rollback()
+			return err
+		}
 	}
 
 	return tx.Commit()
@@ -85,16 +131,12 @@ func (b *BoltStore) Get(idx uint64) (*mlog.Record, error) {
 		return nil, errors.New("index not found")
 	}
 
-	l := &mlog.Record{}
-	if _, err := l.UnmarshalMsg(val); err != nil {
-		return nil, err
-	}
-	return l, nil
+	return mlog.DecodeRecord(val)
 }
 
 // NewEntry creates a record from the provided data, appends that record onto
 // the end of the mlog, then returns the created record.
-func (b *BoltStore) NewEntry(message []byte, remoteAddr string) (*mlog.Record, error) {
+func (b *BoltStore) NewEntry(message []byte, remoteAddr, producer string) (*mlog.Record, error) {
 	tx, err := b.conn.Begin(true)
 	if err != nil {
 		return nil, err
@@ -104,7 +146,7 @@ func (b *BoltStore) NewEntry(message []byte, remoteAddr string) (*mlog.Record, e
 	// no need to sync b/c the conn.Begin(true) call will block
 	bucket := tx.Bucket(bucketName)
 
-	record := mlog.NewRecord(message, remoteAddr)
+	record := mlog.NewRecord(message, remoteAddr, producer)
 	record.Index, err = bucket.NextSequence()
 	if err != nil {
 		return nil, err
@@ -128,6 +170,109 @@ func (b *BoltStore) NewEntry(message []byte, remoteAddr string) (*mlog.Record, e
 	return record, nil
 }
 
+// NewEntries creates records from the provided messages, appends them onto
+// the end of the mlog within a single transaction, then returns the records.
+// Either all new records are persisted, or none are. Messages with an
+// idempotency key that has already been seen are not appended; the earlier
+// record is returned in their place.
+func (b *BoltStore) NewEntries(messages [][]byte, keys []string, remoteAddr, producer string) ([]*mlog.Record, []bool, error) {
+	tx, err := b.conn.Begin(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	bucket := tx.Bucket(bucketName)
+	keyBucket, orderBucket := tx.Bucket(keyBucketName), tx.Bucket(orderBucketName)
+
+	records := make([]*mlog.Record, 0, len(messages))
+	created := make([]bool, 0, len(messages))
+	for k, message := range messages {
+		var scoped []byte
+		if keys != nil && keys[k] != "" {
+			scoped = []byte(mlog.IdempotencyScope(producer, keys[k]))
+			if key := keyBucket.Get(scoped); key != nil && mlog.Remembered(binary.BigEndian.Uint64(key), lastIndex(bucket)) {
+				record, err := mlog.DecodeRecord(bucket.Get(key))
+				if err != nil {
+					return nil, nil, err
+				}
+				records = append(records, record)
+				created = append(created, false)
+				continue
+			}
+		}
+
+		record := mlog.NewRecord(message, remoteAddr, producer)
+		record.Index, err = bucket.NextSequence()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, record.Index)
+		val, err := record.MarshalMsg(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err = bucket.Put(key, val); err != nil {
+			return nil, nil, err
+		}
+		if scoped != nil {
+			if err = keyBucket.Put(scoped, key); err != nil {
+				return nil, nil, err
+			}
+			if err = orderBucket.Put(key, scoped); err != nil {
+				return nil, nil, err
+			}
+		}
+		records = append(records, record)
+		created = append(created, true)
+	}
+
+	if err = b.forgetKeys(keyBucket, orderBucket, lastIndex(bucket)); err != nil {
+		return nil, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return records, created, nil
+}
+
+// forgetKeys removes idempotency keys that have fallen out of the window.
+// Keys are ordered by the index of their record, so these are all at the
+// front of the order bucket.
+func (b *BoltStore) forgetKeys(keyBucket, orderBucket *bolt.Bucket, newest uint64) error {
+	curs := orderBucket.Cursor()
+	for idx, scoped := curs.First(); idx != nil; idx, scoped = curs.First() {
+		if mlog.Remembered(binary.BigEndian.Uint64(idx), newest) {
+			return nil
+		}
+
+		// The key may have since been reused for a newer record
+		if current := keyBucket.Get(scoped); current != nil && binary.BigEndian.Uint64(current) == binary.BigEndian.Uint64(idx) {
+			if err := keyBucket.Delete(scoped); err != nil {
+				return err
+			}
+		}
+		if err := curs.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastIndex returns the index of the last record in the mlog bucket, or 0 if
+// it is empty.
+func lastIndex(bucket *bolt.Bucket) uint64 {
+	if last, _ := bucket.Cursor().Last(); last != nil {
+		return binary.BigEndian.Uint64(last)
+	}
+	return 0
+}
+
 // Count reports the number of items in the mlog by opening a db cursor to
 // grab the last item from the bucket. Because we're append-only, this is
 // guaranteed to be the last one, and thus its index is the count.
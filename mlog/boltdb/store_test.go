@@ -2,9 +2,11 @@ package boltdb
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/boltdb/bolt"
 	"github.com/pipeviz/pipeviz/mlog"
 )
 
@@ -55,7 +57,7 @@ func TestNewEntryGetCount(t *testing.T) {
 
 	var item1, item2 *mlog.Record
 
-	item1, err = b.NewEntry(m1, a1)
+	item1, err = b.NewEntry(m1, a1, "")
 	if err != nil {
 		t.Errorf("Failed to complete first NewEntry() due to err: %s", err)
 	}
@@ -63,7 +65,7 @@ func TestNewEntryGetCount(t *testing.T) {
 		t.Errorf("First log item should have been assigned index 1, got %d", item1.Index)
 	}
 
-	item2, err = b.NewEntry(m2, a2)
+	item2, err = b.NewEntry(m2, a2, "")
 	if err != nil {
 		t.Errorf("Failed to complete second NewEntry() due to err: %s", err)
 	}
@@ -133,3 +135,149 @@ func TestNewEntryGetCount(t *testing.T) {
 		t.Errorf("Second persisted message was incorrect, expected %q got %q", "msg1", get2.Message)
 	}
 }
+
+func TestNewEntries(t *testing.T) {
+	ls, err := NewBoltStore("test-batch.boltdb")
+	if err != nil {
+		t.Fatalf("Failed to create bolt store with err %s", err)
+	}
+	b := ls.(*BoltStore)
+	defer func() {
+		_ = b.conn.Close()
+		_ = os.Remove("test-batch.boltdb")
+	}()
+
+	b.NewEntry([]byte("msg1"), "127.0.0.1", "")
+	items, _, err := b.NewEntries([][]byte{[]byte("msg2"), []byte("msg3")}, nil, "127.0.0.1", "")
+	if err != nil {
+		t.Fatalf("Failed to complete NewEntries() due to err: %s", err)
+	}
+	if len(items) != 2 || items[0].Index != 2 || items[1].Index != 3 {
+		t.Fatalf("Batch should have been assigned contiguous indices 2 and 3, got %v", items)
+	}
+
+	count, err := b.Count()
+	if err != nil || count != 3 {
+		t.Errorf("After three appends Count() should report three items; reported %d (err %v)", count, err)
+	}
+
+	for i, m := range []string{"msg1", "msg2", "msg3"} {
+		rec, err := b.Get(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("Failed to complete Get() on item %d due to err: %s", i+1, err)
+		}
+		if !bytes.Equal([]byte(m), rec.Message) {
+			t.Errorf("Persisted message %d was incorrect, expected %q got %q", i+1, m, rec.Message)
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	defer func(w uint64) { mlog.IdempotencyWindow = w }(mlog.IdempotencyWindow)
+	mlog.IdempotencyWindow = 3
+
+	ls, err := NewBoltStore("test-idem.boltdb")
+	if err != nil {
+		t.Fatalf("Failed to create bolt store with err %s", err)
+	}
+	defer func() {
+		_ = os.Remove("test-idem.boltdb")
+	}()
+
+	msgs := [][]byte{[]byte("msg1"), []byte("msg2"), []byte("msg3")}
+	items, created, err := ls.NewEntries(msgs, []string{"a", "", "a"}, "127.0.0.1", "yum")
+	if err != nil {
+		t.Fatalf("Failed to complete NewEntries() due to err: %s", err)
+	}
+	if created[0] != true || created[1] != true || created[2] != false || items[2].Index != 1 {
+		t.Errorf("Repeated key within a batch should return the first record; got created %v, index %v", created, items[2].Index)
+	}
+	if !bytes.Equal(items[2].Message, []byte("msg1")) {
+		t.Errorf("Expected original record to be returned for repeated key, got message %q", items[2].Message)
+	}
+
+	// The index of keys persists
+	_ = ls.(*BoltStore).conn.Close()
+	ls, err = NewBoltStore("test-idem.boltdb")
+	if err != nil {
+		t.Fatalf("Failed to reopen bolt store with err %s", err)
+	}
+	defer func() {
+		_ = ls.(*BoltStore).conn.Close()
+	}()
+
+	items, created, _ = ls.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "github")
+	if !created[0] || items[0].Index != 3 {
+		t.Errorf("Same key from a different producer should create a new record; got created %v, index %v", created[0], items[0].Index)
+	}
+
+	items, created, _ = ls.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "yum")
+	if created[0] || items[0].Index != 1 {
+		t.Errorf("Repeated key should return the original record after reopening; got created %v, index %v", created[0], items[0].Index)
+	}
+
+	// Push the first record out of the window
+	ls.NewEntry([]byte("msg4"), "127.0.0.1", "")
+	items, created, _ = ls.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "yum")
+	if !created[0] || items[0].Index != 5 {
+		t.Errorf("Key outside the window should be forgotten; got created %v, index %v", created[0], items[0].Index)
+	}
+}
+
+func TestReadOnlyBoltStore(t *testing.T) {
+	if _, err := NewReadOnlyBoltStore("test-ro.boltdb"); err == nil {
+		t.Error("Expected error when opening a nonexistent mlog read-only")
+	}
+	if _, err := os.Stat("test-ro.boltdb"); !os.IsNotExist(err) {
+		t.Error("Opening a nonexistent mlog read-only should not create it")
+	}
+	defer func() {
+		_ = os.Remove("test-ro.boltdb")
+	}()
+
+	ioutil.WriteFile("test-ro.boltdb", nil, fileMode)
+	if _, err := NewReadOnlyBoltStore("test-ro.boltdb"); err != ErrNotMlog {
+		t.Errorf("Expected ErrNotMlog when opening an empty file, got %v", err)
+	}
+
+	// A bolt database without the mlog bucket
+	db, err := bolt.Open("test-ro.boltdb", fileMode, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+	if _, err := NewReadOnlyBoltStore("test-ro.boltdb"); err != ErrNotMlog {
+		t.Errorf("Expected ErrNotMlog when opening a database without a mlog, got %v", err)
+	}
+
+	ls, err := NewBoltStore("test-ro.boltdb")
+	if err != nil {
+		t.Fatalf("Failed to create bolt store with err %s", err)
+	}
+	ls.NewEntry([]byte("msg1"), "127.0.0.1", "")
+	ls.NewEntry([]byte("msg2"), "127.0.0.1", "")
+	_ = ls.(*BoltStore).conn.Close()
+	before, _ := ioutil.ReadFile("test-ro.boltdb")
+
+	ro, err := NewReadOnlyBoltStore("test-ro.boltdb")
+	if err != nil {
+		t.Fatalf("Failed to open bolt store read-only with err %s", err)
+	}
+	defer func() {
+		_ = ro.(*BoltStore).conn.Close()
+	}()
+
+	if n, err := ro.Count(); n != 2 || err != nil {
+		t.Errorf("Expected 2 records in read-only store, got %v (err %v)", n, err)
+	}
+	if rec, err := ro.Get(2); err != nil || !bytes.Equal(rec.Message, []byte("msg2")) {
+		t.Errorf("Failed to read record from read-only store: %v", err)
+	}
+	if _, err := ro.NewEntry([]byte("msg3"), "127.0.0.1", ""); err == nil {
+		t.Error("Expected error when appending to a read-only store")
+	}
+
+	if after, _ := ioutil.ReadFile("test-ro.boltdb"); !bytes.Equal(before, after) {
+		t.Error("Read-only store should not modify the database file")
+	}
+}
@@ -14,12 +14,22 @@ import (
 type memMessageLog struct {
 	j    []*mlog.Record
 	lock sync.RWMutex
+	// Index of records by scoped idempotency key, and the keys in the order
+	// they were added, for forgetting them.
+	keys     map[string]uint64
+	keyOrder []keyedIndex
+}
+
+type keyedIndex struct {
+	index uint64
+	key   string
 }
 
 // NewMemStore initializes a new memory-backed mlog.
 func NewMemStore() mlog.Store {
 	s := &memMessageLog{
-		j: make([]*mlog.Record, 0),
+		j:    make([]*mlog.Record, 0),
+		keys: make(map[string]uint64),
 	}
 
 	return s
@@ -27,6 +37,9 @@ func NewMemStore() mlog.Store {
 
 // Count returns the number of items in the mlog.
 func (s *memMessageLog) Count() (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	return uint64(len(s.j)), nil
 }
 
@@ -36,7 +49,7 @@ func (s *memMessageLog) Get(index uint64) (*mlog.Record, error) {
 	defer s.lock.RUnlock()
 
 	i := int(index) // could be super-wrong, but who cares this is toy code
-	if i <= 0 || i-1 > len(s.j) {
+	if i <= 0 || i > len(s.j) {
 		return nil, errors.New("index out of range")
 	}
 
@@ -45,10 +58,10 @@ func (s *memMessageLog) Get(index uint64) (*mlog.Record, error) {
 
 // NewEntry creates a record from the provided data, appends that record onto
 // the end of the mlog, then returns the created record.
-func (s *memMessageLog) NewEntry(message []byte, remoteAddr string) (*mlog.Record, error) {
+func (s *memMessageLog) NewEntry(message []byte, remoteAddr, producer string) (*mlog.Record, error) {
 	s.lock.Lock()
 
-	record := mlog.NewRecord(message, remoteAddr)
+	record := mlog.NewRecord(message, remoteAddr, producer)
 	record.Index = uint64(len(s.j) + 1)
 
 	s.j = append(s.j, record)
@@ -56,3 +69,49 @@ func (s *memMessageLog) NewEntry(message []byte, remoteAddr string) (*mlog.Recor
 	s.lock.Unlock()
 	return record, nil
 }
+
+// NewEntries creates records from the provided messages, appends them onto the
+// end of the mlog with contiguous indices, then returns the records. Messages
+// with an idempotency key that has already been seen are not appended; the
+// earlier record is returned in their place.
+func (s *memMessageLog) NewEntries(messages [][]byte, keys []string, remoteAddr, producer string) ([]*mlog.Record, []bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make([]*mlog.Record, 0, len(messages))
+	created := make([]bool, 0, len(messages))
+	for k, message := range messages {
+		var scoped string
+		if keys != nil && keys[k] != "" {
+			scoped = mlog.IdempotencyScope(producer, keys[k])
+			if idx, exists := s.keys[scoped]; exists && mlog.Remembered(idx, uint64(len(s.j))) {
+				records = append(records, s.j[idx-1])
+				created = append(created, false)
+				continue
+			}
+		}
+
+		record := mlog.NewRecord(message, remoteAddr, producer)
+		record.Index = uint64(len(s.j) + 1)
+
+		s.j = append(s.j, record)
+		records = append(records, record)
+		created = append(created, true)
+
+		if scoped != "" {
+			s.keys[scoped] = record.Index
+			s.keyOrder = append(s.keyOrder, keyedIndex{index: record.Index, key: scoped})
+		}
+	}
+
+	// Forget keys that have fallen out of the window
+	newest := uint64(len(s.j))
+	for len(s.keyOrder) > 0 && !mlog.Remembered(s.keyOrder[0].index, newest) {
+		if s.keys[s.keyOrder[0].key] == s.keyOrder[0].index {
+			delete(s.keys, s.keyOrder[0].key)
+		}
+		s.keyOrder = s.keyOrder[1:]
+	}
+
+	return records, created, nil
+}
@@ -18,7 +18,7 @@ func TestNewEntryGetCount(t *testing.T) {
 
 	var item1, item2 *mlog.Record
 
-	item1, err := store.NewEntry(m1, a1)
+	item1, err := store.NewEntry(m1, a1, "")
 	if err != nil {
 		t.Errorf("Failed to complete first NewEntry() due to err: %s", err)
 	}
@@ -26,7 +26,7 @@ func TestNewEntryGetCount(t *testing.T) {
 		t.Errorf("First log item should have been assigned index 1, got %d", item1.Index)
 	}
 
-	item2, err = store.NewEntry(m2, a2)
+	item2, err = store.NewEntry(m2, a2, "")
 	if err != nil {
 		t.Errorf("Failed to complete second NewEntry() due to err: %s", err)
 	}
@@ -59,4 +59,66 @@ func TestNewEntryGetCount(t *testing.T) {
 	if !bytes.Equal([]byte("msg1"), get2.Message) {
 		t.Errorf("Second persisted message was incorrect, expected %q got %q", "msg1", get2.Message)
 	}
+
+	// Test Get() on an index past the end of the log
+	if _, err = store.Get(3); err == nil {
+		t.Errorf("Get() on an index beyond the end of the log should return an error")
+	}
+}
+
+func TestNewEntries(t *testing.T) {
+	store := NewMemStore()
+	store.NewEntry([]byte("msg1"), "127.0.0.1", "")
+
+	items, _, err := store.NewEntries([][]byte{[]byte("msg2"), []byte("msg3")}, nil, "127.0.0.1", "")
+	if err != nil {
+		t.Fatalf("Failed to complete NewEntries() due to err: %s", err)
+	}
+	if len(items) != 2 || items[0].Index != 2 || items[1].Index != 3 {
+		t.Fatalf("Batch should have been assigned contiguous indices 2 and 3, got %v", items)
+	}
+
+	for i, m := range []string{"msg1", "msg2", "msg3"} {
+		rec, err := store.Get(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("Failed to complete Get() on item %d due to err: %s", i+1, err)
+		}
+		if !bytes.Equal([]byte(m), rec.Message) {
+			t.Errorf("Persisted message %d was incorrect, expected %q got %q", i+1, m, rec.Message)
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	defer func(w uint64) { mlog.IdempotencyWindow = w }(mlog.IdempotencyWindow)
+	mlog.IdempotencyWindow = 3
+
+	store := NewMemStore()
+	msgs := [][]byte{[]byte("msg1"), []byte("msg2"), []byte("msg3")}
+
+	items, created, err := store.NewEntries(msgs, []string{"a", "", "a"}, "127.0.0.1", "yum")
+	if err != nil {
+		t.Fatalf("Failed to complete NewEntries() due to err: %s", err)
+	}
+	if created[0] != true || created[1] != true || created[2] != false || items[2].Index != 1 {
+		t.Errorf("Repeated key within a batch should return the first record; got created %v, index %v", created, items[2].Index)
+	}
+
+	// Keys are scoped to the producer
+	items, created, _ = store.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "github")
+	if !created[0] || items[0].Index != 3 {
+		t.Errorf("Same key from a different producer should create a new record; got created %v, index %v", created[0], items[0].Index)
+	}
+
+	items, created, _ = store.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "yum")
+	if created[0] || items[0].Index != 1 {
+		t.Errorf("Repeated key should return the original record; got created %v, index %v", created[0], items[0].Index)
+	}
+
+	// Push the first record out of the window
+	store.NewEntry([]byte("msg4"), "127.0.0.1", "")
+	items, created, _ = store.NewEntries(msgs[:1], []string{"a"}, "127.0.0.1", "yum")
+	if !created[0] || items[0].Index != 5 {
+		t.Errorf("Key outside the window should be forgotten; got created %v, index %v", created[0], items[0].Index)
+	}
 }
@@ -12,8 +12,39 @@ type Store interface {
 	Get(index uint64) (*Record, error)
 
 	// NewEntry creates a record from the provided data, appends it onto the
-	// end of the mlog, and returns the created record.
-	NewEntry(message []byte, remoteAddr string) (*Record, error)
+	// end of the mlog, and returns the created record. The producer is the
+	// authenticated identity of the sender, or empty if unknown.
+	NewEntry(message []byte, remoteAddr, producer string) (*Record, error)
+
+	// NewEntries creates records from each of the provided messages and
+	// appends them onto the end of the mlog as a single atomic operation,
+	// such that they have contiguous indices. The records are returned in the
+	// same order as the messages.
+	//
+	// keys is either nil, or holds an idempotency key for each message, which
+	// may be empty. If a record was created for the same producer and key
+	// within the IdempotencyWindow, no new record is created; that earlier
+	// record is returned instead, and false is reported in the corresponding
+	// position of created.
+	NewEntries(messages [][]byte, keys []string, remoteAddr, producer string) (records []*Record, created []bool, err error)
+}
+
+// IdempotencyWindow is the number of most recent records for which
+// idempotency keys are remembered. Keys of older records are forgotten, and
+// may be reused.
+var IdempotencyWindow uint64 = 100000
+
+// IdempotencyScope combines a producer and the idempotency key it supplied
+// into the key under which stores index records, as keys from different
+// producers must not collide.
+func IdempotencyScope(producer, key string) string {
+	return producer + "\x00" + key
+}
+
+// Remembered indicates whether the idempotency key of the record at the given
+// index is still remembered, given the index of the newest record.
+func Remembered(index, newest uint64) bool {
+	return newest < IdempotencyWindow || index > newest-IdempotencyWindow
 }
 
 // RecordGetter is a function type that gets records out of a mlog.
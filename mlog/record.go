@@ -6,6 +6,8 @@ package mlog
 import (
 	"net"
 	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/tinylib/msgp/msgp"
 )
 
 // Record represents a single entry in the mlog.
@@ -15,6 +17,10 @@ type Record struct {
 
 	// A system-local timestamp, split into seconds and nanoseconds, indicating
 	// when this record was persisted.
+	//
+	// Records written by older versions of pipeviz stored the full UnixNano
+	// value in TimeNSec, rather than just the nanosecond offset; Time() accounts
+	// for both.
 	TimeSec  int64 `msg:"ts"`
 	TimeNSec int64 `msg:"tns"`
 
@@ -23,23 +29,66 @@ type Record struct {
 
 	// The body of the message.
 	Message []byte `msg:"message"`
+
+	// The authenticated identity of the producer that sent the message, or
+	// empty if the ingestor did not require authentication. Records written
+	// by older versions of pipeviz lack this field; see DecodeRecord.
+	Producer string `msg:"producer"`
 }
 
 // NewRecord creates a new Record struct with a current timestamp. The
 // expectation is that it will be immediately persisted to disk.
-func NewRecord(message []byte, RemoteAddr string) *Record {
+func NewRecord(message []byte, RemoteAddr, producer string) *Record {
 	t := time.Now()
 	return &Record{
 		Index:      0,
 		TimeSec:    t.Unix(),
-		TimeNSec:   t.UnixNano(),
+		TimeNSec:   int64(t.Nanosecond()),
 		RemoteAddr: net.ParseIP(RemoteAddr),
 		Message:    message,
+		Producer:   producer,
 	}
 }
 
 // Time returns a standard Go time.Time object composed from the timestamp
 // indicating when the record was persisted to the mlog.
 func (r Record) Time() time.Time {
+	// An offset of a second or more can only be a legacy UnixNano value.
+	if r.TimeNSec >= int64(time.Second) {
+		return time.Unix(0, r.TimeNSec)
+	}
 	return time.Unix(r.TimeSec, r.TimeNSec)
 }
+
+// DecodeRecord decodes a record from its serialized msgp form, as produced
+// by MarshalMsg. Records serialized by older versions of pipeviz, before the
+// Producer field was added, are also accepted; their Producer is empty.
+//
+// The generated UnmarshalMsg and DecodeMsg accept only the current form, so
+// records should always be decoded with DecodeRecord or ReadRecord.
+func DecodeRecord(b []byte) (*Record, error) {
+	r := &Record{}
+	_, err := r.UnmarshalMsg(b)
+	if ae, ok := err.(msgp.ArrayError); ok && ae.Got == 5 && len(b) > 0 && b[0] == 0x95 {
+		// A legacy record is a fixarray of the first five fields. Rewrite
+		// it as the current six-field form, with an empty producer.
+		cur := append([]byte{0x96}, b[1:]...)
+		cur = msgp.AppendString(cur, "")
+		_, err = r.UnmarshalMsg(cur)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadRecord reads the next record from a msgp stream, as written by
+// EncodeMsg. As with DecodeRecord, records in the legacy form are accepted.
+func ReadRecord(dc *msgp.Reader) (*Record, error) {
+	var raw msgp.Raw
+	if err := raw.DecodeMsg(dc); err != nil {
+		return nil, err
+	}
+	return DecodeRecord(raw)
+}
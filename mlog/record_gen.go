@@ -8,13 +8,13 @@ import "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/tinylib/msgp
 
 // DecodeMsg implements msgp.Decodable
 func (z *Record) DecodeMsg(dc *msgp.Reader) (err error) {
-	var ssz uint32
-	ssz, err = dc.ReadArrayHeader()
+	var zfjz uint32
+	zfjz, err = dc.ReadArrayHeader()
 	if err != nil {
 		return
 	}
-	if ssz != 5 {
-		err = msgp.ArrayError{Wanted: 5, Got: ssz}
+	if zfjz != 6 {
+		err = msgp.ArrayError{Wanted: 6, Got: zfjz}
 		return
 	}
 	z.Index, err = dc.ReadUint64()
@@ -37,13 +37,17 @@ func (z *Record) DecodeMsg(dc *msgp.Reader) (err error) {
 	if err != nil {
 		return
 	}
+	z.Producer, err = dc.ReadString()
+	if err != nil {
+		return
+	}
 	return
 }
 
 // EncodeMsg implements msgp.Encodable
 func (z *Record) EncodeMsg(en *msgp.Writer) (err error) {
-	// array header, size 5
-	err = en.Append(0x95)
+	// array header, size 6
+	err = en.Append(0x96)
 	if err != nil {
 		return err
 	}
@@ -67,34 +71,37 @@ func (z *Record) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	err = en.WriteString(z.Producer)
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Record) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// array header, size 5
-	o = append(o, 0x95)
+	// array header, size 6
+	o = append(o, 0x96)
 	o = msgp.AppendUint64(o, z.Index)
 	o = msgp.AppendInt64(o, z.TimeSec)
 	o = msgp.AppendInt64(o, z.TimeNSec)
 	o = msgp.AppendBytes(o, z.RemoteAddr)
 	o = msgp.AppendBytes(o, z.Message)
+	o = msgp.AppendString(o, z.Producer)
 	return
 }
 
 // UnmarshalMsg implements msgp.Unmarshaler
 func (z *Record) UnmarshalMsg(bts []byte) (o []byte, err error) {
-	{
-		var ssz uint32
-		ssz, bts, err = msgp.ReadArrayHeaderBytes(bts)
-		if err != nil {
-			return
-		}
-		if ssz != 5 {
-			err = msgp.ArrayError{Wanted: 5, Got: ssz}
-			return
-		}
+	var zkdl uint32
+	zkdl, bts, err = msgp.ReadArrayHeaderBytes(bts)
+	if err != nil {
+		return
+	}
+	if zkdl != 6 {
+		err = msgp.ArrayError{Wanted: 6, Got: zkdl}
+		return
 	}
 	z.Index, bts, err = msgp.ReadUint64Bytes(bts)
 	if err != nil {
@@ -116,11 +123,16 @@ func (z *Record) UnmarshalMsg(bts []byte) (o []byte, err error) {
 	if err != nil {
 		return
 	}
+	z.Producer, bts, err = msgp.ReadStringBytes(bts)
+	if err != nil {
+		return
+	}
 	o = bts
 	return
 }
 
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Record) Msgsize() (s int) {
-	s = 1 + msgp.Uint64Size + msgp.Int64Size + msgp.Int64Size + msgp.BytesPrefixSize + len(z.RemoteAddr) + msgp.BytesPrefixSize + len(z.Message)
+	s = 1 + msgp.Uint64Size + msgp.Int64Size + msgp.Int64Size + msgp.BytesPrefixSize + len(z.RemoteAddr) + msgp.BytesPrefixSize + len(z.Message) + msgp.StringPrefixSize + len(z.Producer)
 	return
 }
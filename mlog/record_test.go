@@ -0,0 +1,103 @@
+package mlog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/tinylib/msgp/msgp"
+)
+
+func TestRecordTime(t *testing.T) {
+	now := time.Now()
+	r := NewRecord([]byte("{}"), "127.0.0.1", "")
+	if r.Time().Before(now.Add(-time.Second)) || r.Time().After(now.Add(time.Second)) {
+		t.Errorf("Record time %v is not close to creation time %v", r.Time(), now)
+	}
+
+	// Older records stored the entire UnixNano value in TimeNSec
+	legacy := Record{TimeSec: now.Unix(), TimeNSec: now.UnixNano()}
+	if !legacy.Time().Equal(time.Unix(0, now.UnixNano())) {
+		t.Errorf("Legacy record time decoded incorrectly: got %v, expected %v", legacy.Time(), now)
+	}
+
+	cur := Record{TimeSec: now.Unix(), TimeNSec: int64(now.Nanosecond())}
+	if !cur.Time().Equal(legacy.Time()) {
+		t.Errorf("Current and legacy encodings of the same instant differ: %v vs %v", cur.Time(), legacy.Time())
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	r := NewRecord([]byte(`{"a":1}`), "127.0.0.1", "producer")
+	r.Index = 7
+	b, err := r.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr, err := DecodeRecord(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr.Index != 7 || dr.Producer != "producer" || string(dr.Message) != `{"a":1}` {
+		t.Errorf("Decoded record does not match original: %+v", dr)
+	}
+
+	// Records from before producers were recorded have only five fields
+	legacy := []byte{0x95}
+	legacy = msgp.AppendUint64(legacy, 3)
+	legacy = msgp.AppendInt64(legacy, r.TimeSec)
+	legacy = msgp.AppendInt64(legacy, r.TimeNSec)
+	legacy = msgp.AppendBytes(legacy, r.RemoteAddr)
+	legacy = msgp.AppendBytes(legacy, []byte(`{"b":2}`))
+
+	dr, err = DecodeRecord(legacy)
+	if err != nil {
+		t.Fatalf("Failed to decode legacy record: %v", err)
+	}
+	if dr.Index != 3 || dr.Producer != "" || string(dr.Message) != `{"b":2}` || !dr.Time().Equal(r.Time()) {
+		t.Errorf("Decoded legacy record is incorrect: %+v", dr)
+	}
+
+	if _, err = DecodeRecord([]byte{0x93, 0x01, 0x02, 0x03}); err == nil {
+		t.Error("Expected error when decoding a record with the wrong number of fields")
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	r := NewRecord([]byte(`{"a":1}`), "127.0.0.1", "producer")
+	r.Index = 7
+
+	var buf bytes.Buffer
+	w := msgp.NewWriter(&buf)
+	if err := r.EncodeMsg(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	// A legacy record follows the current one in the stream
+	legacy := []byte{0x95}
+	legacy = msgp.AppendUint64(legacy, 3)
+	legacy = msgp.AppendInt64(legacy, r.TimeSec)
+	legacy = msgp.AppendInt64(legacy, r.TimeNSec)
+	legacy = msgp.AppendBytes(legacy, r.RemoteAddr)
+	legacy = msgp.AppendBytes(legacy, []byte(`{"b":2}`))
+	buf.Write(legacy)
+
+	dc := msgp.NewReader(&buf)
+	dr, err := ReadRecord(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr.Index != 7 || dr.Producer != "producer" || string(dr.Message) != `{"a":1}` {
+		t.Errorf("Read record does not match original: %+v", dr)
+	}
+
+	dr, err = ReadRecord(dc)
+	if err != nil {
+		t.Fatalf("Failed to read legacy record: %v", err)
+	}
+	if dr.Index != 3 || dr.Producer != "" || string(dr.Message) != `{"b":2}` {
+		t.Errorf("Read legacy record is incorrect: %+v", dr)
+	}
+}
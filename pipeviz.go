@@ -1,8 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"expvar"
 	"net/http"
+	"path/filepath"
 	"strconv"
 
 	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -12,12 +14,14 @@ import (
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/graceful"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/web"
 	"github.com/pipeviz/pipeviz/broker"
+	"github.com/pipeviz/pipeviz/history"
 	"github.com/pipeviz/pipeviz/ingest"
 	"github.com/pipeviz/pipeviz/mlog"
 	"github.com/pipeviz/pipeviz/mlog/boltdb"
 	"github.com/pipeviz/pipeviz/mlog/mem"
 	"github.com/pipeviz/pipeviz/represent"
 	"github.com/pipeviz/pipeviz/schema"
+	"github.com/pipeviz/pipeviz/snapshot"
 	"github.com/pipeviz/pipeviz/types/system"
 	"github.com/pipeviz/pipeviz/webapp"
 )
@@ -42,12 +46,41 @@ var (
 	webappKey  = pflag.String("webapp-key", "", "Path to an x509 key to use for TLS on the webapp port. If no cert is provided, unsecured HTTP will be used.")
 	webappCert = pflag.String("webapp-cert", "", "Path to an x509 certificate to use for TLS on the webapp port. If key is provided, will try to find a certificate of the same name plus .crt extension.")
 	mlstore    = pflag.StringP("mlog-storage", "", "bolt", "Storage backend to use for the message log. Valid options: 'memory' or 'bolt'. Defaults to bolt.")
+	snapIntv   = pflag.Uint64("snapshot-interval", 1000, "Number of messages to merge between graph snapshots written to the data dir. Set to 0 to disable snapshots. Ignored when using memory mlog storage.")
+	snapKeep   = pflag.Int("snapshot-retain", 10, "Number of most recent graph snapshots to keep in the data dir; older ones are deleted as new ones are written. Set to 0 to keep them all.")
+	orphanMsgs = pflag.Uint64("orphan-max-messages", 0, "Drop unresolved edge specs once this many messages have been merged after the one they came from. Set to 0 to keep them forever.")
+	orphanAge  = pflag.Duration("orphan-max-age", 0, "Drop unresolved edge specs once this much time has passed since the message they came from was received (e.g. 72h). Set to 0 to keep them forever.")
+	ingestToks = pflag.String("ingest-tokens", "", "Path to a file of producer names and bearer tokens, one pair per line, accepted on the ingestion port.")
+	ingestHMAC = pflag.String("ingest-hmac-keys", "", "Path to a file of producer names and secrets, one pair per line, used to verify HMAC-SHA256 signatures of messages sent to the ingestion port.")
+	ingestCA   = pflag.String("ingest-client-ca", "", "Path to PEM-encoded CA certificates used to verify client certificates on the ingestion port. Requires TLS.")
+	ingestPol  = pflag.String("ingest-policy", "", "Path to a JSON file restricting the message sections and hosts each authenticated producer may send to the ingestion port.")
+	lenient    = pflag.Bool("ingest-lenient", false, "Accept messages that pass the schema but fail semantic validation, such as those with malformed sha1s, logging the errors instead of rejecting the messages.")
+	ingestRate = pflag.Float64("ingest-rate", 0, "Maximum sustained rate, in messages per second, accepted from each producer on the ingestion port. Set to 0 for no limit.")
+	rateBurst  = pflag.Int("ingest-burst", 100, "Number of messages a producer may send in a burst above the ingest rate. Ignored if there is no ingest rate.")
+	queueDepth = pflag.Int("ingest-queue-depth", 1000, "Number of persisted messages that may wait for interpretation. Once full, the ingestion port responds with 503 until there is room.")
+	idemWindow = pflag.Uint64("idempotency-window", mlog.IdempotencyWindow, "Number of most recent messages whose idempotency keys are remembered. Retries of a message older than this are appended to the mlog again.")
+	vertexTTLs = pflag.String("vertex-ttl", "", "Comma-separated TTLs for vertices not reaffirmed by a message, as <vtype>=<stale>[:<expire>] (e.g. process=10m:1h). Vertices are marked stale after the first duration, and removed after the second, if given.")
 )
 
 func main() {
 	pflag.Parse()
 	setUpLogging()
 
+	represent.OrphanExpiry = represent.OrphanPolicy{
+		MaxMessages: *orphanMsgs,
+		MaxAge:      *orphanAge,
+	}
+
+	ttls, err := represent.ParseTTLs(*vertexTTLs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"system": "main",
+			"err":    err,
+		}).Fatal("Invalid vertex TTLs, exiting")
+	}
+	represent.VertexTTLs = ttls
+	mlog.IdempotencyWindow = *idemWindow
+
 	src, err := schema.Master()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -65,10 +98,10 @@ func main() {
 		}).Fatal("Error while creating a schema object from the master schema file, exiting")
 	}
 
-	// Channel to receive persisted messages from HTTP workers. 1000 cap to allow
+	// Channel to receive persisted messages from HTTP workers. Buffered to allow
 	// some wiggle room if there's a sudden burst of messages and the interpreter
-	// gets behind.
-	interpretChan := make(chan *mlog.Record, 1000)
+	// gets behind; beyond that, the ingestor turns messages away.
+	interpretChan := make(chan *mlog.Record, *queueDepth)
 
 	var listenAt string
 	if *bindAll == false {
@@ -96,9 +129,22 @@ func main() {
 		}).Fatal("Invalid storage type requested for mlog, exiting")
 	}
 
-	// Restore the graph from the mlog (or start from nothing if mlog is empty)
+	// Snapshots are only meaningful if the mlog they derive from is persistent.
+	var sd *snapshot.Dir
+	if *mlstore != "memory" && *snapIntv > 0 {
+		sd, err = snapshot.NewDir(filepath.Join(*dbPath, "snapshots"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"system": "main",
+				"err":    err,
+			}).Fatal("Error while setting up graph snapshot directory, exiting")
+		}
+	}
+
+	// Restore the graph from the latest snapshot and the mlog (or start from
+	// nothing if mlog is empty)
 	// TODO move this down to after ingestor is started
-	g, err := restoreGraph(j)
+	g, err := restoreGraph(j, sd)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"system": "main",
@@ -106,6 +152,11 @@ func main() {
 		}).Fatal("Error while rebuilding the graph from the mlog")
 	}
 
+	// Write snapshots periodically, as the graph advances.
+	if sd != nil {
+		go sd.Follow(g.MsgID(), *snapIntv, *snapKeep, broker.Get().Subscribe())
+	}
+
 	// Kick off fanout on the master/singleton graph broker. This will bridge between
 	// the state machine and the listeners interested in the machine's state.
 	brokerChan := make(chan system.CoreGraph, 0)
@@ -113,6 +164,33 @@ func main() {
 	brokerChan <- g
 
 	srv := ingest.New(j, masterSchema, interpretChan, brokerChan, MaxMessageSize)
+	auth := loadIngestAuth()
+	srv.SetAuth(auth...)
+	srv.SetRateLimit(*ingestRate, *rateBurst)
+	srv.SetLenient(*lenient)
+	srv.SetMergeDescriber(func(from, to system.CoreGraph) interface{} {
+		return history.NewPreview(from, to)
+	})
+	if *ingestPol != "" {
+		// Policies are keyed by producer, which only authentication can supply;
+		// without it, every message would be rejected.
+		if len(auth) == 0 {
+			log.WithFields(log.Fields{
+				"system": "main",
+				"path":   *ingestPol,
+			}).Fatal("An ingestion policy requires ingestion auth to identify producers, exiting")
+		}
+
+		pol, err := ingest.LoadPolicy(*ingestPol)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"system": "main",
+				"path":   *ingestPol,
+				"err":    err,
+			}).Fatal("Error while loading ingestion policy, exiting")
+		}
+		srv.SetPolicy(pol)
+	}
 
 	// Kick off the http message ingestor.
 	// TODO let config/params control address
@@ -139,7 +217,7 @@ func main() {
 	if *webappKey != "" && *webappCert == "" {
 		*webappCert = *webappKey + ".crt"
 	}
-	go RunWebapp(listenAt+strconv.Itoa(DefaultAppPort), *webappKey, *webappCert, j.Get)
+	go RunWebapp(listenAt+strconv.Itoa(DefaultAppPort), *webappKey, *webappCert, j.Get, history.NewBuilder(j, sd))
 
 	// Block on goji's graceful waiter, allowing the http connections to shut down nicely.
 	// FIXME using this should be unnecessary if we're crash-only
@@ -149,7 +227,7 @@ func main() {
 // RunWebapp runs the pipeviz http frontend webapp on the specified address.
 //
 // This blocks on the http listening loop, so it should typically be called in its own goroutine.
-func RunWebapp(addr, key, cert string, f mlog.RecordGetter) {
+func RunWebapp(addr, key, cert string, f mlog.RecordGetter, hb *history.Builder) {
 	mf := web.New()
 	useTLS := key != "" && cert != ""
 
@@ -185,17 +263,24 @@ func RunWebapp(addr, key, cert string, f mlog.RecordGetter) {
 		})
 	}
 
-	// A middleware to attach the mlog-getting func to the env for later use.
+	// A middleware to attach the mlog-getting func and the historical graph
+	// builder to the env for later use.
 	mf.Use(func(c *web.C, h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if c.Env == nil {
 				c.Env = make(map[interface{}]interface{})
 			}
 			c.Env["mlogGet"] = f
+			c.Env["history"] = hb
 			h.ServeHTTP(w, r)
 		})
 	})
 
+	// Metrics, including the ingestor's, are for operators, not producers, so
+	// they are served here rather than on the ingestion port. Registered
+	// first, as the webapp serves static assets from everything it does not
+	// otherwise route.
+	mf.Get("/debug/vars", expvar.Handler())
 	webapp.RegisterToMux(mf)
 
 	mf.Compile()
@@ -215,29 +300,76 @@ func RunWebapp(addr, key, cert string, f mlog.RecordGetter) {
 	}
 }
 
-// Rebuilds the graph from the extant entries in a mlog.
-func restoreGraph(j mlog.Store) (system.CoreGraph, error) {
+// Rebuilds the graph from the extant entries in a mlog. If a snapshot dir is
+// provided, the newest valid snapshot is used as a starting point, and only
+// the records after it are replayed.
+func restoreGraph(j mlog.Store, sd *snapshot.Dir) (system.CoreGraph, error) {
 	g := represent.NewGraph()
 
-	var item *mlog.Record
+	// we manually iterate to the count because we assume that any messages
+	// that come in while we do this processing will be queued elsewhere.
 	tot, err := j.Count()
 	if err != nil {
 		// mlog failed to report a count for some reason, bail out
 		return g, err
-	} else if tot > 0 {
-		// we manually iterate to the count because we assume that any messages
-		// that come in while we do this processing will be queued elsewhere.
-		for i := uint64(1); i-1 < tot; i++ {
-			item, err = j.Get(i)
-			if err != nil {
-				// TODO returning out here could end us up somwehere weird
-				return g, err
-			}
-			msg := &ingest.Message{}
-			json.Unmarshal(item.Message, msg)
-			g = g.Merge(item.Index, msg.UnificationForm())
+	}
+
+	if sd != nil {
+		sg, info, err := sd.Latest(tot)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"system": "main",
+				"err":    err,
+			}).Warn("Error while searching for graph snapshots; replaying entire mlog")
+		} else if sg != nil {
+			log.WithFields(log.Fields{
+				"system": "main",
+				"path":   info.Path,
+				"msgid":  info.MsgID,
+			}).Info("Restored graph from snapshot; replaying subsequent mlog records")
+			g = sg
+		}
+	}
+
+	// TODO returning out on error could end us up somwehere weird
+	return ingest.Replay(g, j.Get, tot)
+}
+
+// loadIngestAuth creates the authenticators for the ingestion port requested
+// by flags. If none are requested, the ingestor accepts messages from anyone.
+func loadIngestAuth() (auth []ingest.Authenticator) {
+	fail := func(path string, err error) {
+		log.WithFields(log.Fields{
+			"system": "main",
+			"path":   path,
+			"err":    err,
+		}).Fatal("Error while loading ingestion auth credentials, exiting")
+	}
+
+	if *ingestToks != "" {
+		a, err := ingest.LoadTokenAuth(*ingestToks)
+		if err != nil {
+			fail(*ingestToks, err)
+		}
+		auth = append(auth, a)
+	}
+	if *ingestHMAC != "" {
+		a, err := ingest.LoadHMACAuth(*ingestHMAC)
+		if err != nil {
+			fail(*ingestHMAC, err)
+		}
+		auth = append(auth, a)
+	}
+	if *ingestCA != "" {
+		if *ingestKey == "" {
+			fail(*ingestCA, errors.New("client certificates require TLS on the ingestion port"))
+		}
+		a, err := ingest.LoadCertAuth(*ingestCA)
+		if err != nil {
+			fail(*ingestCA, err)
 		}
+		auth = append(auth, a)
 	}
 
-	return g, nil
+	return auth
 }
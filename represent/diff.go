@@ -0,0 +1,212 @@
+package represent
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// GraphDiff describes the changes necessary to transform one version of the
+// graph into another. All slices are ordered by ID.
+type GraphDiff struct {
+	From            uint64         `json:"from"`
+	To              uint64         `json:"to"`
+	VerticesAdded   []DiffVertex   `json:"verticesAdded"`
+	VerticesRemoved []DiffVertex   `json:"verticesRemoved"`
+	VerticesChanged []VertexChange `json:"verticesChanged"`
+	EdgesAdded      []DiffEdge     `json:"edgesAdded"`
+	EdgesRemoved    []DiffEdge     `json:"edgesRemoved"`
+	// Edges present in both graphs, but with differing properties. The
+	// edge is given as it exists in the 'to' graph.
+	EdgesChanged []DiffEdge `json:"edgesChanged"`
+}
+
+// DiffVertex is a vertex (without its edges) as it appears in a GraphDiff.
+type DiffVertex struct {
+	ID    uint64                     `json:"id"`
+	VType system.VType               `json:"type"`
+	Props map[string]system.Property `json:"properties"`
+}
+
+// DiffEdge is an edge as it appears in a GraphDiff.
+type DiffEdge struct {
+	ID     uint64                     `json:"id"`
+	Source uint64                     `json:"source"`
+	Target uint64                     `json:"target"`
+	EType  system.EType               `json:"etype"`
+	Props  map[string]system.Property `json:"properties"`
+}
+
+// VertexChange lists the properties that differ on a vertex that exists in
+// both graphs.
+type VertexChange struct {
+	ID    uint64       `json:"id"`
+	VType system.VType `json:"type"`
+	Props []PropChange `json:"properties"`
+}
+
+// PropChange describes a single changed property. Old is nil if the property
+// was added; New is nil if it was removed.
+type PropChange struct {
+	Key string           `json:"key"`
+	Old *system.Property `json:"old"`
+	New *system.Property `json:"new"`
+}
+
+// Empty indicates whether the diff contains no changes at all.
+func (d GraphDiff) Empty() bool {
+	return len(d.VerticesAdded) == 0 && len(d.VerticesRemoved) == 0 && len(d.VerticesChanged) == 0 &&
+		len(d.EdgesAdded) == 0 && len(d.EdgesRemoved) == 0 && len(d.EdgesChanged) == 0
+}
+
+// allVertices is a VFilter that matches every vertex.
+type allVertices struct{}
+
+func (allVertices) VType() system.VType       { return system.VTypeNone }
+func (allVertices) VProps() []system.PropPair { return nil }
+
+// Diff computes the changes between two versions of a graph. The graphs
+// need not be related by ancestry, though the result is only meaningful if
+// they are; vertex and edge identity is determined solely by ID.
+func Diff(from, to system.CoreGraph) GraphDiff {
+	d := GraphDiff{
+		From: from.MsgID(),
+		To:   to.MsgID(),
+	}
+
+	for _, vt := range to.VerticesWith(allVertices{}) {
+		old, err := from.Get(vt.ID)
+		if err != nil {
+			d.VerticesAdded = append(d.VerticesAdded, diffVertex(vt))
+			vt.OutEdges.ForEach(func(_ string, val ps.Any) {
+				d.EdgesAdded = append(d.EdgesAdded, diffEdge(val.(system.StdEdge)))
+			})
+			continue
+		}
+
+		if pc := diffProps(old.Vertex.Properties, vt.Vertex.Properties); len(pc) > 0 {
+			d.VerticesChanged = append(d.VerticesChanged, VertexChange{
+				ID:    vt.ID,
+				VType: vt.Vertex.Type,
+				Props: pc,
+			})
+		}
+
+		// Only out-edges are examined, so that each edge is visited once
+		vt.OutEdges.ForEach(func(k string, val ps.Any) {
+			e := val.(system.StdEdge)
+			oval, exists := old.OutEdges.Lookup(k)
+			if !exists {
+				d.EdgesAdded = append(d.EdgesAdded, diffEdge(e))
+			} else if len(diffProps(oval.(system.StdEdge).Props, e.Props)) > 0 {
+				d.EdgesChanged = append(d.EdgesChanged, diffEdge(e))
+			}
+		})
+	}
+
+	for _, vt := range from.VerticesWith(allVertices{}) {
+		nvt, err := to.Get(vt.ID)
+		if err != nil {
+			d.VerticesRemoved = append(d.VerticesRemoved, diffVertex(vt))
+		}
+
+		vt.OutEdges.ForEach(func(k string, val ps.Any) {
+			if err == nil {
+				if _, exists := nvt.OutEdges.Lookup(k); exists {
+					return
+				}
+			}
+			d.EdgesRemoved = append(d.EdgesRemoved, diffEdge(val.(system.StdEdge)))
+		})
+	}
+
+	sort.Sort(diffVerticesByID(d.VerticesAdded))
+	sort.Sort(diffVerticesByID(d.VerticesRemoved))
+	sort.Sort(vertexChangesByID(d.VerticesChanged))
+	sort.Sort(diffEdgesByID(d.EdgesAdded))
+	sort.Sort(diffEdgesByID(d.EdgesRemoved))
+	sort.Sort(diffEdgesByID(d.EdgesChanged))
+
+	return d
+}
+
+// diffProps returns the changes between two property maps, ordered by key.
+// A property is considered changed if either its value or its MsgSrc differs.
+func diffProps(from, to ps.Map) (pc []PropChange) {
+	to.ForEach(func(k string, val ps.Any) {
+		np := val.(system.Property)
+		oval, exists := from.Lookup(k)
+		if !exists {
+			pc = append(pc, PropChange{Key: k, New: &np})
+			return
+		}
+
+		op := oval.(system.Property)
+		if op.MsgSrc != np.MsgSrc || !reflect.DeepEqual(op.Value, np.Value) {
+			pc = append(pc, PropChange{Key: k, Old: &op, New: &np})
+		}
+	})
+
+	from.ForEach(func(k string, val ps.Any) {
+		if _, exists := to.Lookup(k); !exists {
+			op := val.(system.Property)
+			pc = append(pc, PropChange{Key: k, Old: &op})
+		}
+	})
+
+	sort.Sort(propChangesByKey(pc))
+	return pc
+}
+
+func diffVertex(vt system.VertexTuple) DiffVertex {
+	return DiffVertex{
+		ID:    vt.ID,
+		VType: vt.Vertex.Type,
+		Props: propsToMap(vt.Vertex.Properties),
+	}
+}
+
+func diffEdge(e system.StdEdge) DiffEdge {
+	return DiffEdge{
+		ID:     e.ID,
+		Source: e.Source,
+		Target: e.Target,
+		EType:  e.EType,
+		Props:  propsToMap(e.Props),
+	}
+}
+
+func propsToMap(m ps.Map) map[string]system.Property {
+	ret := make(map[string]system.Property, m.Size())
+	m.ForEach(func(k string, val ps.Any) {
+		ret[k] = val.(system.Property)
+	})
+
+	return ret
+}
+
+type diffVerticesByID []DiffVertex
+
+func (s diffVerticesByID) Len() int           { return len(s) }
+func (s diffVerticesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s diffVerticesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type vertexChangesByID []VertexChange
+
+func (s vertexChangesByID) Len() int           { return len(s) }
+func (s vertexChangesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s vertexChangesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type diffEdgesByID []DiffEdge
+
+func (s diffEdgesByID) Len() int           { return len(s) }
+func (s diffEdgesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s diffEdgesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type propChangesByKey []PropChange
+
+func (s propChangesByKey) Len() int           { return len(s) }
+func (s propChangesByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s propChangesByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,101 @@
+package represent
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestDiff(t *testing.T) {
+	from := getGraphFixture()
+	from.msgid = 5
+
+	// Build a modified copy of the fixture graph
+	to := getGraphFixture()
+	to.msgid = 6
+
+	// vid 5 is removed
+	to.vtuples = to.vtuples.Delete("5")
+
+	// vid 2 gets a changed prop and a new prop
+	vt2, _ := to.Get(2)
+	vt2.Vertex.Properties = vt2.Vertex.Properties.
+		Set("prop1", system.Property{MsgSrc: 6, Value: "qux"}).
+		Set("prop9", system.Property{MsgSrc: 6, Value: 9})
+	to.vtuples = to.vtuples.Set("2", vt2)
+
+	// vid 4 loses a prop
+	vt4, _ := to.Get(4)
+	vt4.Vertex.Properties = vt4.Vertex.Properties.Delete("prop3")
+	// edge 13 is removed
+	vt4.InEdges = vt4.InEdges.Delete("13")
+	to.vtuples = to.vtuples.Set("4", vt4)
+	vt3, _ := to.Get(3)
+	vt3.OutEdges = vt3.OutEdges.Delete("13")
+	to.vtuples = to.vtuples.Set("3", vt3)
+
+	// edge 10 has its props changed
+	edge10 := mkEdge(10, 1, 2, 6, "dummy-edge-type1", "eprop1", "changed")
+	vt1, _ := to.Get(1)
+	vt1.OutEdges = vt1.OutEdges.Set("10", edge10)
+	// vid 6 is added, with an edge (14) to vid 1
+	edge14 := mkEdge(14, 6, 1, 6, "dummy-edge-type1")
+	vt1.InEdges = vt1.InEdges.Set("14", edge14)
+	to.vtuples = to.vtuples.Set("1", vt1)
+	vt6 := mkTuple(6, system.NewVertex("vt3", 6, tprops("prop1", "new")...), edge14)
+	to.vtuples = to.vtuples.Set(strconv.Itoa(6), vt6)
+
+	d := Diff(from, to)
+
+	if d.From != 5 || d.To != 6 {
+		t.Errorf("Diff should be from msgid 5 to 6, got %v to %v", d.From, d.To)
+	}
+
+	if len(d.VerticesAdded) != 1 || d.VerticesAdded[0].ID != 6 {
+		t.Errorf("Expected vid 6 to be the only added vertex, got %+v", d.VerticesAdded)
+	}
+	if len(d.VerticesRemoved) != 1 || d.VerticesRemoved[0].ID != 5 {
+		t.Errorf("Expected vid 5 to be the only removed vertex, got %+v", d.VerticesRemoved)
+	}
+
+	if len(d.VerticesChanged) != 2 {
+		t.Fatalf("Expected two changed vertices, got %+v", d.VerticesChanged)
+	}
+
+	c2 := d.VerticesChanged[0]
+	if c2.ID != 2 || len(c2.Props) != 2 {
+		t.Fatalf("Expected two prop changes on vid 2, got %+v", c2)
+	}
+	if p := c2.Props[0]; p.Key != "prop1" || p.Old.Value != "bar" || p.New.Value != "qux" || p.Old.MsgSrc != 2 || p.New.MsgSrc != 6 {
+		t.Errorf("Incorrect change recorded for prop1 on vid 2: %+v -> %+v", p.Old, p.New)
+	}
+	if p := c2.Props[1]; p.Key != "prop9" || p.Old != nil || p.New.Value != 9 {
+		t.Errorf("Expected prop9 to be added to vid 2, got %+v", p)
+	}
+
+	c4 := d.VerticesChanged[1]
+	if c4.ID != 4 || len(c4.Props) != 1 || c4.Props[0].Key != "prop3" || c4.Props[0].New != nil {
+		t.Errorf("Expected prop3 to be removed from vid 4, got %+v", c4)
+	}
+
+	if len(d.EdgesAdded) != 1 || d.EdgesAdded[0].ID != 14 {
+		t.Errorf("Expected edge 14 to be the only added edge, got %+v", d.EdgesAdded)
+	}
+	if len(d.EdgesRemoved) != 1 || d.EdgesRemoved[0].ID != 13 {
+		t.Errorf("Expected edge 13 to be the only removed edge, got %+v", d.EdgesRemoved)
+	}
+	if len(d.EdgesChanged) != 1 || d.EdgesChanged[0].Props["eprop1"].Value != "changed" {
+		t.Errorf("Expected edge 10 to be the only changed edge, got %+v", d.EdgesChanged)
+	}
+
+	if !Diff(from, from).Empty() {
+		t.Error("Diff of a graph against itself should be empty")
+	}
+
+	// Reversing the direction should swap adds and removes
+	rd := Diff(to, from)
+	if len(rd.VerticesAdded) != 1 || rd.VerticesAdded[0].ID != 5 || len(rd.EdgesRemoved) != 1 || rd.EdgesRemoved[0].ID != 14 {
+		t.Errorf("Reversed diff did not invert adds and removes: %+v", rd)
+	}
+}
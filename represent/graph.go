@@ -3,6 +3,7 @@ package represent
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
@@ -17,8 +18,15 @@ var i2a = func(i uint64) string {
 // the main graph construct
 type coreGraph struct {
 	msgid, vserial uint64
+	msgtime        time.Time // receipt time of msgid, if known
 	vtuples        ps.Map
-	orphans        edgeSpecSet // FIXME breaks immut
+	vindex         ps.Map // secondary indexes; see index.go
+	affirmed       ps.Map // vid to time of the message that last described it; see ttl.go
+	expiry         ps.Map // vtype to expiryQueue, for types with an expire TTL; see ttl.go
+	// Edge specs held over for resolution in later merges. Like the rest of
+	// the graph, the set and its members are never modified once the graph
+	// has been returned from Merge; each merge builds a new set.
+	orphans edgeSpecSet
 }
 
 // NewGraph creates a new in-memory coreGraph and returns it as a system.CoreGraph.
@@ -27,7 +35,7 @@ func NewGraph() system.CoreGraph {
 		"system": "engine",
 	}).Debug("New coreGraph created")
 
-	return &coreGraph{vtuples: ps.NewMap(), vserial: 0}
+	return &coreGraph{vtuples: ps.NewMap(), vindex: ps.NewMap(), affirmed: ps.NewMap(), expiry: ps.NewMap(), vserial: 0}
 }
 
 type veProcessingInfo struct {
@@ -35,6 +43,7 @@ type veProcessingInfo struct {
 	uif   system.UnifyInstructionForm
 	e     []system.EdgeSpec
 	msgid uint64
+	time  time.Time
 }
 
 type edgeSpecSet []*veProcessingInfo
@@ -59,133 +68,142 @@ func (g *coreGraph) MsgID() uint64 {
 
 // the method to merge a message into the graph
 func (og *coreGraph) Merge(msgid uint64, uifs []system.UnifyInstructionForm) system.CoreGraph {
-	// TODO use a buffering pool to minimize allocs
-	var ess edgeSpecSet
+	// with no time given, time stands still
+	return og.MergeAt(msgid, og.msgtime, uifs)
+}
 
-	logEntry := log.WithFields(log.Fields{
+// MergeAt merges a message into the graph, recording the provided time as
+// the time of the message.
+func (og *coreGraph) MergeAt(msgid uint64, t time.Time, uifs []system.UnifyInstructionForm) system.CoreGraph {
+	return og.mergeAt(msgid, t, uifs, log.WithFields(log.Fields{
 		"system": "engine",
 		"msgid":  msgid,
-	})
+	}))
+}
 
+// DryRunAt merges a message into the graph exactly as MergeAt does, but logs
+// the merge as a dry run.
+func (og *coreGraph) DryRunAt(msgid uint64, t time.Time, uifs []system.UnifyInstructionForm) system.CoreGraph {
+	return og.mergeAt(msgid, t, uifs, log.WithFields(log.Fields{
+		"system":  "engine",
+		"msgid":   msgid,
+		"dry-run": true,
+	}))
+}
+
+// mergeAt does the work of MergeAt, logging everything about the merge to the
+// provided entry.
+func (og *coreGraph) mergeAt(msgid uint64, t time.Time, uifs []system.UnifyInstructionForm, logEntry *log.Entry) system.CoreGraph {
 	logEntry.Infof("Merging message %d into graph", msgid)
 
 	g := og.clone()
-	g.msgid = msgid
+	g.msgid, g.msgtime = msgid, t
+	r := newResolver(g, msgid, logEntry)
+
+	// Tombstones are applied before anything else in the message, so that a
+	// vertex may be removed and replaced by the same message.
+	var removed []system.VertexTuple
+	var detached []uint64
+	for _, uif := range uifs {
+		if ts, ok := uif.(system.Tombstone); ok {
+			if vt, neighbors, ok := g.removeTombstone(logEntry, ts); ok {
+				removed = append(removed, vt)
+				detached = append(detached, neighbors...)
+			}
+		}
+	}
+	if len(removed) > 0 {
+		logEntry.Infof("Removed %d vertices for tombstones", len(removed))
+	}
 
 	// Ensure vertices, then record into intermediate, orphan-enabling container
+	var ess edgeSpecSet
 	for _, uif := range uifs {
+		switch uif.(type) {
+		case system.Tombstone, system.AuthoritativeScope:
+			continue
+		}
+
+		vt := g.ensureVertex(msgid, uif)
+		g.affirm(vt)
+
 		ess = append(ess, &veProcessingInfo{
-			vt:  g.ensureVertex(msgid, uif),
+			vt:  vt,
 			uif: uif,
 			// copy out the edges for later bookkeeping
 			e:     append(uif.ScopingSpecs(), uif.EdgeSpecs()...),
 			msgid: msgid,
+			time:  t,
 		})
 	}
 
+	// With everything in the message present, remove whatever it omitted
+	// from the scopes it is authoritative for.
+	described := make(map[uint64]struct{}, len(ess))
+	for _, info := range ess {
+		described[info.vt.ID] = struct{}{}
+	}
+	for _, uif := range uifs {
+		if as, ok := uif.(system.AuthoritativeScope); ok {
+			out, neighbors := g.removeOutOfScope(logEntry, as, described)
+			removed = append(removed, out...)
+			detached = append(detached, neighbors...)
+		}
+	}
+
+	// Vertices that have outlived their TTL are removed only after this
+	// message has had the chance to reaffirm them.
+	expired, expDetached := g.expireVertices(logEntry)
+	removed = append(removed, expired...)
+	detached = append(detached, expDetached...)
+
 	logEntry.Infof("Adding %d orphan edge spec sets from previous merges", len(g.orphans))
-	// Reinclude the held-over set of orphans for edge (re-)resolutions
-	var ess2 edgeSpecSet
-	// TODO lots of things very wrong with this approach, but works for first pass
+	// Held-over orphans go in first, waiting. Copies are made so that the
+	// orphan set of the graph being merged into is not modified.
 	for _, orphan := range g.orphans {
+		o := *orphan
 		// vertex ident failed; try again now that new vertices are present
-		if orphan.vt.ID == 0 {
-			orphan.vt = g.ensureVertex(orphan.msgid, orphan.uif)
+		if o.vt.ID == 0 {
+			o.vt = g.ensureVertex(o.msgid, o.uif)
 		} else {
 			// ensure we have latest version of vt
-			vt, err := g.Get(orphan.vt.ID)
+			vt, err := g.Get(o.vt.ID)
 			if err != nil {
 				// but if that vid has gone away, forget about it completely
-				logEntry.Infof("Orphan vid %d went away, discarding from orphan list", orphan.vt.ID)
+				logEntry.Infof("Orphan vid %d went away, discarding from orphan list", o.vt.ID)
 				continue
 			}
-			orphan.vt = vt
+			o.vt = vt
 		}
 
-		ess2 = append(ess2, orphan)
+		r.add(&o, false)
 	}
 
-	// Put orphan stuff first so that it's guaranteed to be overwritten on conflict
-	ess = append(ess2, ess...)
-
-	// All vertices processed. Now, process edges in passes, ensuring that each
-	// pass diminishes the number of remaining edges. If it doesn't, the remaining
-	// edges need to be attached to null-vertices of the appropriate type.
-	//
-	// This is a little wasteful, but it's the simplest way to let any possible
-	// dependencies between edges work themselves out. It has provably incorrect
-	// cases, however, and will need to be replaced.
-	var ec, lec, pass int
-	var specs []system.EdgeSpec
-	for ec = ess.EdgeCount(); ec != 0 && ec != lec; ec = ess.EdgeCount() {
-		pass++
-		lec = ec
-		l2 := logEntry.WithFields(log.Fields{
-			"pass":       pass,
-			"edge-count": ec,
-		})
-
-		l2.Debug("Beginning edge resolution pass")
-		for infokey, info := range ess {
-			l3 := logEntry.WithFields(log.Fields{
-				"vid":   info.vt.ID,
-				"vtype": info.vt.Vertex.Typ(),
-			})
-			// Ensure our local copy of the tuple is up to date
-			info.vt, _ = g.Get(info.vt.ID)
-
-			// Zero-alloc filtering technique
-			specs, info.e = info.e, info.e[:0]
-			for _, spec := range specs {
-				l3.Debugf("Resolving EdgeSpec of type %T", spec)
-				edge, success := spec.Resolve(g, msgid, info.vt)
-				if success {
-					l4 := l3.WithFields(log.Fields{
-						"target-vid": edge.Target,
-						"etype":      edge.EType,
-					})
-
-					l4.Debug("Edge resolved successfully")
-
-					edge.Source = info.vt.ID
-					if edge.ID == 0 {
-						// new edge, allocate a new id for it
-						g.vserial++
-						edge.ID = g.vserial
-						l4.WithField("edge-id", edge.ID).Debug("New edge created")
-					} else {
-						l4.WithField("edge-id", edge.ID).Debug("Edge will merge over existing edge")
-					}
-
-					info.vt.OutEdges = info.vt.OutEdges.Set(i2a(edge.ID), edge)
-					g.vtuples = g.vtuples.Set(i2a(info.vt.ID), info.vt)
-
-					any, _ := g.vtuples.Lookup(i2a(edge.Target))
-					tvt := any.(system.VertexTuple)
-
-					tvt.InEdges = tvt.InEdges.Set(i2a(edge.ID), edge)
-					g.vtuples = g.vtuples.Set(i2a(tvt.ID), tvt)
-				} else {
-					l3.Debug("Unsuccessful edge resolution; reattempt on next pass")
-					// FIXME mem leaks if done this way...?
-					info.e = append(info.e, spec)
-				}
-			}
-			// set the processing info back into its original position in the slice
-			ess[infokey] = info
-		}
+	// Wake any orphans that depend on the vertices this message touched,
+	// then queue all of this message's own specs for a first attempt. This
+	// puts orphans first, so that they are guaranteed to be overwritten on
+	// conflict.
+	for _, vt := range removed {
+		r.removed(vt)
+	}
+	for _, vid := range detached {
+		r.touch(vid)
 	}
-	logEntry.WithField("passes", pass).Info("Edge resolution complete")
-
-	g.orphans = g.orphans[:0]
 	for _, info := range ess {
-		if len(info.e) == 0 {
-			continue
-		}
-
-		g.orphans = append(g.orphans, info)
+		r.touch(info.vt.ID)
 	}
-	logEntry.Infof("Adding %d orphan edge spec sets from previous merges", len(g.orphans))
+	for _, info := range ess {
+		r.add(info, true)
+	}
+
+	r.run()
+	g.orphans = g.expireOrphans(r.orphans(), logEntry)
+
+	logEntry.WithFields(log.Fields{
+		"attempts":   r.attempts,
+		"edge-count": len(r.all),
+	}).Info("Edge resolution complete")
+	logEntry.Infof("Holding %d orphan edge spec sets for later merges", len(g.orphans))
 
 	return g
 }
@@ -219,6 +237,7 @@ func (g *coreGraph) ensureVertex(msgid uint64, sd system.UnifyInstructionForm) (
 		g.vserial++
 		final.ID = g.vserial
 		g.vtuples = g.vtuples.Set(i2a(g.vserial), final)
+		g.indexVertex(final)
 
 		// Resolve scoping edge specs early, here
 		for _, spec := range sd.ScopingSpecs() {
@@ -261,6 +280,8 @@ func (g *coreGraph) ensureVertex(msgid uint64, sd system.UnifyInstructionForm) (
 
 		final = system.VertexTuple{ID: vid, InEdges: vt.InEdges, OutEdges: vt.OutEdges, Vertex: nu}
 		g.vtuples = g.vtuples.Set(i2a(vid), final)
+		g.unindexVertex(vt)
+		g.indexVertex(final)
 	}
 
 	return
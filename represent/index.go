@@ -0,0 +1,173 @@
+package represent
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// indexedProps lists, per vertex type, the properties for which the graph
+// maintains a secondary index. These are the properties that unify functions
+// and edge specs look vertices up by; lookups on any other property fall
+// back to a scan of all vertices of the requested type.
+var indexedProps = map[system.VType][]string{
+	"commit":         {"sha1"},
+	"environment":    {"hostname", "nick"},
+	"logic-state":    {"path"},
+	"process":        {"pid"},
+	"dataset":        {"name"},
+	"parent-dataset": {"name"},
+	"pkg-yum":        {"name"},
+	"git-tag":        {"name"},
+	"git-branch":     {"name"},
+}
+
+// The graph's secondary indexes are kept in a single persistent map, so that
+// they are structurally shared between graph versions exactly as vtuples is.
+// Each entry in the map is itself a persistent set of vids (stringified vid
+// -> vid), keyed either by vertex type alone, or by vertex type, property
+// name, and property value.
+//
+// A graph with a nil index is unindexed; VerticesWith scans all vertices, and
+// index maintenance is a no-op. Graphs created by this package's constructors
+// are always indexed.
+
+func typeIndexKey(vtype system.VType) string {
+	return "t\x00" + string(vtype)
+}
+
+func propIndexKey(vtype system.VType, k string, v interface{}) (string, bool) {
+	vk, ok := indexValue(v)
+	if !ok {
+		return "", false
+	}
+	return "p\x00" + string(vtype) + "\x00" + k + "\x00" + vk, true
+}
+
+// indexValue produces a string form of a property value such that any two
+// values considered equal by system.EqualValues produce the same string.
+// Distinct values may also collide; lookups always re-check candidates, so
+// this costs only time, not correctness.
+//
+// Values that can never be equal to anything (uncomparable types other than
+// byte slices), and floats (for which -0 == 0, but they print differently),
+// are not indexable.
+func indexValue(v interface{}) (string, bool) {
+	switch tv := v.(type) {
+	case nil:
+		return "<nil>", true
+	case string:
+		return "string:" + tv, true
+	case []byte:
+		return "[]uint8:" + string(tv), true
+	}
+
+	t := reflect.TypeOf(v)
+	if !t.Comparable() || t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64 {
+		return "", false
+	}
+	return fmt.Sprintf("%T:%v", v, v), true
+}
+
+// reindex discards any existing index and rebuilds it from the graph's
+// current set of vertices.
+func (g *coreGraph) reindex() {
+	g.vindex = ps.NewMap()
+	g.vtuples.ForEach(func(_ string, val ps.Any) {
+		g.indexVertex(val.(system.VertexTuple))
+	})
+}
+
+// indexVertex adds the vertex to all applicable indexes.
+func (g *coreGraph) indexVertex(vt system.VertexTuple) {
+	g.eachIndexKey(vt, func(key string) {
+		var set ps.Map
+		if any, exists := g.vindex.Lookup(key); exists {
+			set = any.(ps.Map)
+		} else {
+			set = ps.NewMap()
+		}
+		g.vindex = g.vindex.Set(key, set.Set(i2a(vt.ID), vt.ID))
+	})
+}
+
+// unindexVertex removes the vertex from all indexes it was added to. The
+// tuple must be the version of the vertex that was originally indexed, as
+// that determines which index entries it appears in.
+func (g *coreGraph) unindexVertex(vt system.VertexTuple) {
+	g.eachIndexKey(vt, func(key string) {
+		any, exists := g.vindex.Lookup(key)
+		if !exists {
+			return
+		}
+
+		set := any.(ps.Map).Delete(i2a(vt.ID))
+		if set.Size() == 0 {
+			g.vindex = g.vindex.Delete(key)
+		} else {
+			g.vindex = g.vindex.Set(key, set)
+		}
+	})
+}
+
+func (g *coreGraph) eachIndexKey(vt system.VertexTuple, f func(key string)) {
+	if g.vindex == nil {
+		return
+	}
+
+	vtype := vt.Vertex.Typ()
+	f(typeIndexKey(vtype))
+
+	props := vt.Vertex.Props()
+	for _, k := range indexedProps[vtype] {
+		val, exists := props.Lookup(k)
+		if !exists {
+			continue
+		}
+
+		if key, ok := propIndexKey(vtype, k, val.(system.Property).Value); ok {
+			f(key)
+		}
+	}
+}
+
+// candidates returns the narrowest indexed set of vids that must contain all
+// vertices satisfying the provided type and property constraints. The second
+// return value is false if no index applies, and all vertices must be
+// considered.
+//
+// Only plain equality constraints can be satisfied from a property index;
+// PropPredicates are always evaluated against the candidates.
+func (g *coreGraph) candidates(vtype system.VType, props []system.PropPair) (ps.Map, bool) {
+	if g.vindex == nil || vtype == system.VTypeNone {
+		return nil, false
+	}
+
+	key := typeIndexKey(vtype)
+	for _, pp := range props {
+		if _, ok := pp.V.(system.PropPredicate); ok || !isIndexed(vtype, pp.K) {
+			continue
+		}
+
+		if pk, ok := propIndexKey(vtype, pp.K, pp.V); ok {
+			key = pk
+			break
+		}
+	}
+
+	if any, exists := g.vindex.Lookup(key); exists {
+		return any.(ps.Map), true
+	}
+	return ps.NewMap(), true
+}
+
+func isIndexed(vtype system.VType, k string) bool {
+	for _, ik := range indexedProps[vtype] {
+		if ik == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package represent
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/semantic"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func mergeEinFixtures() *coreGraph {
+	g := NewGraph()
+	for k, m := range msgs {
+		g = g.Merge(uint64(k+1), m.UnificationForm())
+	}
+	return g.(*coreGraph)
+}
+
+func vidsOf(vtv system.VertexTupleVector) map[uint64]bool {
+	ret := make(map[uint64]bool)
+	for _, vt := range vtv {
+		ret[vt.ID] = true
+	}
+	return ret
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	g := mergeEinFixtures()
+	unindexed := g.clone()
+	unindexed.vindex = nil
+
+	commits := g.VerticesWith(q.Qbv(system.VType("commit")))
+	if len(commits) == 0 {
+		t.Fatal("Fixture graph should contain commits")
+	}
+	sha1, _ := commits[0].Vertex.Props().Lookup("sha1")
+
+	filters := map[string]system.VFilter{
+		"all":             q.Qbv(),
+		"vtype only":      q.Qbv(system.VType("commit")),
+		"missing vtype":   q.Qbv(system.VType("nonexistent")),
+		"commit sha1":     q.Qbv(system.VType("commit"), "sha1", sha1.(system.Property).Value),
+		"env hostname":    q.Qbv(system.VType("environment"), "hostname", "prod-web01"),
+		"logic path":      q.Qbv(system.VType("logic-state"), "path", "/usr/sbin/httpd"),
+		"process pid":     q.Qbv(system.VType("process"), "pid", 6212),
+		"unindexed prop":  q.Qbv(system.VType("environment"), "provider", "vagrant"),
+		"predicate":       q.Qbv(system.VType("environment"), "hostname", q.Prefix("prod-")),
+		"indexed and not": q.Qbv(system.VType("logic-state"), "type", "binary", "path", "/usr/sbin/httpd"),
+		"no match":        q.Qbv(system.VType("environment"), "hostname", "nope"),
+	}
+
+	for name, vf := range filters {
+		expect := vidsOf(unindexed.VerticesWith(vf))
+		actual := vidsOf(g.VerticesWith(vf))
+		if fmt.Sprint(expect) != fmt.Sprint(actual) {
+			t.Errorf("Indexed lookup (%s) returned %v, but full scan returned %v", name, actual, expect)
+		}
+	}
+
+	// Graphs built outside of Merge must be fully indexed, too
+	sg := Subgraph(g, []uint64{commits[0].ID})
+	if len(sg.VerticesWith(filters["commit sha1"])) != 1 {
+		t.Error("Subgraph should have indexed its commit vertex")
+	}
+}
+
+func TestIndexMaintenance(t *testing.T) {
+	mkmsg := func(nick string) ingest.Message {
+		var m ingest.Message
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"environments": [{"address": {"hostname": "indexhost"}, "nick": %q}]}`, nick)), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	g1 := NewGraph().Merge(1, mkmsg("first").UnificationForm())
+	g2 := g1.Merge(2, mkmsg("second").UnificationForm())
+
+	if len(g2.VerticesWith(q.Qbv(system.VType("environment")))) != 1 {
+		t.Fatal("Second message should have merged into the existing environment")
+	}
+	if len(g2.VerticesWith(q.Qbv(system.VType("environment"), "nick", "first"))) != 0 {
+		t.Error("Index should no longer contain the environment under its old nick")
+	}
+	if len(g2.VerticesWith(q.Qbv(system.VType("environment"), "nick", "second"))) != 1 {
+		t.Error("Index should contain the environment under its new nick")
+	}
+	if len(g1.VerticesWith(q.Qbv(system.VType("environment"), "nick", "first"))) != 1 {
+		t.Error("Index changes should not propagate back to the original graph")
+	}
+}
+
+var commitGraph *coreGraph
+
+// Builds (once) a graph containing a single linear history of 100k commits.
+func getCommitGraph(b *testing.B) *coreGraph {
+	if commitGraph != nil {
+		return commitGraph
+	}
+
+	log.SetLevel(log.WarnLevel)
+	var m ingest.Message
+	for i := 0; i < 100000; i++ {
+		c := semantic.Commit{Sha1Str: fmt.Sprintf("%040x", i+1), Subject: "bench"}
+		if i > 0 {
+			c.ParentsStr = []string{fmt.Sprintf("%040x", i)}
+		}
+		m.C = append(m.C, c)
+	}
+
+	commitGraph = NewGraph().Merge(1, m.UnificationForm()).(*coreGraph)
+	return commitGraph
+}
+
+func benchmarkMergeCommit(b *testing.B, indexed bool) {
+	g := getCommitGraph(b).clone()
+	if !indexed {
+		g.vindex = nil
+	}
+
+	m := ingest.Message{C: []semantic.Commit{{
+		Sha1Str:    fmt.Sprintf("%040x", 100001),
+		ParentsStr: []string{fmt.Sprintf("%040x", 100000)},
+		Subject:    "bench",
+	}}}
+	uifs := m.UnificationForm()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Merge(2, uifs)
+	}
+}
+
+func BenchmarkMergeCommit100kIndexed(b *testing.B) {
+	benchmarkMergeCommit(b, true)
+}
+
+func BenchmarkMergeCommit100kUnindexed(b *testing.B) {
+	benchmarkMergeCommit(b, false)
+}
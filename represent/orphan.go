@@ -0,0 +1,139 @@
+package represent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// OrphanPolicy governs when edge specs that have gone unresolved for too long
+// are dropped from a graph's orphan set. Limits that are zero are disabled.
+type OrphanPolicy struct {
+	// MaxMessages is the number of messages that may be merged after the one
+	// a spec originated in before the spec is dropped.
+	MaxMessages uint64
+	// MaxAge is the amount of time that may pass between the receipt of the
+	// message a spec originated in, and the receipt of the message currently
+	// being merged, before the spec is dropped. It is only applied when the
+	// times of both messages are known; see system.CoreGraph.MergeAt.
+	MaxAge time.Duration
+}
+
+// OrphanExpiry is the policy applied by all graphs on every merge. The zero
+// value, the default, holds orphans forever.
+//
+// Because the policy determines the contents of the graph, it should be set
+// once at startup and not changed thereafter; graphs built (or replayed)
+// under differing policies will differ.
+var OrphanExpiry OrphanPolicy
+
+// expired reports whether an orphan that originated in the given message has
+// outlived the policy, as of the given message.
+func (p OrphanPolicy) expired(from uint64, fromTime time.Time, to uint64, toTime time.Time) bool {
+	if p.MaxMessages != 0 && to-from > p.MaxMessages {
+		return true
+	}
+	if p.MaxAge != 0 && !fromTime.IsZero() && !toTime.IsZero() && toTime.Sub(fromTime) > p.MaxAge {
+		return true
+	}
+	return false
+}
+
+// expireOrphans returns the subset of the provided orphans that have not
+// expired under OrphanExpiry as of the graph's current message, logging any
+// that are dropped.
+func (g *coreGraph) expireOrphans(ess edgeSpecSet, logEntry *log.Entry) edgeSpecSet {
+	policy := OrphanExpiry
+	if policy == (OrphanPolicy{}) {
+		return ess
+	}
+
+	var keep edgeSpecSet
+	for _, info := range ess {
+		if !policy.expired(info.msgid, info.time, g.msgid, g.msgtime) {
+			keep = append(keep, info)
+			continue
+		}
+
+		for _, spec := range info.e {
+			logEntry.WithFields(log.Fields{
+				"vid":          info.vt.ID,
+				"vtype":        info.vt.Vertex.Typ(),
+				"spec-type":    fmt.Sprintf("%T", spec),
+				"origin-msgid": info.msgid,
+			}).Info("Dropping expired orphan edge spec")
+		}
+	}
+
+	return keep
+}
+
+// Orphan describes an edge spec held in a graph because it has not yet been
+// successfully resolved.
+type Orphan struct {
+	// Source is the id of the vertex the edge would originate from.
+	Source uint64 `json:"source"`
+	// VType is the type of the source vertex.
+	VType system.VType `json:"vtype"`
+	// SpecType is the Go type of the EdgeSpec.
+	SpecType string `json:"spec-type"`
+	// MsgID is the id of the message the spec originated in.
+	MsgID uint64 `json:"msgid"`
+	// Age is the number of messages merged since the originating message.
+	Age uint64 `json:"age"`
+	// Time is the time the originating message was received, if known.
+	Time *time.Time `json:"time,omitempty"`
+	// Elapsed is the time between receipt of the originating message and
+	// the graph's latest message, in seconds, if both are known.
+	Elapsed *float64 `json:"elapsed,omitempty"`
+}
+
+// Orphans lists all the edge specs currently held in the provided graph for
+// later resolution, ordered by source vertex and then originating message.
+func Orphans(cg system.CoreGraph) []Orphan {
+	g, ok := cg.(*coreGraph)
+	if !ok {
+		return nil
+	}
+
+	var ret []Orphan
+	for _, info := range g.orphans {
+		for _, spec := range info.e {
+			o := Orphan{
+				Source:   info.vt.ID,
+				VType:    info.vt.Vertex.Typ(),
+				SpecType: fmt.Sprintf("%T", spec),
+				MsgID:    info.msgid,
+				Age:      g.msgid - info.msgid,
+			}
+
+			if !info.time.IsZero() {
+				t := info.time
+				o.Time = &t
+				if !g.msgtime.IsZero() {
+					el := g.msgtime.Sub(t).Seconds()
+					o.Elapsed = &el
+				}
+			}
+
+			ret = append(ret, o)
+		}
+	}
+
+	sort.Stable(orphansBySource(ret))
+	return ret
+}
+
+type orphansBySource []Orphan
+
+func (o orphansBySource) Len() int      { return len(o) }
+func (o orphansBySource) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o orphansBySource) Less(i, j int) bool {
+	if o[i].Source == o[j].Source {
+		return o[i].MsgID < o[j].MsgID
+	}
+	return o[i].Source < o[j].Source
+}
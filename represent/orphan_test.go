@@ -0,0 +1,90 @@
+package represent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestOrphans(t *testing.T) {
+	var calls int
+	t0 := time.Unix(1440000000, 0)
+
+	g := NewGraph().MergeAt(1, t0, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "x", calls: &calls}),
+	})
+	g = g.MergeAt(2, t0.Add(time.Minute), []system.UnifyInstructionForm{node("y")})
+	g = g.Merge(3, []system.UnifyInstructionForm{node("z")})
+
+	orphans := Orphans(g)
+	if len(orphans) != 1 {
+		t.Fatalf("Expected one orphan, got %v", len(orphans))
+	}
+
+	o := orphans[0]
+	if o.VType != "node" || o.SpecType != "represent.linkSpec" {
+		t.Errorf("Orphan should describe its source vertex and spec type, got %+v", o)
+	}
+	if o.MsgID != 1 || o.Age != 2 {
+		t.Errorf("Expected orphan from msgid 1 with age 2, got msgid %v and age %v", o.MsgID, o.Age)
+	}
+	if o.Time == nil || !o.Time.Equal(t0) {
+		t.Errorf("Expected orphan to carry its originating message's time, got %v", o.Time)
+	}
+	// Merge without a time should not have advanced the graph's clock
+	if o.Elapsed == nil || *o.Elapsed != 60 {
+		t.Errorf("Expected orphan to have been held for 60s, got %v", o.Elapsed)
+	}
+}
+
+func TestOrphanExpiry(t *testing.T) {
+	defer func(p OrphanPolicy) { OrphanExpiry = p }(OrphanExpiry)
+
+	var calls int
+	t0 := time.Unix(1440000000, 0)
+	orphaned := func() system.CoreGraph {
+		return NewGraph().MergeAt(1, t0, []system.UnifyInstructionForm{
+			node("a", linkSpec{to: "x", calls: &calls}),
+		})
+	}
+
+	OrphanExpiry = OrphanPolicy{MaxMessages: 2}
+	g := orphaned()
+	g = g.MergeAt(2, t0, []system.UnifyInstructionForm{node("y")})
+	g = g.MergeAt(3, t0, []system.UnifyInstructionForm{node("y")})
+	if len(Orphans(g)) != 1 {
+		t.Error("Orphan should be held while within the message limit")
+	}
+	g = g.MergeAt(4, t0, []system.UnifyInstructionForm{node("y")})
+	if len(Orphans(g)) != 0 {
+		t.Error("Orphan should be dropped once past the message limit")
+	}
+
+	// Once expired, the spec is gone for good, even if its target appears
+	g = g.MergeAt(5, t0, []system.UnifyInstructionForm{node("x")})
+	if linksFrom(g, "a") != 0 {
+		t.Error("Expired orphan should not resolve later")
+	}
+
+	OrphanExpiry = OrphanPolicy{MaxAge: time.Hour}
+	g = orphaned()
+	g = g.MergeAt(2, t0.Add(time.Hour), []system.UnifyInstructionForm{node("y")})
+	if len(Orphans(g)) != 1 {
+		t.Error("Orphan should be held while within the age limit")
+	}
+	g2 := g.MergeAt(3, t0.Add(time.Hour+time.Second), []system.UnifyInstructionForm{node("y")})
+	if len(Orphans(g2)) != 0 {
+		t.Error("Orphan should be dropped once past the age limit")
+	}
+	if len(Orphans(g)) != 1 {
+		t.Error("Expiry should not affect orphans in earlier versions of the graph")
+	}
+
+	// Without times, age limits cannot be evaluated
+	g = NewGraph().Merge(1, []system.UnifyInstructionForm{node("a", linkSpec{to: "x", calls: &calls})})
+	g = g.MergeAt(2, t0.Add(1000*time.Hour), []system.UnifyInstructionForm{node("y")})
+	if len(Orphans(g)) != 1 {
+		t.Error("Orphan with unknown origin time should not be dropped by age")
+	}
+}
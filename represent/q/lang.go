@@ -0,0 +1,534 @@
+package q
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// MaxDepth is the largest depth a single query step may traverse.
+const MaxDepth = 16
+
+// Step directions in the query language.
+const (
+	DirOut          = "out"          // out-edges; terminal
+	DirIn           = "in"           // in-edges; terminal
+	DirSuccessors   = "successors"   // vertices at the far end of out-edges
+	DirPredecessors = "predecessors" // vertices at the near end of in-edges
+)
+
+// Query is a declarative, JSON-serializable graph traversal. It starts from a
+// set of vertices, then walks through a chain of steps, each of which moves
+// the working set along edges that match the step's filters. For example:
+//
+//	{
+//	  "start": {"vtype": "environment", "props": {"hostname": "prod-web01"}},
+//	  "steps": [
+//	    {"dir": "predecessors", "edge": {"etype": "envlink"}, "vertex": {"vtype": "logic-state"}},
+//	    {"dir": "successors", "vertex": {"vtype": "commit"}, "depth": 3}
+//	  ],
+//	  "project": {"props": ["sha1"]}
+//	}
+//
+// The "out" and "in" directions yield edges rather than vertices, and so may
+// only be used as the final step.
+type Query struct {
+	Start   VertexMatch `json:"start"`
+	Steps   []Step      `json:"steps"`
+	Project Projection  `json:"project"`
+	// Maximum number of results to return; zero means no limit.
+	Limit int `json:"limit"`
+}
+
+// VertexMatch selects vertices by type and properties, as with Qbv. In a
+// query's start set, explicit vertex IDs may be given instead.
+type VertexMatch struct {
+	IDs   []uint64               `json:"ids,omitempty"`
+	VType system.VType           `json:"vtype"`
+	Props map[string]interface{} `json:"props"`
+}
+
+// EdgeMatch selects edges by type and properties, as with Qbe.
+type EdgeMatch struct {
+	EType system.EType           `json:"etype"`
+	Props map[string]interface{} `json:"props"`
+}
+
+// Step is a single hop (or, with depth, several hops) in a query.
+type Step struct {
+	Dir    string      `json:"dir"`
+	Edge   EdgeMatch   `json:"edge"`
+	Vertex VertexMatch `json:"vertex"`
+	// For successors and predecessors, the maximum number of hops to take;
+	// vertices matching the vertex filter at any depth are included. Defaults
+	// to 1. Intermediate vertices need only match the edge filter.
+	Depth int `json:"depth"`
+}
+
+// Projection controls the shape of vertices in query results.
+type Projection struct {
+	// If non-empty, only these properties are included.
+	Props []string `json:"props"`
+	// Whether to include each vertex's in- and out-edges.
+	Edges bool `json:"edges"`
+}
+
+// Result is the output of running a query. Exactly one of Vertices or Edges
+// is populated, depending on the final step.
+type Result struct {
+	MsgID    uint64         `json:"id"`
+	Vertices []ResultVertex `json:"vertices,omitempty"`
+	Edges    []ResultEdge   `json:"edges,omitempty"`
+}
+
+// ResultVertex is a vertex in a query result, shaped by the query's projection.
+type ResultVertex struct {
+	ID       uint64                     `json:"id"`
+	VType    system.VType               `json:"type"`
+	Props    map[string]system.Property `json:"properties"`
+	InEdges  []ResultEdge               `json:"inEdges,omitempty"`
+	OutEdges []ResultEdge               `json:"outEdges,omitempty"`
+}
+
+// ResultEdge is an edge in a query result.
+type ResultEdge struct {
+	ID     uint64                     `json:"id"`
+	Source uint64                     `json:"source"`
+	Target uint64                     `json:"target"`
+	EType  system.EType               `json:"etype"`
+	Props  map[string]system.Property `json:"properties"`
+}
+
+// ParseQuery decodes a JSON query and checks it for validity.
+func ParseQuery(r io.Reader) (*Query, error) {
+	var qry Query
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&qry); err != nil {
+		return nil, fmt.Errorf("malformed query: %v", err)
+	}
+
+	if err := qry.Validate(); err != nil {
+		return nil, err
+	}
+	return &qry, nil
+}
+
+// Validate checks that the query is well-formed, normalizing property values
+// decoded from JSON as it goes.
+func (qry *Query) Validate() error {
+	if len(qry.Start.IDs) > 0 && (qry.Start.VType != system.VTypeNone || len(qry.Start.Props) > 0) {
+		return errors.New("start may specify either ids or a vtype/props filter, not both")
+	}
+	if err := qry.Start.Validate(); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+
+	for k := range qry.Steps {
+		s := &qry.Steps[k]
+		switch s.Dir {
+		case DirOut, DirIn:
+			if k != len(qry.Steps)-1 {
+				return fmt.Errorf("step %d: %q steps yield edges, and must be the final step", k, s.Dir)
+			}
+			if s.Depth > 1 {
+				return fmt.Errorf("step %d: depth is not supported on %q steps", k, s.Dir)
+			}
+		case DirSuccessors, DirPredecessors:
+		default:
+			return fmt.Errorf("step %d: unknown direction %q", k, s.Dir)
+		}
+
+		if len(s.Vertex.IDs) > 0 {
+			return fmt.Errorf("step %d: ids may only be used in the start set", k)
+		}
+		if s.Depth < 0 || s.Depth > MaxDepth {
+			return fmt.Errorf("step %d: depth must be between 0 and %d", k, MaxDepth)
+		}
+		if s.Depth == 0 {
+			s.Depth = 1
+		}
+
+		if err := s.Vertex.Validate(); err != nil {
+			return fmt.Errorf("step %d vertex: %v", k, err)
+		}
+		if err := s.Edge.Validate(); err != nil {
+			return fmt.Errorf("step %d edge: %v", k, err)
+		}
+	}
+
+	if qry.Limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+
+	return nil
+}
+
+// Validate checks that all property values in the match are usable, and
+// normalizes those decoded from JSON; see normalizeProps.
+func (vm VertexMatch) Validate() error {
+	return normalizeProps(vm.Props)
+}
+
+// Validate checks that all property values in the match are usable, and
+// normalizes those decoded from JSON; see normalizeProps.
+func (em EdgeMatch) Validate() error {
+	return normalizeProps(em.Props)
+}
+
+// normalizeProps checks that property values are usable, converting them
+// from their JSON-decoded form as needed. Plain values must be scalars; JSON
+// numbers with no fractional part are converted into ints, as that is the far
+// more common type for numeric vertex properties. Strings that could be the
+// hexadecimal form of a sha1 are converted into Eq predicates, so that they
+// match sha1 properties, which are not stored as strings.
+//
+// A value may also be an object with a single operator key, which is converted
+// into the corresponding predicate:
+//
+//	{"$eq": <scalar>}            equal (same as a plain value; Eq for sha1s)
+//	{"$neq": <scalar>}           not equal, or does not exist (Neq)
+//	{"$exists": <bool>}          exists (Exists) or does not (NotExists)
+//	{"$prefix": <string>}        string prefix (Prefix)
+//	{"$regex": <string>}         regular expression (Regex)
+//	{"$range": [<min>, <max>]}   inclusive numeric range; null is unbounded (Range)
+//	{"$in": [<scalar>...]}       any of the values (In)
+//	{"$changedSince": <msgid>}   last set after msgid (ChangedSince)
+//	{"$unchangedSince": <msgid>} last set at or before msgid (UnchangedSince)
+func normalizeProps(props map[string]interface{}) error {
+	for k, v := range props {
+		var err error
+		if _, ok := v.(system.PropPredicate); ok {
+			// already converted
+			continue
+		} else if obj, ok := v.(map[string]interface{}); ok {
+			props[k], err = predicateFromJSON(obj)
+		} else {
+			props[k], err = eqFromJSON(v)
+		}
+
+		if err != nil {
+			return fmt.Errorf("property %q: %v", k, err)
+		}
+	}
+	return nil
+}
+
+func scalarFromJSON(v interface{}) (interface{}, error) {
+	switch tv := v.(type) {
+	case string, bool, int:
+		return v, nil
+	case float64:
+		if tv == float64(int(tv)) {
+			return int(tv), nil
+		}
+		return v, nil
+	default:
+		return nil, errors.New("value must be a string, number, boolean or operator object")
+	}
+}
+
+// eqFromJSON converts a scalar for use in an equality match.
+func eqFromJSON(v interface{}) (interface{}, error) {
+	v, err := scalarFromJSON(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := v.(string); ok && len(s) == 40 {
+		if _, err := hex.DecodeString(s); err == nil {
+			return Eq(s), nil
+		}
+	}
+	return v, nil
+}
+
+func predicateFromJSON(obj map[string]interface{}) (interface{}, error) {
+	if len(obj) != 1 {
+		return nil, errors.New("operator object must have exactly one key")
+	}
+
+	for op, arg := range obj {
+		switch op {
+		case "$eq":
+			return eqFromJSON(arg)
+		case "$neq":
+			v, err := scalarFromJSON(arg)
+			if err != nil {
+				return nil, err
+			}
+			return Neq(v), nil
+		case "$exists":
+			b, ok := arg.(bool)
+			if !ok {
+				return nil, errors.New("$exists requires a boolean")
+			}
+			if b {
+				return Exists(), nil
+			}
+			return NotExists(), nil
+		case "$prefix":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, errors.New("$prefix requires a string")
+			}
+			return Prefix(s), nil
+		case "$regex":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, errors.New("$regex requires a string")
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			return Regex(re), nil
+		case "$range":
+			bounds, ok := arg.([]interface{})
+			if !ok || len(bounds) != 2 {
+				return nil, errors.New("$range requires a two-element array")
+			}
+			min, max := math.Inf(-1), math.Inf(1)
+			if bounds[0] != nil {
+				if min, ok = bounds[0].(float64); !ok {
+					return nil, errors.New("$range bounds must be numbers or null")
+				}
+			}
+			if bounds[1] != nil {
+				if max, ok = bounds[1].(float64); !ok {
+					return nil, errors.New("$range bounds must be numbers or null")
+				}
+			}
+			return Range(min, max), nil
+		case "$in":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return nil, errors.New("$in requires an array")
+			}
+			vals := make([]interface{}, len(list))
+			for k, v := range list {
+				var err error
+				if vals[k], err = scalarFromJSON(v); err != nil {
+					return nil, err
+				}
+			}
+			return In(vals...), nil
+		case "$changedSince", "$unchangedSince":
+			f, ok := arg.(float64)
+			if !ok || f < 0 || f != float64(uint64(f)) {
+				return nil, fmt.Errorf("%s requires a msgid", op)
+			}
+			if op == "$changedSince" {
+				return ChangedSince(uint64(f)), nil
+			}
+			return UnchangedSince(uint64(f)), nil
+		default:
+			return nil, fmt.Errorf("unknown operator %q", op)
+		}
+	}
+
+	panic("unreachable")
+}
+
+// Filter converts the match into a VFilter suitable for use with CoreGraph
+// methods. IDs are not considered.
+func (vm VertexMatch) Filter() vertexFilter {
+	return Qbv(append([]interface{}{vm.VType}, propArgs(vm.Props)...)...)
+}
+
+// Filter converts the match into an EFilter suitable for use with CoreGraph
+// methods.
+func (em EdgeMatch) Filter() edgeFilter {
+	return Qbe(append([]interface{}{em.EType}, propArgs(em.Props)...)...)
+}
+
+func propArgs(props map[string]interface{}) (args []interface{}) {
+	// Sort keys so filters are constructed deterministically
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		args = append(args, k, props[k])
+	}
+	return
+}
+
+// Run executes the query against the provided graph.
+func (qry *Query) Run(g system.CoreGraph) Result {
+	res := Result{MsgID: g.MsgID()}
+
+	var set []uint64
+	if len(qry.Start.IDs) > 0 {
+		for _, id := range qry.Start.IDs {
+			if _, err := g.Get(id); err == nil {
+				set = append(set, id)
+			}
+		}
+	} else {
+		for _, vt := range g.VerticesWith(qry.Start.Filter()) {
+			set = append(set, vt.ID)
+		}
+	}
+	set = dedupe(set)
+
+	for _, s := range qry.Steps {
+		switch s.Dir {
+		case DirOut, DirIn:
+			ef := s.Edge.Filter()
+			seen := make(map[uint64]struct{})
+			for _, id := range set {
+				var ev system.EdgeVector
+				if s.Dir == DirOut {
+					ev = g.OutWith(id, ef)
+				} else {
+					ev = g.InWith(id, ef)
+				}
+
+				for _, e := range ev {
+					if _, exists := seen[e.ID]; !exists {
+						seen[e.ID] = struct{}{}
+						res.Edges = append(res.Edges, resultEdge(e))
+					}
+				}
+			}
+
+			sort.Sort(resultEdgesByID(res.Edges))
+			if qry.Limit > 0 && len(res.Edges) > qry.Limit {
+				res.Edges = res.Edges[:qry.Limit]
+			}
+			return res
+		default:
+			set = walk(g, set, s)
+		}
+	}
+
+	if qry.Limit > 0 && len(set) > qry.Limit {
+		set = set[:qry.Limit]
+	}
+
+	res.Vertices = make([]ResultVertex, 0, len(set))
+	for _, id := range set {
+		vt, _ := g.Get(id)
+		res.Vertices = append(res.Vertices, qry.Project.apply(vt))
+	}
+	return res
+}
+
+// walk performs a successors or predecessors step, breadth-first out to the
+// step's depth, and returns the sorted IDs of all vertices that matched.
+func walk(g system.CoreGraph, from []uint64, s Step) []uint64 {
+	ef := s.Edge.Filter()
+	both := ef.And(s.Vertex.Filter())
+	adj := g.SuccessorsWith
+	if s.Dir == DirPredecessors {
+		adj = g.PredecessorsWith
+	}
+
+	var matched []uint64
+	visited := make(map[uint64]struct{})
+	frontier := from
+	for depth := 0; depth < s.Depth && len(frontier) > 0; depth++ {
+		var next []uint64
+		for _, id := range frontier {
+			for _, vt := range adj(id, both) {
+				matched = append(matched, vt.ID)
+			}
+
+			if depth+1 == s.Depth {
+				continue
+			}
+			for _, vt := range adj(id, ef) {
+				if _, seen := visited[vt.ID]; !seen {
+					visited[vt.ID] = struct{}{}
+					next = append(next, vt.ID)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return dedupe(matched)
+}
+
+func (p Projection) apply(vt system.VertexTuple) ResultVertex {
+	rv := ResultVertex{
+		ID:    vt.ID,
+		VType: vt.Vertex.Type,
+		Props: make(map[string]system.Property),
+	}
+
+	if len(p.Props) == 0 {
+		vt.Vertex.Properties.ForEach(func(k string, val ps.Any) {
+			rv.Props[k] = val.(system.Property)
+		})
+	} else {
+		for _, k := range p.Props {
+			if val, exists := vt.Vertex.Properties.Lookup(k); exists {
+				rv.Props[k] = val.(system.Property)
+			}
+		}
+	}
+
+	if p.Edges {
+		vt.InEdges.ForEach(func(_ string, val ps.Any) {
+			rv.InEdges = append(rv.InEdges, resultEdge(val.(system.StdEdge)))
+		})
+		vt.OutEdges.ForEach(func(_ string, val ps.Any) {
+			rv.OutEdges = append(rv.OutEdges, resultEdge(val.(system.StdEdge)))
+		})
+		sort.Sort(resultEdgesByID(rv.InEdges))
+		sort.Sort(resultEdgesByID(rv.OutEdges))
+	}
+
+	return rv
+}
+
+func resultEdge(e system.StdEdge) ResultEdge {
+	re := ResultEdge{
+		ID:     e.ID,
+		Source: e.Source,
+		Target: e.Target,
+		EType:  e.EType,
+		Props:  make(map[string]system.Property),
+	}
+
+	e.Props.ForEach(func(k string, val ps.Any) {
+		re.Props[k] = val.(system.Property)
+	})
+	return re
+}
+
+// dedupe sorts and removes duplicates from a slice of IDs.
+func dedupe(ids []uint64) []uint64 {
+	sort.Sort(idSlice(ids))
+
+	ret := ids[:0]
+	for _, id := range ids {
+		if len(ret) == 0 || id != ret[len(ret)-1] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+type idSlice []uint64
+
+func (s idSlice) Len() int           { return len(s) }
+func (s idSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s idSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type resultEdgesByID []ResultEdge
+
+func (s resultEdgesByID) Len() int           { return len(s) }
+func (s resultEdgesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s resultEdgesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
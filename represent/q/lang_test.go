@@ -0,0 +1,191 @@
+package q_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+var einGraph system.CoreGraph
+
+func init() {
+	logrus.SetLevel(logrus.WarnLevel)
+}
+
+// Builds (once) the graph from all the ein fixtures.
+func getEinGraph(t *testing.T) system.CoreGraph {
+	if einGraph != nil {
+		return einGraph
+	}
+
+	j := mem.NewMemStore()
+	for i := range make([]struct{}, 8) {
+		path := fmt.Sprintf("../../fixtures/ein/%v.json", i+1)
+		f, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("json fnf: " + path)
+		}
+		j.NewEntry(f, "127.0.0.1", "")
+	}
+
+	g, err := ingest.Replay(represent.NewGraph(), j.Get, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	einGraph = g
+	return g
+}
+
+func runQuery(t *testing.T, src string) q.Result {
+	qry, err := q.ParseQuery(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Failed to parse query %s: %v", src, err)
+	}
+	return qry.Run(getEinGraph(t))
+}
+
+func TestQueryPredecessors(t *testing.T) {
+	res := runQuery(t, `{
+		"start": {"vtype": "environment", "props": {"hostname": "prod-web01"}},
+		"steps": [{"dir": "predecessors", "edge": {"etype": "envlink"}, "vertex": {"vtype": "logic-state"}}],
+		"project": {"props": ["path"]}
+	}`)
+
+	if res.MsgID != 8 {
+		t.Errorf("Result should carry graph msgid 8, got %v", res.MsgID)
+	}
+	if len(res.Vertices) != 3 {
+		t.Fatalf("Expected three logic states on prod-web01, got %v", len(res.Vertices))
+	}
+
+	paths := make(map[string]bool)
+	for _, v := range res.Vertices {
+		if v.VType != "logic-state" {
+			t.Errorf("Expected only logic-state vertices, got %v", v.VType)
+		}
+		if len(v.Props) != 1 {
+			t.Errorf("Projection should have limited props to path only, got %v", v.Props)
+		}
+		paths[v.Props["path"].Value.(string)] = true
+	}
+
+	for _, p := range []string{"/var/www/app", "/usr/sbin/httpd", "/etc/httpd/modules/libphp.so"} {
+		if !paths[p] {
+			t.Errorf("Expected logic state with path %v in results", p)
+		}
+	}
+}
+
+func TestQueryDepth(t *testing.T) {
+	src := `{
+		"start": {"vtype": "commit", "props": {"subject": "Phony commit to simulate fork at tip"}},
+		"steps": [{"dir": "successors", "edge": {"etype": "parent-commit"}, "depth": %d}]
+	}`
+
+	one := runQuery(t, fmt.Sprintf(src, 1))
+	if len(one.Vertices) != 1 {
+		t.Errorf("Expected one direct parent commit, got %v", len(one.Vertices))
+	}
+
+	deep := runQuery(t, fmt.Sprintf(src, q.MaxDepth))
+	if len(deep.Vertices) <= len(one.Vertices) {
+		t.Errorf("Deeper traversal should reach more ancestor commits; got %v at depth 1 and %v at depth %v", len(one.Vertices), len(deep.Vertices), q.MaxDepth)
+	}
+
+	limited := runQuery(t, `{"start": {"vtype": "commit"}, "limit": 3}`)
+	if len(limited.Vertices) != 3 {
+		t.Errorf("Limit should cap results at 3, got %v", len(limited.Vertices))
+	}
+}
+
+func TestQueryEdges(t *testing.T) {
+	// pid arrives from JSON as a float64, and must be normalized to match the int prop
+	res := runQuery(t, `{
+		"start": {"vtype": "process", "props": {"pid": 6212}},
+		"steps": [{"dir": "out", "edge": {"etype": "logic-link"}}]
+	}`)
+
+	if len(res.Vertices) != 0 {
+		t.Error("Query ending in an out step should not return vertices")
+	}
+	if len(res.Edges) != 2 {
+		t.Fatalf("Expected process 6212 to have two logic-link out-edges, got %v", len(res.Edges))
+	}
+	for _, e := range res.Edges {
+		if e.EType != "logic-link" {
+			t.Errorf("Expected only logic-link edges, got %v", e.EType)
+		}
+	}
+
+	// Start by ids, include edges in the projection
+	res = runQuery(t, fmt.Sprintf(`{"start": {"ids": [%d, 999999]}, "project": {"edges": true}}`, res.Edges[0].Source))
+	if len(res.Vertices) != 1 || len(res.Vertices[0].OutEdges) == 0 {
+		t.Errorf("Expected single process vertex with its out-edges, got %+v", res.Vertices)
+	}
+}
+
+func TestQueryValidation(t *testing.T) {
+	bad := map[string]string{
+		"malformed":        `{"start":`,
+		"unknown dir":      `{"steps": [{"dir": "sideways"}]}`,
+		"nonterminal out":  `{"steps": [{"dir": "out"}, {"dir": "successors"}]}`,
+		"depth too deep":   fmt.Sprintf(`{"steps": [{"dir": "successors", "depth": %d}]}`, q.MaxDepth+1),
+		"ids and filter":   `{"start": {"ids": [1], "vtype": "commit"}}`,
+		"ids in step":      `{"steps": [{"dir": "successors", "vertex": {"ids": [1]}}]}`,
+		"nonscalar prop":   `{"start": {"props": {"foo": [1, 2]}}}`,
+		"negative limit":   `{"limit": -1}`,
+		"depth on in step": `{"steps": [{"dir": "in", "depth": 2}]}`,
+	}
+
+	for name, src := range bad {
+		if _, err := q.ParseQuery(strings.NewReader(src)); err == nil {
+			t.Errorf("Expected error for invalid query (%s): %s", name, src)
+		}
+	}
+}
+
+func TestQueryPredicates(t *testing.T) {
+	res := runQuery(t, `{
+		"start": {"vtype": "commit", "props": {"sha1": {"$prefix": "58c5329"}}},
+		"steps": [{"dir": "successors", "edge": {"etype": "parent-commit"}}]
+	}`)
+	if len(res.Vertices) != 1 {
+		t.Errorf("Expected sha1 prefix to select a single commit with a single parent, got %v results", len(res.Vertices))
+	}
+
+	// Sha1s are stored as byte arrays, but match their hex string form
+	for _, sha1 := range []string{`"58c5329896cc2a623f1dd881d83969f90637bc9a"`, `{"$eq": "58C5329896CC2A623F1DD881D83969F90637BC9A"}`, `{"$in": ["58c5329896cc2a623f1dd881d83969f90637bc9a"]}`} {
+		res = runQuery(t, `{"start": {"vtype": "commit", "props": {"sha1": `+sha1+`}}}`)
+		if len(res.Vertices) != 1 {
+			t.Errorf("Expected sha1 %s to select a single commit, got %v results", sha1, len(res.Vertices))
+		}
+	}
+	res = runQuery(t, `{"start": {"vtype": "logic-state"}, "steps": [{"dir": "successors", "edge": {"etype": "version", "props": {"sha1": "58c5329896cc2a623f1dd881d83969f90637bc9a"}}}]}`)
+	if len(res.Vertices) != 1 {
+		t.Errorf("Expected version edges filtered by sha1 to lead to a single commit, got %v results", len(res.Vertices))
+	}
+	for _, v := range res.Vertices {
+		if v.VType != "commit" {
+			t.Errorf("Expected version edges filtered by sha1 to lead to commits, got %v", v.VType)
+		}
+	}
+
+	res = runQuery(t, `{"start": {"vtype": "environment", "props": {"hostname": {"$changedSince": 3}}}}`)
+	if len(res.Vertices) != 2 {
+		t.Errorf("Expected two environments created after msgid 3, got %v", len(res.Vertices))
+	}
+
+	res = runQuery(t, `{"start": {"vtype": "environment", "props": {"hostname": {"$regex": "^prod-"}, "provider": {"$neq": "vagrant"}}}}`)
+	if len(res.Vertices) != 2 {
+		t.Errorf("Expected two prod environments, got %v", len(res.Vertices))
+	}
+}
@@ -0,0 +1,180 @@
+package q
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Predicate constructors, for use as property values in Qbv/Qbe. For example,
+// all commits whose sha1 starts with "abc123" and that changed after msgid 40:
+//
+//  q.Qbv(system.VType("commit"), "sha1", q.Prefix("abc123"), "sha1", q.ChangedSince(40))
+
+type predFunc func(p system.Property, exists bool) bool
+
+func (f predFunc) MatchProp(p system.Property, exists bool) bool {
+	return f(p, exists)
+}
+
+// Eq matches properties whose value is equal to v. This is the same as using
+// v as a plain value, except that a hexadecimal string also matches a sha1,
+// which is stored as a 20-byte array; see valuesEqual.
+func Eq(v interface{}) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		return exists && valuesEqual(p.Value, v)
+	})
+}
+
+// Neq matches properties that do not exist, or whose value is not equal to v.
+func Neq(v interface{}) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		return !exists || !valuesEqual(p.Value, v)
+	})
+}
+
+// Exists matches properties that exist, regardless of value.
+func Exists() system.PropPredicate {
+	return predFunc(func(_ system.Property, exists bool) bool {
+		return exists
+	})
+}
+
+// NotExists matches properties that do not exist.
+func NotExists() system.PropPredicate {
+	return predFunc(func(_ system.Property, exists bool) bool {
+		return !exists
+	})
+}
+
+// Prefix matches properties whose value, as a string, starts with the given
+// prefix. Values that are strings, byte slices, or fmt.Stringers (e.g. sha1s)
+// can match.
+func Prefix(prefix string) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		s, ok := stringOf(p.Value)
+		return exists && ok && strings.HasPrefix(s, prefix)
+	})
+}
+
+// Regex matches properties whose value, as a string, matches the given
+// regular expression. The same values as Prefix can match.
+func Regex(re *regexp.Regexp) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		s, ok := stringOf(p.Value)
+		return exists && ok && re.MatchString(s)
+	})
+}
+
+// Range matches properties with a numeric value in the inclusive range
+// [min, max]. Use math.Inf for an open-ended range.
+func Range(min, max float64) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		f, ok := floatOf(p.Value)
+		return exists && ok && f >= min && f <= max
+	})
+}
+
+// In matches properties whose value is equal to any of the provided values.
+func In(vals ...interface{}) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		if !exists {
+			return false
+		}
+
+		for _, v := range vals {
+			if valuesEqual(p.Value, v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ChangedSince matches properties that were last set by a message after the
+// given msgid.
+func ChangedSince(msgid uint64) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		return exists && p.MsgSrc > msgid
+	})
+}
+
+// UnchangedSince matches properties that were last set by a message at or
+// before the given msgid.
+func UnchangedSince(msgid uint64) system.PropPredicate {
+	return predFunc(func(p system.Property, exists bool) bool {
+		return exists && p.MsgSrc <= msgid
+	})
+}
+
+// valuesEqual compares a property's value with a value to match, as
+// system.EqualValues does. In addition, a sha1 - any 20-byte array - is equal
+// to its hexadecimal representation, in either case, as values decoded from
+// JSON queries can only be strings.
+func valuesEqual(pv, v interface{}) bool {
+	if system.EqualValues(pv, v) {
+		return true
+	}
+
+	s, ok := v.(string)
+	if !ok || len(s) != 40 {
+		return false
+	}
+
+	rv := reflect.ValueOf(pv)
+	if rv.Kind() != reflect.Array || rv.Len() != 20 || rv.Type().Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+
+	b := make([]byte, 20)
+	for i := range b {
+		b[i] = byte(rv.Index(i).Uint())
+	}
+	return strings.EqualFold(hex.EncodeToString(b), s)
+}
+
+func stringOf(v interface{}) (string, bool) {
+	switch tv := v.(type) {
+	case string:
+		return tv, true
+	case []byte:
+		return string(tv), true
+	case fmt.Stringer:
+		return tv.String(), true
+	}
+	return "", false
+}
+
+func floatOf(v interface{}) (float64, bool) {
+	switch tv := v.(type) {
+	case int:
+		return float64(tv), true
+	case int8:
+		return float64(tv), true
+	case int16:
+		return float64(tv), true
+	case int32:
+		return float64(tv), true
+	case int64:
+		return float64(tv), true
+	case uint:
+		return float64(tv), true
+	case uint8:
+		return float64(tv), true
+	case uint16:
+		return float64(tv), true
+	case uint32:
+		return float64(tv), true
+	case uint64:
+		return float64(tv), true
+	case float32:
+		return float64(tv), true
+	case float64:
+		return tv, true
+	}
+	return 0, false
+}
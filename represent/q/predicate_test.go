@@ -0,0 +1,128 @@
+package q
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+type sha1 [20]byte
+
+const sha1Hex = "58c5329896cc2a623f1dd881d83969f90637bc9a"
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestPredicates(t *testing.T) {
+	props := ps.NewMap().
+		Set("str", system.Property{MsgSrc: 2, Value: "foobar"}).
+		Set("num", system.Property{MsgSrc: 5, Value: 42}).
+		Set("bytes", system.Property{MsgSrc: 3, Value: []byte("bazqux")}).
+		Set("sha", system.Property{MsgSrc: 7, Value: stringer("abc123")}).
+		Set("list", system.Property{MsgSrc: 1, Value: []string{"a"}}).
+		Set("sha1", system.Property{MsgSrc: 4, Value: sha1{0x58, 0xc5, 0x32, 0x98, 0x96, 0xcc, 0x2a, 0x62, 0x3f, 0x1d, 0xd8, 0x81, 0xd8, 0x39, 0x69, 0xf9, 0x06, 0x37, 0xbc, 0x9a}}).
+		Set("hexstr", system.Property{MsgSrc: 4, Value: sha1Hex})
+
+	match := func(pairs ...interface{}) bool {
+		return system.MatchProps(props, Qbv(append([]interface{}{system.VTypeNone}, pairs...)...).VProps())
+	}
+
+	assert.True(t, match("str", "foobar"), "plain values still match by equality")
+	assert.True(t, match("bytes", []byte("bazqux")), "byte slices still match by content")
+	assert.False(t, match("list", []string{"a"}), "uncomparable values do not match, and do not panic")
+
+	assert.True(t, match("sha1", Eq(sha1Hex)), "eq matches sha1 by hex string")
+	assert.True(t, match("sha1", Eq(strings.ToUpper(sha1Hex))), "eq matches sha1 by upper-case hex string")
+	assert.False(t, match("sha1", Eq(sha1Hex[1:]+"0")), "eq does not match sha1 by different hex string")
+	assert.False(t, match("sha1", sha1Hex), "plain hex string does not match sha1")
+	assert.True(t, match("hexstr", Eq(sha1Hex)), "eq still matches hex strings as strings")
+	assert.False(t, match("sha1", Neq(sha1Hex)), "neq does not match sha1 by hex string")
+	assert.True(t, match("sha1", In("x", sha1Hex)), "in matches sha1 by hex string")
+
+	assert.True(t, match("str", Neq("foo")), "neq matches differing value")
+	assert.False(t, match("str", Neq("foobar")), "neq does not match equal value")
+	assert.True(t, match("missing", Neq("foobar")), "neq matches nonexistent prop")
+
+	assert.True(t, match("num", Exists()), "exists matches existing prop")
+	assert.False(t, match("missing", Exists()), "exists does not match nonexistent prop")
+	assert.True(t, match("missing", NotExists()), "notexists matches nonexistent prop")
+	assert.False(t, match("num", NotExists()), "notexists does not match existing prop")
+
+	assert.True(t, match("str", Prefix("foo")), "prefix matches string")
+	assert.True(t, match("bytes", Prefix("baz")), "prefix matches byte slice")
+	assert.True(t, match("sha", Prefix("abc")), "prefix matches stringer")
+	assert.False(t, match("num", Prefix("4")), "prefix does not match numbers")
+
+	assert.True(t, match("str", Regex(regexp.MustCompile("o+b"))), "regex matches")
+	assert.False(t, match("str", Regex(regexp.MustCompile("^bar"))), "regex does not match")
+
+	assert.True(t, match("num", Range(40, 42)), "range is inclusive")
+	assert.True(t, match("num", Range(math.Inf(-1), 100)), "range may be open-ended")
+	assert.False(t, match("num", Range(43, 50)), "range excludes values outside it")
+	assert.False(t, match("str", Range(math.Inf(-1), math.Inf(1))), "range does not match non-numbers")
+
+	assert.True(t, match("num", In(1, 42, "x")), "in matches any listed value")
+	assert.False(t, match("num", In(1, 2)), "in does not match unlisted value")
+
+	assert.True(t, match("num", ChangedSince(4)), "changedsince matches later msgsrc")
+	assert.False(t, match("num", ChangedSince(5)), "changedsince does not match same msgsrc")
+	assert.True(t, match("num", UnchangedSince(5)), "unchangedsince matches same msgsrc")
+	assert.False(t, match("missing", UnchangedSince(5)), "unchangedsince does not match nonexistent prop")
+
+	assert.True(t, match("str", Prefix("foo"), "num", Range(0, 100), "missing", NotExists()), "all predicates must match")
+	assert.False(t, match("str", Prefix("foo"), "num", Range(0, 1)), "one failing predicate fails the whole filter")
+}
+
+func TestPredicatesFromJSON(t *testing.T) {
+	good := map[string]interface{}{
+		"a": map[string]interface{}{"$eq": 4.0},
+		"b": map[string]interface{}{"$neq": "x"},
+		"c": map[string]interface{}{"$exists": false},
+		"d": map[string]interface{}{"$prefix": "x"},
+		"e": map[string]interface{}{"$regex": "^x+$"},
+		"f": map[string]interface{}{"$range": []interface{}{nil, 3.5}},
+		"g": map[string]interface{}{"$in": []interface{}{1.0, "y"}},
+		"h": map[string]interface{}{"$changedSince": 12.0},
+	}
+
+	assert.Nil(t, normalizeProps(good), "all operators should be accepted")
+	assert.Equal(t, 4, good["a"], "$eq yields a plain normalized value")
+	for k, v := range good {
+		if k == "a" {
+			continue
+		}
+		_, ok := v.(system.PropPredicate)
+		assert.True(t, ok, "operator for %s should yield a predicate", k)
+	}
+	assert.Nil(t, normalizeProps(good), "normalizing twice should be harmless")
+
+	shas := map[string]interface{}{
+		"a": sha1Hex,
+		"b": map[string]interface{}{"$eq": sha1Hex},
+		"c": sha1Hex[:39],
+	}
+	assert.Nil(t, normalizeProps(shas), "sha1 strings should be accepted")
+	for _, k := range []string{"a", "b"} {
+		_, ok := shas[k].(system.PropPredicate)
+		assert.True(t, ok, "sha1 string %s should yield a predicate", k)
+	}
+	assert.Equal(t, sha1Hex[:39], shas["c"], "other strings remain plain values")
+
+	bad := []map[string]interface{}{
+		{"a": map[string]interface{}{"$bogus": 1.0}},
+		{"a": map[string]interface{}{"$eq": 1.0, "$neq": 2.0}},
+		{"a": map[string]interface{}{"$regex": "("}},
+		{"a": map[string]interface{}{"$range": []interface{}{1.0}}},
+		{"a": map[string]interface{}{"$changedSince": -1.0}},
+		{"a": map[string]interface{}{"$in": []interface{}{[]interface{}{}}}},
+	}
+	for _, props := range bad {
+		assert.NotNil(t, normalizeProps(props), "invalid operator object should be rejected: %v", props)
+	}
+}
@@ -0,0 +1,80 @@
+package represent
+
+import (
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// removeTombstone removes the vertex identified by the tombstone, if it
+// exists, along with all its edges. The removed tuple is returned, along with
+// the ids of the vertices on the other end of the removed edges.
+func (g *coreGraph) removeTombstone(mergeLog *log.Entry, ts system.Tombstone) (system.VertexTuple, []uint64, bool) {
+	logEntry := mergeLog.WithField("vtype", ts.Vertex().Type())
+
+	vid := ts.Unify(g, ts.UnifyInstructionForm)
+	if vid == 0 {
+		logEntry.Debug("No vertex matched tombstone; nothing to remove")
+		return system.VertexTuple{}, nil, false
+	}
+
+	vt, neighbors := g.removeVertex(vid)
+	logEntry.WithFields(log.Fields{
+		"vid":       vid,
+		"neighbors": len(neighbors),
+	}).Debug("Removed vertex and its edges")
+
+	return vt, neighbors, true
+}
+
+// removeVertex removes the vertex with the given id from the graph, along with
+// all of its in- and out-edges. The removed tuple is returned, along with the
+// ids of the other vertices that lost edges as a result.
+//
+// The vertex must exist.
+func (g *coreGraph) removeVertex(vid uint64) (system.VertexTuple, []uint64) {
+	vt, _ := g.Get(vid)
+	seen := map[uint64]struct{}{vid: {}}
+	var neighbors []uint64
+
+	// Remove the edge from the map on the other vertex, unless that other
+	// vertex is the one being removed
+	detach := func(other uint64, eid string, in bool) {
+		if _, exists := seen[other]; !exists {
+			seen[other] = struct{}{}
+			neighbors = append(neighbors, other)
+		}
+
+		if other == vid {
+			return
+		}
+
+		any, exists := g.vtuples.Lookup(i2a(other))
+		if !exists {
+			return
+		}
+
+		ovt := any.(system.VertexTuple)
+		if in {
+			ovt.InEdges = ovt.InEdges.Delete(eid)
+		} else {
+			ovt.OutEdges = ovt.OutEdges.Delete(eid)
+		}
+		g.vtuples = g.vtuples.Set(i2a(other), ovt)
+	}
+
+	vt.OutEdges.ForEach(func(k string, val ps.Any) {
+		detach(val.(system.StdEdge).Target, k, true)
+	})
+	vt.InEdges.ForEach(func(k string, val ps.Any) {
+		detach(val.(system.StdEdge).Source, k, false)
+	})
+
+	g.vtuples = g.vtuples.Delete(i2a(vid))
+	g.unindexVertex(vt)
+	if g.affirmed != nil {
+		g.affirmed = g.affirmed.Delete(i2a(vid))
+	}
+
+	return vt, neighbors
+}
@@ -0,0 +1,125 @@
+package represent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func messageUIFs(t *testing.T, src string) []system.UnifyInstructionForm {
+	var m ingest.Message
+	if err := json.Unmarshal([]byte(src), &m); err != nil {
+		t.Fatalf("Failed to unmarshal message: %v", err)
+	}
+	return m.UnificationForm()
+}
+
+func TestTombstoneProcess(t *testing.T) {
+	g := mergeEinFixtures()
+	procs := g.VerticesWith(q.Qbv(system.VType("process"), "pid", 6212))
+	if len(procs) != 1 {
+		t.Fatalf("Expected fixture graph to contain process 6212")
+	}
+	proc := procs[0]
+
+	g2 := g.Merge(9, messageUIFs(t, `{"tombstones": {"processes": [
+		{"pid": 6212, "environment": {"address": {"hostname": "prod-web01"}}}
+	]}}`))
+
+	if _, err := g2.Get(proc.ID); err == nil {
+		t.Fatal("Process vertex should have been removed")
+	}
+	if len(g2.VerticesWith(q.Qbv(system.VType("process"), "pid", 6212))) != 0 {
+		t.Error("Removed process should no longer be found via the index")
+	}
+
+	// Every edge the process had should be gone from the other end, too
+	check := func(e system.StdEdge, other uint64) {
+		ovt, err := g2.Get(other)
+		if err != nil {
+			t.Errorf("Neighbor vertex %d should not have been removed", other)
+			return
+		}
+		if _, exists := ovt.InEdges.Lookup(i2a(e.ID)); exists {
+			t.Errorf("Edge %d should have been removed from in-edges of vertex %d", e.ID, other)
+		}
+		if _, exists := ovt.OutEdges.Lookup(i2a(e.ID)); exists {
+			t.Errorf("Edge %d should have been removed from out-edges of vertex %d", e.ID, other)
+		}
+	}
+	for _, e := range g.OutWith(proc.ID, q.Qbe()) {
+		check(e, e.Target)
+	}
+	for _, e := range g.InWith(proc.ID, q.Qbe()) {
+		check(e, e.Source)
+	}
+
+	// The process in the other env should be unaffected, as should the original graph
+	if len(g2.VerticesWith(q.Qbv(system.VType("process")))) != len(g.VerticesWith(q.Qbv(system.VType("process"))))-1 {
+		t.Error("Only the one process should have been removed")
+	}
+	if _, err := g.Get(proc.ID); err != nil {
+		t.Error("Removal should not affect the original graph")
+	}
+}
+
+func TestTombstoneEnvironment(t *testing.T) {
+	g := mergeEinFixtures()
+	env := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "prod-web01"))[0]
+	scoped := g.PredecessorsWith(env.ID, q.Qbe(system.EType("envlink")))
+	if len(scoped) == 0 {
+		t.Fatal("Expected fixture environment to contain things")
+	}
+
+	g2 := g.Merge(9, messageUIFs(t, `{"tombstones": {"environments": [{"address": {"hostname": "prod-web01"}}]}}`))
+	if _, err := g2.Get(env.ID); err == nil {
+		t.Fatal("Environment vertex should have been removed")
+	}
+
+	// Things that were in the environment remain, but lose their envlinks
+	for _, vt := range scoped {
+		vt2, err := g2.Get(vt.ID)
+		if err != nil {
+			t.Errorf("Vertex %d within the environment should not have been removed", vt.ID)
+			continue
+		}
+		for _, e := range g2.OutWith(vt2.ID, q.Qbe(system.EType("envlink"))) {
+			if e.Target == env.ID {
+				t.Errorf("Vertex %d should no longer have an envlink to the removed environment", vt.ID)
+			}
+		}
+	}
+}
+
+func TestTombstoneNoMatch(t *testing.T) {
+	g := mergeEinFixtures()
+	g2 := g.Merge(9, messageUIFs(t, `{"tombstones": {"commits": [{"sha1": "0000000000000000000000000000000000000001"}]}}`))
+
+	if len(g2.VerticesWith(q.Qbv())) != len(g.VerticesWith(q.Qbv())) {
+		t.Error("Tombstone matching nothing should not remove anything")
+	}
+}
+
+func TestTombstoneAndReplace(t *testing.T) {
+	g := NewGraph().Merge(1, messageUIFs(t, `{"environments": [{"address": {"hostname": "replaced"}, "os": "old"}]}`))
+	old := g.VerticesWith(q.Qbv(system.VType("environment")))[0]
+
+	g = g.Merge(2, messageUIFs(t, `{
+		"environments": [{"address": {"hostname": "replaced"}, "provider": "new"}],
+		"tombstones": {"environments": [{"address": {"hostname": "replaced"}}]}
+	}`))
+
+	envs := g.VerticesWith(q.Qbv(system.VType("environment")))
+	if len(envs) != 1 {
+		t.Fatalf("Expected exactly one environment after replacement, got %v", len(envs))
+	}
+	if envs[0].ID == old.ID {
+		t.Error("Replacement environment should be a new vertex")
+	}
+	if _, exists := envs[0].Vertex.Props().Lookup("os"); exists {
+		t.Error("Replacement environment should not carry over properties from the removed one")
+	}
+}
@@ -0,0 +1,236 @@
+package represent
+
+import (
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// pendingEdge is a single EdgeSpec that has yet to be resolved.
+type pendingEdge struct {
+	info *veProcessingInfo
+	spec system.EdgeSpec
+	// filters from system.DependentEdgeSpec; nil if the spec declares none
+	awaits  []system.VFilter
+	waiting bool
+}
+
+// resolver drives edge resolution for a single merge. Specs are attempted in
+// the order they are queued. Those that fail to resolve wait until a vertex
+// they depend on is touched - created, updated, removed, or given or stripped
+// of an edge - and are only then queued again. Once the queue drains, any
+// specs that are still waiting become orphans.
+//
+// Because every wakeup is caused by a successful resolution (or by the vertex
+// ensuring that precedes resolution), and every success permanently removes a
+// spec, resolution always terminates.
+type resolver struct {
+	g        *coreGraph
+	msgid    uint64
+	logEntry *log.Entry
+
+	all   []*pendingEdge
+	ready []*pendingEdge
+
+	// waiting specs, indexed by the things that can wake them
+	bySrc  map[uint64][]*pendingEdge
+	byType map[system.VType][]*pendingEdge
+	any    []*pendingEdge
+
+	attempts int
+}
+
+func newResolver(g *coreGraph, msgid uint64, logEntry *log.Entry) *resolver {
+	return &resolver{
+		g:        g,
+		msgid:    msgid,
+		logEntry: logEntry,
+		bySrc:    make(map[uint64][]*pendingEdge),
+		byType:   make(map[system.VType][]*pendingEdge),
+	}
+}
+
+// add registers all the specs in the processing info with the resolver. If
+// ready is true they are queued for an immediate attempt; otherwise, they
+// wait to be woken by a touch.
+func (r *resolver) add(info *veProcessingInfo, ready bool) {
+	for _, spec := range info.e {
+		p := &pendingEdge{info: info, spec: spec}
+		if ds, ok := spec.(system.DependentEdgeSpec); ok {
+			p.awaits = ds.Awaits(info.vt)
+		}
+
+		r.all = append(r.all, p)
+		if ready {
+			r.ready = append(r.ready, p)
+		} else {
+			r.wait(p)
+		}
+	}
+}
+
+func (r *resolver) wait(p *pendingEdge) {
+	p.waiting = true
+	r.bySrc[p.info.vt.ID] = append(r.bySrc[p.info.vt.ID], p)
+
+	if p.awaits == nil {
+		r.any = append(r.any, p)
+		return
+	}
+
+	for _, vf := range p.awaits {
+		if vt := vf.VType(); vt == system.VTypeNone {
+			r.any = append(r.any, p)
+		} else {
+			r.byType[vt] = append(r.byType[vt], p)
+		}
+	}
+}
+
+func (r *resolver) wake(p *pendingEdge) {
+	if p.waiting {
+		p.waiting = false
+		r.ready = append(r.ready, p)
+	}
+}
+
+// touch wakes all waiting specs that could be affected by a change to the
+// given vertex.
+func (r *resolver) touch(vid uint64) {
+	vt, err := r.g.Get(vid)
+	if err != nil {
+		return
+	}
+	r.wakeFor(vt)
+}
+
+// removed wakes all waiting specs that could be affected by the removal of
+// the given vertex. (Specs that had it as their source will be discarded.)
+func (r *resolver) removed(vt system.VertexTuple) {
+	r.wakeFor(vt)
+}
+
+func (r *resolver) wakeFor(vt system.VertexTuple) {
+	for _, p := range r.bySrc[vt.ID] {
+		r.wake(p)
+	}
+	delete(r.bySrc, vt.ID)
+
+	for _, p := range r.any {
+		r.wake(p)
+	}
+	r.any = nil
+
+	vtype := vt.Vertex.Typ()
+	var keep []*pendingEdge
+	for _, p := range r.byType[vtype] {
+		if !p.waiting {
+			continue
+		}
+
+		if awaitsVertex(p.awaits, vt) {
+			r.wake(p)
+		} else {
+			keep = append(keep, p)
+		}
+	}
+	r.byType[vtype] = keep
+}
+
+func awaitsVertex(awaits []system.VFilter, vt system.VertexTuple) bool {
+	for _, vf := range awaits {
+		if vf.VType() != vt.Vertex.Typ() {
+			continue
+		}
+		if system.MatchProps(vt.Vertex.Props(), vf.VProps()) {
+			return true
+		}
+	}
+	return false
+}
+
+// run attempts queued specs until none remain.
+func (r *resolver) run() {
+	g := r.g
+	for len(r.ready) > 0 {
+		p := r.ready[0]
+		r.ready = r.ready[1:]
+
+		// Ensure our local copy of the tuple is up to date
+		vt, err := g.Get(p.info.vt.ID)
+		if err != nil {
+			r.logEntry.WithField("vid", p.info.vt.ID).Info("Source vertex for edge spec went away, discarding it")
+			continue
+		}
+		p.info.vt = vt
+
+		l := r.logEntry.WithFields(log.Fields{
+			"vid":   vt.ID,
+			"vtype": vt.Vertex.Typ(),
+		})
+		l.Debugf("Resolving EdgeSpec of type %T", p.spec)
+
+		r.attempts++
+		edge, success := p.spec.Resolve(g, r.msgid, vt)
+		if !success {
+			l.Debug("Unsuccessful edge resolution; will reattempt if a dependency changes")
+			r.wait(p)
+			continue
+		}
+
+		l2 := l.WithFields(log.Fields{
+			"target-vid": edge.Target,
+			"etype":      edge.EType,
+		})
+		l2.Debug("Edge resolved successfully")
+
+		edge.Source = vt.ID
+		if edge.ID == 0 {
+			// new edge, allocate a new id for it
+			g.vserial++
+			edge.ID = g.vserial
+			l2.WithField("edge-id", edge.ID).Debug("New edge created")
+		} else {
+			l2.WithField("edge-id", edge.ID).Debug("Edge will merge over existing edge")
+		}
+
+		vt.OutEdges = vt.OutEdges.Set(i2a(edge.ID), edge)
+		g.vtuples = g.vtuples.Set(i2a(vt.ID), vt)
+
+		any, _ := g.vtuples.Lookup(i2a(edge.Target))
+		tvt := any.(system.VertexTuple)
+
+		tvt.InEdges = tvt.InEdges.Set(i2a(edge.ID), edge)
+		g.vtuples = g.vtuples.Set(i2a(tvt.ID), tvt)
+
+		r.touch(vt.ID)
+		r.touch(tvt.ID)
+	}
+}
+
+// orphans returns the specs that are still waiting, grouped back into
+// processing infos for their source vertices. New infos are created, rather
+// than modifying those the resolver was given, so that the orphan set of the
+// graph being merged into is left untouched.
+func (r *resolver) orphans() (ess edgeSpecSet) {
+	byInfo := make(map[*veProcessingInfo]*veProcessingInfo)
+	for _, p := range r.all {
+		if !p.waiting {
+			continue
+		}
+
+		orphan, exists := byInfo[p.info]
+		if !exists {
+			orphan = &veProcessingInfo{
+				vt:    p.info.vt,
+				uif:   p.info.uif,
+				msgid: p.info.msgid,
+				time:  p.info.time,
+			}
+			byInfo[p.info] = orphan
+			ess = append(ess, orphan)
+		}
+		orphan.e = append(orphan.e, p.spec)
+	}
+
+	return ess
+}
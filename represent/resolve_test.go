@@ -0,0 +1,208 @@
+package represent
+
+import (
+	"testing"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// A minimal vertex model for exercising edge resolution: "node" vertices,
+// identified by name, linked by specs that can be made to depend on their
+// target's state.
+
+type testUIF struct {
+	props system.RawProps
+	specs []system.EdgeSpec
+}
+
+func (u testUIF) Vertex() system.ProtoVertex { return u }
+func (u testUIF) Type() system.VType         { return "node" }
+func (u testUIF) Properties() system.RawProps {
+	return u.props
+}
+func (u testUIF) EdgeSpecs() []system.EdgeSpec    { return u.specs }
+func (u testUIF) ScopingSpecs() []system.EdgeSpec { return nil }
+func (u testUIF) Unify(g system.CoreGraph, u2 system.UnifyInstructionForm) uint64 {
+	if vtv := g.VerticesWith(q.Qbv(system.VType("node"), "name", u.props["name"])); len(vtv) > 0 {
+		return vtv[0].ID
+	}
+	return 0
+}
+
+func node(name string, specs ...system.EdgeSpec) system.UnifyInstructionForm {
+	return testUIF{props: system.RawProps{"name": name}, specs: specs}
+}
+
+// linkSpec links to the node with the given name. If linked is set, the
+// target must itself already have an out-edge; if ready is set, the target
+// must have its "ready" prop set to true.
+type linkSpec struct {
+	to            string
+	linked, ready bool
+	calls         *int
+}
+
+func (spec linkSpec) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (e system.StdEdge, success bool) {
+	*spec.calls++
+	e = system.StdEdge{Source: src.ID, EType: "link", Props: ps.NewMap()}
+	e.Props = e.Props.Set("to", system.Property{MsgSrc: mid, Value: spec.to})
+
+	if re := g.OutWith(src.ID, q.Qbe(system.EType("link"), "to", spec.to)); len(re) == 1 {
+		return re[0], true
+	}
+
+	rv := g.VerticesWith(q.Qbv(system.VType("node"), "name", spec.to))
+	if len(rv) != 1 {
+		return
+	}
+	if spec.linked && rv[0].OutEdges.Size() == 0 {
+		return
+	}
+	if spec.ready && !system.MatchProps(rv[0].Vertex.Props(), []system.PropPair{{K: "ready", V: true}}) {
+		return
+	}
+
+	e.Target = rv[0].ID
+	return e, true
+}
+
+func (spec linkSpec) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("node"), "name", spec.to)}
+}
+
+// undeclaredSpec is a linkSpec that does not declare its dependencies.
+type undeclaredSpec struct {
+	ls linkSpec
+}
+
+func (spec undeclaredSpec) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (system.StdEdge, bool) {
+	return spec.ls.Resolve(g, mid, src)
+}
+
+func linksFrom(g system.CoreGraph, name string) int {
+	rv := g.VerticesWith(q.Qbv(system.VType("node"), "name", name))
+	if len(rv) != 1 {
+		return -1
+	}
+	return len(g.OutWith(rv[0].ID, q.Qbe(system.EType("link"))))
+}
+
+func TestResolveDependencyChain(t *testing.T) {
+	var ca, cb, cc int
+	// Each spec depends on the one after it having resolved first, so the
+	// order in which they're first attempted is the worst possible one.
+	g := NewGraph().Merge(1, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "b", linked: true, calls: &ca}),
+		node("b", linkSpec{to: "c", linked: true, calls: &cb}),
+		node("c", linkSpec{to: "d", calls: &cc}),
+		node("d"),
+	}).(*coreGraph)
+
+	for _, n := range []string{"a", "b", "c"} {
+		if linksFrom(g, n) != 1 {
+			t.Errorf("Expected node %s to have resolved its link", n)
+		}
+	}
+	if len(g.orphans) != 0 {
+		t.Errorf("Expected no orphans, got %v", len(g.orphans))
+	}
+
+	// Each spec should have been retried only once its dependency resolved,
+	// not once per pass over all specs.
+	if ca != 2 || cb != 2 || cc != 1 {
+		t.Errorf("Expected 2, 2 and 1 resolution attempts, got %v, %v and %v", ca, cb, cc)
+	}
+}
+
+func TestResolveOrphanOnDependency(t *testing.T) {
+	var calls int
+	g := NewGraph().Merge(1, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "x", calls: &calls}),
+	}).(*coreGraph)
+
+	if len(g.orphans) != 1 || calls != 1 {
+		t.Fatalf("Expected unresolvable spec to be orphaned after a single attempt")
+	}
+
+	// Unrelated vertices should not cause the orphan to be reattempted
+	g = g.Merge(2, []system.UnifyInstructionForm{node("y"), node("z")}).(*coreGraph)
+	if calls != 1 {
+		t.Errorf("Orphan should not be reattempted when unrelated vertices change; %v attempts", calls)
+	}
+
+	g = g.Merge(3, []system.UnifyInstructionForm{node("x")}).(*coreGraph)
+	if calls != 2 {
+		t.Errorf("Orphan should have been reattempted exactly once its dependency appeared; %v attempts", calls)
+	}
+	if linksFrom(g, "a") != 1 || len(g.orphans) != 0 {
+		t.Error("Orphan should have resolved once its dependency appeared")
+	}
+}
+
+func TestResolveOrphanOnUpdatedDependency(t *testing.T) {
+	var calls int
+	g := NewGraph().Merge(1, []system.UnifyInstructionForm{
+		node("x"),
+		node("a", linkSpec{to: "x", ready: true, calls: &calls}),
+	}).(*coreGraph)
+
+	if len(g.orphans) != 1 {
+		t.Fatal("Expected spec to be orphaned while its target is not ready")
+	}
+
+	// The awaited vertex already exists; only a change to it should matter
+	g = g.Merge(2, []system.UnifyInstructionForm{
+		testUIF{props: system.RawProps{"name": "x", "ready": true}},
+	}).(*coreGraph)
+
+	if linksFrom(g, "a") != 1 || len(g.orphans) != 0 {
+		t.Error("Orphan should have resolved once its existing dependency was updated")
+	}
+}
+
+func TestResolveOrphanNeverResolved(t *testing.T) {
+	var calls, ucalls int
+	g := NewGraph().Merge(1, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "x", calls: &calls}, undeclaredSpec{linkSpec{to: "x", calls: &ucalls}}),
+	}).(*coreGraph)
+
+	for i := uint64(2); i < 7; i++ {
+		g = g.Merge(i, []system.UnifyInstructionForm{node("y")}).(*coreGraph)
+	}
+
+	if len(g.orphans) != 1 || len(g.orphans[0].e) != 2 {
+		t.Fatalf("Expected both specs to still be held as orphans")
+	}
+	if g.orphans[0].msgid != 1 {
+		t.Errorf("Orphans should retain the msgid of their originating message, got %v", g.orphans[0].msgid)
+	}
+	if calls != 1 {
+		t.Errorf("Orphan with declared dependencies should never have been reattempted; %v attempts", calls)
+	}
+	// Specs with no declared dependencies fall back to being retried whenever
+	// anything changes.
+	if ucalls != 6 {
+		t.Errorf("Orphan with undeclared dependencies should be reattempted on every merge; %v attempts", ucalls)
+	}
+}
+
+func TestResolveLeavesOriginalOrphans(t *testing.T) {
+	var calls int
+	g1 := NewGraph().Merge(1, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "x", calls: &calls}),
+	}).(*coreGraph)
+
+	g2 := g1.Merge(2, []system.UnifyInstructionForm{node("x")})
+	if linksFrom(g2, "a") != 1 {
+		t.Fatal("Orphan should have resolved in the new graph")
+	}
+
+	if len(g1.orphans) != 1 || len(g1.orphans[0].e) != 1 {
+		t.Fatal("Merging should not alter the orphans of the graph merged into")
+	}
+	if linksFrom(g1.Merge(2, []system.UnifyInstructionForm{node("x")}), "a") != 1 {
+		t.Error("Repeating a merge onto the original graph should produce the same result")
+	}
+}
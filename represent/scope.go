@@ -0,0 +1,72 @@
+package represent
+
+import (
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// removeOutOfScope removes all vertices within the authoritative scope that
+// are not in the described set, including those nested beneath others. The removed tuples are returned, along with
+// the ids of the vertices on the other end of their removed edges.
+func (g *coreGraph) removeOutOfScope(mergeLog *log.Entry, as system.AuthoritativeScope, described map[uint64]struct{}) (removed []system.VertexTuple, neighbors []uint64) {
+	logEntry := mergeLog.WithField("vtype", as.Vertex().Type())
+
+	sid := as.Unify(g, as.UnifyInstructionForm)
+	if sid == 0 {
+		logEntry.Debug("No vertex matched authoritative scope; nothing to remove")
+		return
+	}
+
+	scope, _ := g.Get(sid)
+	vtypes := make(map[system.VType]struct{}, len(as.VTypes))
+	for _, vtype := range as.VTypes {
+		vtypes[vtype] = struct{}{}
+	}
+
+	// Collect first; removal alters the scope's in-edges. Walk down through
+	// nested vertices, such as child datasets, so they go with their parents.
+	var out []uint64
+	frontier, etype := []system.VertexTuple{scope}, as.EType
+	for len(frontier) > 0 && etype != "" {
+		var next []system.VertexTuple
+		for _, parent := range frontier {
+			parent.InEdges.ForEach(func(_ string, val ps.Any) {
+				e := val.(system.StdEdge)
+				if e.EType != etype {
+					return
+				}
+				vt, err := g.Get(e.Source)
+				if err != nil {
+					return
+				}
+				if _, ok := vtypes[vt.Vertex.Typ()]; !ok {
+					return
+				}
+				next = append(next, vt)
+				if _, ok := described[e.Source]; !ok {
+					out = append(out, e.Source)
+				}
+			})
+		}
+		frontier, etype = next, as.Nested
+	}
+
+	for _, vid := range out {
+		// Vertices with multiple edges to the scope will appear repeatedly
+		if _, err := g.Get(vid); err != nil {
+			continue
+		}
+
+		vt, n := g.removeVertex(vid)
+		removed = append(removed, vt)
+		neighbors = append(neighbors, n...)
+	}
+
+	logEntry.WithFields(log.Fields{
+		"scope-vid": sid,
+		"removed":   len(removed),
+	}).Info("Removed vertices omitted from authoritative scope")
+
+	return
+}
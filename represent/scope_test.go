@@ -0,0 +1,138 @@
+package represent
+
+import (
+	"testing"
+
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestAuthoritativeScope(t *testing.T) {
+	g := mergeEinFixtures()
+	pid := func(g system.CoreGraph, pid int) system.VertexTupleVector {
+		return g.VerticesWith(q.Qbv(system.VType("process"), "pid", pid))
+	}
+	if len(pid(g, 34764)) != 1 || len(pid(g, 7567)) != 1 {
+		t.Fatal("Expected fixture graph to contain both stage processes")
+	}
+	mysqld := pid(g, 7567)[0]
+	procs := len(g.VerticesWith(q.Qbv(system.VType("process"))))
+	lstates := len(g.VerticesWith(q.Qbv(system.VType("logic-state"))))
+
+	g2 := g.Merge(9, messageUIFs(t, `{
+		"processes": [{
+			"pid": 34764,
+			"logic-states": ["/var/www/app", "/usr/sbin/httpd"],
+			"environment": {"address": {"hostname": "stage"}},
+			"listen": [{"type": "port", "proto": ["tcp"], "port": 80}]
+		}],
+		"authoritative": [{"environment": {"address": {"hostname": "stage"}}, "kinds": ["processes"]}]
+	}`))
+
+	if len(pid(g2, 34764)) != 1 {
+		t.Error("Process reported by the authoritative message should remain")
+	}
+	if _, err := g2.Get(mysqld.ID); err == nil {
+		t.Error("Process omitted from the authoritative message should be removed")
+	}
+	if n := len(g2.VerticesWith(q.Qbv(system.VType("process")))); n != procs-1 {
+		t.Errorf("Only the omitted process should be removed; expected %v processes, got %v", procs-1, n)
+	}
+	if n := len(g2.VerticesWith(q.Qbv(system.VType("logic-state")))); n != lstates {
+		t.Errorf("Kinds outside the scope should be unaffected; expected %v logic states, got %v", lstates, n)
+	}
+
+	stage := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "stage"))[0]
+	listeners := func(g system.CoreGraph, port int) (n int) {
+		for _, vt := range g.VerticesWith(q.Qbv(system.VType("comm"), "port", port)) {
+			for _, e := range g.OutWith(vt.ID, q.Qbe(system.EType("envlink"))) {
+				if e.Target == stage.ID {
+					n++
+				}
+			}
+		}
+		return
+	}
+	if listeners(g, 3306) == 0 {
+		t.Fatal("Expected fixture graph to contain mysql listener in stage")
+	}
+	if listeners(g2, 3306) != 0 {
+		t.Error("Listeners of omitted processes should be removed along with them")
+	}
+	if listeners(g2, 80) == 0 {
+		t.Error("Listeners of reported processes should remain")
+	}
+	if _, err := g.Get(mysqld.ID); err != nil {
+		t.Error("Removal should not affect the original graph")
+	}
+}
+
+func TestAuthoritativeScopeEmpty(t *testing.T) {
+	g := mergeEinFixtures()
+	env := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", "qa"))[0]
+
+	g2 := g.Merge(9, messageUIFs(t, `{
+		"authoritative": [{"environment": {"address": {"hostname": "qa"}}, "kinds": ["processes", "logic-states"]}]
+	}`))
+
+	for _, e := range g2.InWith(env.ID, q.Qbe(system.EType("envlink"))) {
+		vt, _ := g2.Get(e.Source)
+		switch vt.Vertex.Typ() {
+		case "process", "comm", "logic-state":
+			t.Errorf("Authoritative message reporting nothing should empty the scope, but found %v %d", vt.Vertex.Typ(), vt.ID)
+		}
+	}
+	if _, err := g2.Get(env.ID); err != nil {
+		t.Error("The environment defining the scope should not be removed")
+	}
+
+	// Scopes that identify no existing environment remove nothing
+	g3 := g.Merge(9, messageUIFs(t, `{
+		"authoritative": [{"environment": {"address": {"hostname": "nonexistent"}}, "kinds": ["processes"]}]
+	}`))
+	if len(g3.VerticesWith(q.Qbv())) != len(g.VerticesWith(q.Qbv())) {
+		t.Error("Scope matching no environment should not remove anything")
+	}
+}
+
+func TestAuthoritativeScopeNestedDatasets(t *testing.T) {
+	g := mergeEinFixtures()
+	// children counts the child datasets beneath each parent in the environment
+	children := func(g system.CoreGraph, hostname string) (n int) {
+		env := g.VerticesWith(q.Qbv(system.VType("environment"), "hostname", hostname))[0]
+		for _, e := range g.InWith(env.ID, q.Qbe(system.EType("envlink"))) {
+			if vt, err := g.Get(e.Source); err == nil && vt.Vertex.Typ() == "parent-dataset" {
+				n += len(g.InWith(vt.ID, q.Qbe(system.EType("dataset-hierarchy"))))
+			}
+		}
+		return
+	}
+	if children(g, "stage") == 0 || children(g, "prod-db01") == 0 {
+		t.Fatal("Expected fixture graph to contain child datasets in stage and prod-db01")
+	}
+	prod := children(g, "prod-db01")
+
+	g2 := g.Merge(9, messageUIFs(t, `{
+		"datasets": [{
+			"name": "/var/lib/mysql",
+			"environment": {"address": {"hostname": "stage"}},
+			"path": "/var/lib/mysql"
+		}],
+		"authoritative": [{"environment": {"address": {"hostname": "stage"}}, "kinds": ["datasets"]}]
+	}`))
+
+	if len(g2.VerticesWith(q.Qbv(system.VType("parent-dataset"), "name", "/var/lib/mysql"))) != len(g.VerticesWith(q.Qbv(system.VType("parent-dataset"), "name", "/var/lib/mysql"))) {
+		t.Error("Parent dataset reported by the authoritative message should remain")
+	}
+	if n := children(g2, "stage"); n != 0 {
+		t.Errorf("Child datasets omitted from the authoritative message should be removed, found %v", n)
+	}
+	if n := children(g2, "prod-db01"); n != prod {
+		t.Errorf("Child datasets in other environments should be unaffected; expected %v, got %v", prod, n)
+	}
+	for _, vt := range g2.VerticesWith(q.Qbv(system.VType("dataset"))) {
+		if len(g2.OutWith(vt.ID, q.Qbe(system.EType("dataset-hierarchy")))) == 0 {
+			t.Errorf("Child dataset %d was orphaned from its parent", vt.ID)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package represent
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// The serialized forms of the graph's contents. Persistent maps are flattened
+// into slices that are sorted by key, so that encoding the same graph always
+// produces the same bytes.
+type (
+	snapGraph struct {
+		MsgID, VSerial uint64
+		MsgTime        time.Time
+		Vertices       []snapVertex
+		Orphans        []snapOrphan
+	}
+
+	snapVertex struct {
+		ID       uint64
+		Type     system.VType
+		Props    []snapProp
+		OutEdges []snapEdge
+		Affirmed time.Time
+	}
+
+	snapEdge struct {
+		ID, Source, Target uint64
+		EType              system.EType
+		Props              []snapProp
+	}
+
+	snapProp struct {
+		K      string
+		MsgSrc uint64
+		Value  interface{}
+	}
+
+	// Orphans are stored as the vertex they originate from and their remaining
+	// edge specs. EdgeSpec implementations must be registered with encoding/gob.
+	snapOrphan struct {
+		VID, MsgID uint64
+		Time       time.Time
+		Specs      []system.EdgeSpec
+	}
+)
+
+// WriteSnapshot serializes the complete state of the provided graph - its
+// vertices, edges, serials, and held-over orphan edge specs - to the writer.
+//
+// The graph must have been created by this package. Concrete types used in
+// property values and EdgeSpecs must be registered with encoding/gob.
+func WriteSnapshot(w io.Writer, cg system.CoreGraph) error {
+	g, ok := cg.(*coreGraph)
+	if !ok {
+		return errors.New("snapshots can only be taken of graphs created by the represent package")
+	}
+
+	sg := snapGraph{
+		MsgID:    g.msgid,
+		VSerial:  g.vserial,
+		MsgTime:  g.msgtime,
+		Vertices: make([]snapVertex, 0, g.vtuples.Size()),
+	}
+
+	g.vtuples.ForEach(func(_ string, val ps.Any) {
+		vt := val.(system.VertexTuple)
+		sv := snapVertex{
+			ID:       vt.ID,
+			Type:     vt.Vertex.Type,
+			Props:    flattenProps(vt.Vertex.Properties),
+			Affirmed: g.affirmedAt(vt.ID),
+		}
+
+		vt.OutEdges.ForEach(func(_ string, val ps.Any) {
+			e := val.(system.StdEdge)
+			sv.OutEdges = append(sv.OutEdges, snapEdge{
+				ID:     e.ID,
+				Source: e.Source,
+				Target: e.Target,
+				EType:  e.EType,
+				Props:  flattenProps(e.Props),
+			})
+		})
+		sort.Sort(edgesByID(sv.OutEdges))
+
+		sg.Vertices = append(sg.Vertices, sv)
+	})
+	sort.Sort(verticesByID(sg.Vertices))
+
+	for _, orphan := range g.orphans {
+		// A zero vid means vertex identification itself failed; that requires
+		// the full unify instruction, which cannot be serialized.
+		if orphan.vt.ID == 0 || len(orphan.e) == 0 {
+			continue
+		}
+
+		sg.Orphans = append(sg.Orphans, snapOrphan{
+			VID:   orphan.vt.ID,
+			MsgID: orphan.msgid,
+			Time:  orphan.time,
+			Specs: orphan.e,
+		})
+	}
+
+	return gob.NewEncoder(w).Encode(sg)
+}
+
+// ReadSnapshot reconstructs a graph from data written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (system.CoreGraph, error) {
+	var sg snapGraph
+	if err := gob.NewDecoder(r).Decode(&sg); err != nil {
+		return nil, err
+	}
+
+	g := &coreGraph{
+		msgid:    sg.MsgID,
+		vserial:  sg.VSerial,
+		msgtime:  sg.MsgTime,
+		vtuples:  ps.NewMap(),
+		affirmed: ps.NewMap(),
+	}
+
+	// First pass places all vertices with their out-edges; second pass
+	// mirrors each out-edge onto its target's in-edges.
+	for _, sv := range sg.Vertices {
+		vt := system.VertexTuple{
+			ID:       sv.ID,
+			Vertex:   system.StdVertex{Type: sv.Type, Properties: unflattenProps(sv.Props)},
+			InEdges:  ps.NewMap(),
+			OutEdges: ps.NewMap(),
+		}
+
+		for _, se := range sv.OutEdges {
+			vt.OutEdges = vt.OutEdges.Set(i2a(se.ID), unflattenEdge(se))
+		}
+
+		g.vtuples = g.vtuples.Set(i2a(vt.ID), vt)
+		if !sv.Affirmed.IsZero() {
+			g.affirmed = g.affirmed.Set(i2a(vt.ID), sv.Affirmed)
+		}
+	}
+
+	for _, sv := range sg.Vertices {
+		for _, se := range sv.OutEdges {
+			any, exists := g.vtuples.Lookup(i2a(se.Target))
+			if !exists {
+				return nil, errors.New("snapshot contains an edge pointing to a nonexistent vertex")
+			}
+
+			tvt := any.(system.VertexTuple)
+			tvt.InEdges = tvt.InEdges.Set(i2a(se.ID), unflattenEdge(se))
+			g.vtuples = g.vtuples.Set(i2a(tvt.ID), tvt)
+		}
+	}
+
+	for _, so := range sg.Orphans {
+		vt, err := g.Get(so.VID)
+		if err != nil {
+			return nil, err
+		}
+
+		g.orphans = append(g.orphans, &veProcessingInfo{
+			vt:    vt,
+			e:     so.Specs,
+			msgid: so.MsgID,
+			time:  so.Time,
+		})
+	}
+
+	g.reindex()
+	g.indexExpiry()
+	return g, nil
+}
+
+func flattenProps(m ps.Map) []snapProp {
+	ret := make([]snapProp, 0, m.Size())
+	m.ForEach(func(k string, val ps.Any) {
+		p := val.(system.Property)
+		ret = append(ret, snapProp{K: k, MsgSrc: p.MsgSrc, Value: p.Value})
+	})
+	sort.Sort(propsByKey(ret))
+
+	return ret
+}
+
+func unflattenProps(props []snapProp) ps.Map {
+	m := ps.NewMap()
+	for _, p := range props {
+		m = m.Set(p.K, system.Property{MsgSrc: p.MsgSrc, Value: p.Value})
+	}
+
+	return m
+}
+
+func unflattenEdge(se snapEdge) system.StdEdge {
+	return system.StdEdge{
+		ID:     se.ID,
+		Source: se.Source,
+		Target: se.Target,
+		EType:  se.EType,
+		Props:  unflattenProps(se.Props),
+	}
+}
+
+type verticesByID []snapVertex
+
+func (s verticesByID) Len() int           { return len(s) }
+func (s verticesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s verticesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type edgesByID []snapEdge
+
+func (s edgesByID) Len() int           { return len(s) }
+func (s edgesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s edgesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type propsByKey []snapProp
+
+func (s propsByKey) Len() int           { return len(s) }
+func (s propsByKey) Less(i, j int) bool { return s[i].K < s[j].K }
+func (s propsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
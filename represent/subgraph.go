@@ -0,0 +1,67 @@
+package represent
+
+import (
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Subgraph returns a new graph containing only the vertices in the provided
+// graph with the given IDs, and the edges that run between them. IDs that do
+// not exist in the source graph are ignored.
+//
+// The returned graph has the same msgid as the source graph. It is intended
+// for reading; it carries no orphan edge specs, so merging into it will not
+// produce the same result as merging into the source graph.
+func Subgraph(g system.CoreGraph, vids []uint64) system.CoreGraph {
+	sg := &coreGraph{
+		msgid:   g.MsgID(),
+		vtuples: ps.NewMap(),
+	}
+	cg, _ := g.(*coreGraph)
+	if cg != nil {
+		sg.vserial, sg.msgtime = cg.vserial, cg.msgtime
+		sg.affirmed = ps.NewMap()
+	}
+
+	keep := make(map[uint64]struct{}, len(vids))
+	for _, id := range vids {
+		keep[id] = struct{}{}
+	}
+
+	for id := range keep {
+		vt, err := g.Get(id)
+		if err != nil {
+			continue
+		}
+
+		vt.InEdges = trimEdges(vt.InEdges, keep)
+		vt.OutEdges = trimEdges(vt.OutEdges, keep)
+		sg.vtuples = sg.vtuples.Set(i2a(id), vt)
+		if cg != nil {
+			if at := cg.affirmedAt(id); !at.IsZero() {
+				sg.affirmed = sg.affirmed.Set(i2a(id), at)
+			}
+		}
+	}
+	sg.reindex()
+	if cg != nil {
+		sg.indexExpiry()
+	}
+
+	return sg
+}
+
+// trimEdges removes all edges from the map that do not have both their source
+// and target in the keep set.
+func trimEdges(m ps.Map, keep map[uint64]struct{}) ps.Map {
+	m.ForEach(func(k string, val ps.Any) {
+		e := val.(system.StdEdge)
+		_, sok := keep[e.Source]
+		_, tok := keep[e.Target]
+		if !sok || !tok {
+			m = m.Delete(k)
+		}
+	})
+
+	return m
+}
@@ -0,0 +1,49 @@
+package represent
+
+import (
+	"testing"
+
+	"github.com/pipeviz/pipeviz/represent/q"
+)
+
+func TestSubgraph(t *testing.T) {
+	g := getGraphFixture()
+	g.msgid = 7
+
+	// vids 1 and 3 are connected by edge 11; edge 10 (1->2) and edges 12/13
+	// (3->4) leave the subgraph and must be dropped. 42 doesn't exist.
+	sg := Subgraph(g, []uint64{1, 3, 3, 42})
+
+	if sg.MsgID() != 7 {
+		t.Errorf("Subgraph should retain msgid of source graph; expected 7, got %v", sg.MsgID())
+	}
+
+	vtv := sg.VerticesWith(q.Qbv())
+	if len(vtv) != 2 {
+		t.Fatalf("Expected two vertices in subgraph, got %v", len(vtv))
+	}
+
+	vt1, err := sg.Get(1)
+	if err != nil {
+		t.Fatal("vid 1 should be in the subgraph")
+	}
+	if vt1.OutEdges.Size() != 0 {
+		t.Errorf("Edge to vid 2 should have been removed from vid 1's out-edges")
+	}
+	if vt1.InEdges.Size() != 1 {
+		t.Errorf("Edge from vid 3 should remain in vid 1's in-edges")
+	}
+
+	if es := sg.OutWith(3, q.Qbe()); len(es) != 1 || es[0].ID != 11 {
+		t.Errorf("vid 3 should have only edge 11 as an out-edge, got %v", es)
+	}
+
+	if _, err := sg.Get(2); err == nil {
+		t.Error("vid 2 should not be in the subgraph")
+	}
+
+	// The source graph must be untouched
+	if vt, _ := g.Get(3); vt.OutEdges.Size() != 3 {
+		t.Error("Creating a subgraph modified the source graph")
+	}
+}
@@ -1,8 +1,6 @@
 package represent
 
 import (
-	"bytes"
-
 	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
 	"github.com/pipeviz/pipeviz/types/system"
@@ -41,24 +39,8 @@ func (g *coreGraph) arcWith(egoID uint64, ef system.EFilter, in bool) (es system
 			return
 		}
 
-		for _, p := range props {
-			eprop, exists := edge.Props.Lookup(p.K)
-			if !exists {
-				return
-			}
-
-			deprop := eprop.(system.Property)
-			switch tv := deprop.Value.(type) {
-			default:
-				if tv != p.V {
-					return
-				}
-			case []byte:
-				cmptv, ok := p.V.([]byte)
-				if !ok || !bytes.Equal(tv, cmptv) {
-					return
-				}
-			}
+		if !system.MatchProps(edge.Props, props) {
+			return
 		}
 
 		es = append(es, edge)
@@ -109,24 +91,8 @@ func (g *coreGraph) adjacentWith(egoID uint64, vef system.VEFilter, in bool) (vt
 			return
 		}
 
-		for _, p := range eprops {
-			eprop, exists := edge.Props.Lookup(p.K)
-			if !exists {
-				return
-			}
-
-			deprop := eprop.(system.Property)
-			switch tv := deprop.Value.(type) {
-			default:
-				if tv != p.V {
-					return
-				}
-			case []byte:
-				cmptv, ok := p.V.([]byte)
-				if !ok || !bytes.Equal(tv, cmptv) {
-					return
-				}
-			}
+		if !system.MatchProps(edge.Props, eprops) {
+			return
 		}
 
 		if in {
@@ -147,7 +113,6 @@ func (g *coreGraph) adjacentWith(egoID uint64, vef system.VEFilter, in bool) (vt
 
 	// Keep track of the vertices we've collected, for deduping
 	visited := make(map[uint64]struct{})
-VertexInspector:
 	for vid := range vidchan {
 		if _, seenit := visited[vid]; seenit {
 			// already visited this vertex; go back to waiting on the chan
@@ -170,24 +135,8 @@ VertexInspector:
 			continue
 		}
 
-		for _, p := range vprops {
-			vprop, exists := adjvt.Vertex.Props().Lookup(p.K)
-			if !exists {
-				continue VertexInspector
-			}
-
-			dvprop := vprop.(system.Property)
-			switch tv := dvprop.Value.(type) {
-			default:
-				if tv != p.V {
-					continue VertexInspector
-				}
-			case []byte:
-				cmptv, ok := p.V.([]byte)
-				if !ok || !bytes.Equal(tv, cmptv) {
-					continue VertexInspector
-				}
-			}
+		if !system.MatchProps(adjvt.Vertex.Props(), vprops) {
+			continue
 		}
 
 		vts = append(vts, adjvt)
@@ -201,36 +150,34 @@ VertexInspector:
 // The first parameter, VType, filters on vertex type; passing VTypeNone
 // will bypass the filter.
 //
-// The second parameter allows filtering on a k/v property pair.
+// The second parameter allows filtering on a k/v property pair. As with all
+// filters, a PropPair's value may be a system.PropPredicate.
 func (g *coreGraph) VerticesWith(vf system.VFilter) (vs system.VertexTupleVector) {
 	vtype, props := vf.VType(), vf.VProps()
-	g.vtuples.ForEach(func(_ string, val ps.Any) {
-		vt := val.(system.VertexTuple)
+	filter := func(vt system.VertexTuple) {
 		if vtype != system.VTypeNone && vt.Vertex.Typ() != vtype {
 			return
 		}
 
-		for _, p := range props {
-			vprop, exists := vt.Vertex.Props().Lookup(p.K)
-			if !exists {
-				return
-			}
-
-			dvprop := vprop.(system.Property)
-			switch tv := dvprop.Value.(type) {
-			default:
-				if tv != p.V {
-					return
-				}
-			case []byte:
-				cmptv, ok := p.V.([]byte)
-				if !ok || !bytes.Equal(tv, cmptv) {
-					return
-				}
-			}
+		if !system.MatchProps(vt.Vertex.Props(), props) {
+			return
 		}
 
 		vs = append(vs, vt)
+	}
+
+	// Narrow the search via the indexes, if possible
+	if set, ok := g.candidates(vtype, props); ok {
+		set.ForEach(func(k string, _ ps.Any) {
+			if val, exists := g.vtuples.Lookup(k); exists {
+				filter(val.(system.VertexTuple))
+			}
+		})
+		return vs
+	}
+
+	g.vtuples.ForEach(func(_ string, val ps.Any) {
+		filter(val.(system.VertexTuple))
 	})
 
 	return vs
@@ -0,0 +1,249 @@
+package represent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// TTLPolicy governs how long a vertex may go without being reaffirmed - that
+// is, described by a message - before it is considered stale, and before it
+// is removed from the graph. Durations that are zero are disabled.
+type TTLPolicy struct {
+	Stale, Expire time.Duration
+}
+
+// VertexTTLs maps vertex types to the TTL policy for vertices of that type.
+// Vertices of types not present in the map never go stale or expire.
+//
+// As with OrphanExpiry, this determines the contents of the graph, so it
+// should be set once at startup and not changed thereafter.
+//
+// TTLs are evaluated against the times recorded with each message (see
+// system.CoreGraph.MergeAt), never against the wall clock, so replaying the
+// same messages always produces the same graph. Vertices last affirmed by a
+// message with no recorded time are exempt.
+var VertexTTLs map[system.VType]TTLPolicy
+
+// ParseTTLs parses a comma-separated list of TTL policies of the form
+// <vtype>=<stale>[:<expire>], where the durations are in the form accepted by
+// time.ParseDuration. For example:
+//
+//	process=10m:1h,comm=10m:1h,git-branch=720h
+func ParseTTLs(s string) (map[system.VType]TTLPolicy, error) {
+	ret := make(map[system.VType]TTLPolicy)
+	if s == "" {
+		return ret, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid TTL %q, expected <vtype>=<stale>[:<expire>]", part)
+		}
+
+		var p TTLPolicy
+		durs := strings.SplitN(kv[1], ":", 2)
+		d, err := time.ParseDuration(durs[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid stale duration for %s: %v", kv[0], err)
+		}
+		p.Stale = d
+
+		if len(durs) == 2 {
+			if p.Expire, err = time.ParseDuration(durs[1]); err != nil {
+				return nil, fmt.Errorf("invalid expire duration for %s: %v", kv[0], err)
+			}
+			if p.Stale != 0 && p.Expire != 0 && p.Expire < p.Stale {
+				return nil, fmt.Errorf("expire duration for %s is shorter than its stale duration", kv[0])
+			}
+		}
+
+		ret[system.VType(kv[0])] = p
+	}
+
+	return ret, nil
+}
+
+// affirm records that the vertex was described by the message currently
+// being merged.
+func (g *coreGraph) affirm(vt system.VertexTuple) {
+	if g.affirmed == nil {
+		return
+	}
+
+	// A vertex reaffirmed at the same time keeps its existing queue entry
+	if p := VertexTTLs[vt.Vertex.Typ()]; p.Expire != 0 && !g.msgtime.IsZero() && !g.affirmedAt(vt.ID).Equal(g.msgtime) {
+		g.enqueueExpiry(vt.Vertex.Typ(), expiryEntry{vid: vt.ID, at: g.msgtime})
+	}
+	g.affirmed = g.affirmed.Set(i2a(vt.ID), g.msgtime)
+}
+
+// affirmedAt returns the time of the message that last described the vertex,
+// or the zero time if unknown.
+func (g *coreGraph) affirmedAt(vid uint64) time.Time {
+	if g.affirmed == nil {
+		return time.Time{}
+	}
+
+	if t, exists := g.affirmed.Lookup(i2a(vid)); exists {
+		return t.(time.Time)
+	}
+	return time.Time{}
+}
+
+// past reports whether more than d has elapsed between the time the vertex
+// was last affirmed and the graph's current message.
+func (g *coreGraph) past(vid uint64, d time.Duration) bool {
+	at := g.affirmedAt(vid)
+	return d != 0 && !at.IsZero() && !g.msgtime.IsZero() && g.msgtime.Sub(at) > d
+}
+
+// expiryQueue holds the vertices of a single type in the order in which they
+// were affirmed. All vertices of a type share an expire TTL, so this is also
+// the order in which their deadlines pass, and expiry need only look at the
+// front of the queue.
+//
+// Entries are not removed when their vertex is reaffirmed or removed by other
+// means; they are discarded on reaching the front, as they no longer match
+// the vertex's affirmation time. Message times are recorded on receipt, so
+// they seldom go backwards; when they do, the out-of-order entry waits behind
+// those ahead of it, and is expired late rather than early.
+type expiryQueue struct {
+	head, tail uint64
+	entries    ps.Map // position in the queue to expiryEntry
+}
+
+type expiryEntry struct {
+	vid uint64
+	at  time.Time
+}
+
+// enqueueExpiry adds an entry to the back of the expiry queue for the type.
+func (g *coreGraph) enqueueExpiry(vtype system.VType, e expiryEntry) {
+	if g.expiry == nil {
+		g.expiry = ps.NewMap()
+	}
+
+	eq := expiryQueue{entries: ps.NewMap()}
+	if val, exists := g.expiry.Lookup(string(vtype)); exists {
+		eq = val.(expiryQueue)
+	}
+
+	eq.entries = eq.entries.Set(i2a(eq.tail), e)
+	eq.tail++
+	g.expiry = g.expiry.Set(string(vtype), eq)
+}
+
+// indexExpiry rebuilds the expiry queues from the recorded affirmation times,
+// for graphs that are reconstructed rather than merged.
+func (g *coreGraph) indexExpiry() {
+	g.expiry = ps.NewMap()
+	if g.affirmed == nil {
+		return
+	}
+
+	var entries expiryEntriesByTime
+	g.vtuples.ForEach(func(_ string, val ps.Any) {
+		vt := val.(system.VertexTuple)
+		if p := VertexTTLs[vt.Vertex.Typ()]; p.Expire != 0 {
+			if at := g.affirmedAt(vt.ID); !at.IsZero() {
+				entries = append(entries, typedExpiryEntry{vt.Vertex.Typ(), expiryEntry{vid: vt.ID, at: at}})
+			}
+		}
+	})
+
+	sort.Sort(entries)
+	for _, e := range entries {
+		g.enqueueExpiry(e.vtype, e.expiryEntry)
+	}
+}
+
+type typedExpiryEntry struct {
+	vtype system.VType
+	expiryEntry
+}
+
+type expiryEntriesByTime []typedExpiryEntry
+
+func (s expiryEntriesByTime) Len() int      { return len(s) }
+func (s expiryEntriesByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s expiryEntriesByTime) Less(i, j int) bool {
+	if !s[i].at.Equal(s[j].at) {
+		return s[i].at.Before(s[j].at)
+	}
+	return s[i].vid < s[j].vid
+}
+
+// expireVertices removes all vertices that have outlived their type's expire
+// TTL as of the graph's current message.
+func (g *coreGraph) expireVertices(logEntry *log.Entry) (removed []system.VertexTuple, detached []uint64) {
+	if g.msgtime.IsZero() || g.expiry == nil {
+		return
+	}
+
+	// Visit types in a fixed order, so that removal is the same on replay
+	var vtypes []string
+	for vtype, p := range VertexTTLs {
+		if p.Expire != 0 {
+			vtypes = append(vtypes, string(vtype))
+		}
+	}
+	sort.Strings(vtypes)
+
+	for _, vtype := range vtypes {
+		val, exists := g.expiry.Lookup(vtype)
+		if !exists {
+			continue
+		}
+		eq := val.(expiryQueue)
+		// Vertices affirmed before the deadline are past their expire TTL
+		deadline := g.msgtime.Add(-VertexTTLs[system.VType(vtype)].Expire)
+
+		for ; eq.head < eq.tail; eq.head++ {
+			val, _ := eq.entries.Lookup(i2a(eq.head))
+			e := val.(expiryEntry)
+			if !e.at.Before(deadline) {
+				break
+			}
+			eq.entries = eq.entries.Delete(i2a(eq.head))
+
+			// Reaffirmed or removed since the entry was queued
+			if !g.affirmedAt(e.vid).Equal(e.at) {
+				continue
+			}
+
+			vt, neighbors := g.removeVertex(e.vid)
+			removed = append(removed, vt)
+			detached = append(detached, neighbors...)
+		}
+		g.expiry = g.expiry.Set(vtype, eq)
+	}
+
+	if len(removed) > 0 {
+		logEntry.Infof("Removed %d vertices that were not reaffirmed within their TTL", len(removed))
+	}
+	return
+}
+
+// IsStale reports whether the given vertex has gone without being reaffirmed
+// for longer than its type's stale TTL, as of the graph's latest message.
+func IsStale(cg system.CoreGraph, vid uint64) bool {
+	g, ok := cg.(*coreGraph)
+	if !ok {
+		return false
+	}
+
+	vt, err := g.Get(vid)
+	if err != nil {
+		return false
+	}
+
+	p, exists := VertexTTLs[vt.Vertex.Typ()]
+	return exists && g.past(vid, p.Stale)
+}
@@ -0,0 +1,177 @@
+package represent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+func TestParseTTLs(t *testing.T) {
+	ttls, err := ParseTTLs("process=10m:1h,node=30s")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing valid TTLs: %v", err)
+	}
+
+	if ttls["process"] != (TTLPolicy{Stale: 10 * time.Minute, Expire: time.Hour}) {
+		t.Errorf("Unexpected policy for process: %+v", ttls["process"])
+	}
+	if ttls["node"] != (TTLPolicy{Stale: 30 * time.Second}) {
+		t.Errorf("Unexpected policy for node: %+v", ttls["node"])
+	}
+
+	if ttls, err = ParseTTLs(""); err != nil || len(ttls) != 0 {
+		t.Error("Empty string should produce no TTLs")
+	}
+
+	for _, bad := range []string{"process", "=10m", "process=10", "process=10m:xx", "process=1h:10m"} {
+		if _, err := ParseTTLs(bad); err == nil {
+			t.Errorf("Expected error when parsing %q", bad)
+		}
+	}
+}
+
+func nodeID(g system.CoreGraph, name string) uint64 {
+	if vtv := g.VerticesWith(q.Qbv(system.VType("node"), "name", name)); len(vtv) == 1 {
+		return vtv[0].ID
+	}
+	return 0
+}
+
+func TestVertexStale(t *testing.T) {
+	defer func(ttls map[system.VType]TTLPolicy) { VertexTTLs = ttls }(VertexTTLs)
+	VertexTTLs = map[system.VType]TTLPolicy{"node": {Stale: time.Minute}}
+
+	t0 := time.Unix(1440000000, 0)
+	g := NewGraph().MergeAt(1, t0, []system.UnifyInstructionForm{node("a"), node("b")})
+	a, b := nodeID(g, "a"), nodeID(g, "b")
+
+	g = g.MergeAt(2, t0.Add(time.Minute), []system.UnifyInstructionForm{node("b")})
+	if IsStale(g, a) {
+		t.Error("Vertex should not be stale until its TTL has been exceeded")
+	}
+
+	g2 := g.MergeAt(3, t0.Add(time.Minute+time.Second), []system.UnifyInstructionForm{node("c")})
+	if !IsStale(g2, a) {
+		t.Error("Vertex should be stale once not reaffirmed within its TTL")
+	}
+	if IsStale(g2, b) {
+		t.Error("Reaffirmed vertex should not be stale")
+	}
+	if IsStale(g, a) {
+		t.Error("Staleness should be evaluated as of each graph's own message")
+	}
+
+	// Reaffirming makes it fresh again; stale vertices are not removed
+	g2 = g2.MergeAt(4, t0.Add(time.Hour), []system.UnifyInstructionForm{node("a")})
+	if IsStale(g2, a) || nodeID(g2, "a") != a {
+		t.Error("Reaffirmed vertex should be the same vertex, and fresh")
+	}
+	if !IsStale(g2, b) {
+		t.Error("Stale vertex without an expire TTL should remain, stale")
+	}
+
+	// Messages without a time neither affirm nor age vertices
+	g3 := NewGraph().Merge(1, []system.UnifyInstructionForm{node("a")})
+	g3 = g3.MergeAt(2, t0.Add(time.Hour), []system.UnifyInstructionForm{node("b")})
+	if IsStale(g3, nodeID(g3, "a")) {
+		t.Error("Vertex affirmed at an unknown time should never be stale")
+	}
+}
+
+func TestVertexExpiry(t *testing.T) {
+	defer func(ttls map[system.VType]TTLPolicy) { VertexTTLs = ttls }(VertexTTLs)
+	VertexTTLs = map[system.VType]TTLPolicy{"node": {Stale: time.Minute, Expire: time.Hour}}
+
+	var calls int
+	t0 := time.Unix(1440000000, 0)
+	g := NewGraph().MergeAt(1, t0, []system.UnifyInstructionForm{
+		node("a", linkSpec{to: "b", calls: &calls}),
+		node("b"),
+	})
+	a, b := nodeID(g, "a"), nodeID(g, "b")
+	if linksFrom(g, "a") != 1 {
+		t.Fatal("Expected a to link to b")
+	}
+
+	g = g.MergeAt(2, t0.Add(time.Hour), []system.UnifyInstructionForm{node("a", linkSpec{to: "b", calls: &calls})})
+	if _, err := g.Get(b); err != nil {
+		t.Fatal("Vertex should not be removed until its expire TTL has been exceeded")
+	}
+
+	g2 := g.MergeAt(3, t0.Add(time.Hour+time.Second), []system.UnifyInstructionForm{node("c")})
+	if _, err := g2.Get(b); err == nil {
+		t.Error("Vertex should be removed once not reaffirmed within its expire TTL")
+	}
+	if _, err := g2.Get(a); err != nil {
+		t.Error("Vertex reaffirmed within its expire TTL should not be removed")
+	}
+	if linksFrom(g2, "a") != 0 {
+		t.Error("Edges to the expired vertex should be removed")
+	}
+	if _, err := g.Get(b); err != nil {
+		t.Error("Expiry should not affect earlier versions of the graph")
+	}
+
+	// Affirmation times survive snapshots, so replay continues identically
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, g); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	sg, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	sg = sg.MergeAt(3, t0.Add(time.Hour+time.Second), []system.UnifyInstructionForm{node("c")})
+	if _, err := sg.Get(b); err == nil {
+		t.Error("Vertex should expire identically in a graph restored from a snapshot")
+	}
+	if _, err := sg.Get(a); err != nil {
+		t.Error("Affirmation time should be restored from the snapshot")
+	}
+}
+
+func TestVertexExpiryQueue(t *testing.T) {
+	defer func(ttls map[system.VType]TTLPolicy) { VertexTTLs = ttls }(VertexTTLs)
+	VertexTTLs = map[system.VType]TTLPolicy{"node": {Expire: time.Hour}}
+
+	queued := func(g system.CoreGraph) int {
+		val, exists := g.(*coreGraph).expiry.Lookup("node")
+		if !exists {
+			return 0
+		}
+		eq := val.(expiryQueue)
+		return int(eq.tail - eq.head)
+	}
+
+	t0 := time.Unix(1440000000, 0)
+	g := NewGraph().MergeAt(1, t0, []system.UnifyInstructionForm{node("a"), node("b")})
+	// Reaffirming at the same time adds nothing to the queue
+	g = g.MergeAt(2, t0, []system.UnifyInstructionForm{node("a")})
+	if n := queued(g); n != 2 {
+		t.Fatalf("Expected one queue entry per vertex, got %v", n)
+	}
+	a, b := nodeID(g, "a"), nodeID(g, "b")
+
+	g = g.MergeAt(3, t0.Add(30*time.Minute), []system.UnifyInstructionForm{node("a")})
+	g = g.MergeAt(4, t0.Add(61*time.Minute), nil)
+	if _, err := g.Get(b); err == nil {
+		t.Error("Vertex should be removed once not reaffirmed within its expire TTL")
+	}
+	if _, err := g.Get(a); err != nil {
+		t.Error("Superseded queue entry should not expire a reaffirmed vertex")
+	}
+	if n := queued(g); n != 1 {
+		t.Errorf("Entries past their deadline should be dropped from the queue; %v remain", n)
+	}
+
+	g = g.MergeAt(5, t0.Add(91*time.Minute), nil)
+	if _, err := g.Get(a); err == nil {
+		t.Error("Vertex should be removed once its latest affirmation is past the expire TTL")
+	}
+	if n := queued(g); n != 0 {
+		t.Errorf("Expected an empty queue once all vertices have expired, got %v entries", n)
+	}
+}
@@ -0,0 +1,351 @@
+// Package snapshot persists point-in-time copies of the pipeviz graph to
+// disk, so that the graph can be restored without replaying the entire mlog.
+//
+// Each snapshot is a single file, named for the msgid of the graph it contains.
+// Files consist of a fixed-size header (magic string, format version, msgid,
+// CRC32 checksum and length of the payload) followed by the payload produced
+// by represent.WriteSnapshot.
+//
+// The format version changes whenever the payload does. Version 2 added the
+// graph's held orphans, message time and vertex affirmation times; snapshots
+// in earlier versions lack them, so cannot be used, and are skipped as
+// invalid. The graph can always be rebuilt from the mlog instead.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+const (
+	fileMode = 0600
+	dirMode  = 0700
+	ext      = ".snap"
+	magic    = "PVSNAP"
+	version  = 2
+	// magic + version + msgid + checksum + payload length
+	headerLen = len(magic) + 1 + 8 + 4 + 8
+)
+
+// Info describes a single snapshot file.
+type Info struct {
+	Path     string `json:"path"`
+	MsgID    uint64 `json:"msgid"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// Dir is a directory containing graph snapshot files.
+type Dir struct {
+	path string
+}
+
+// NewDir returns a handle to a snapshot directory at the provided path,
+// creating the directory if it does not already exist.
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, dirMode); err != nil {
+		return nil, err
+	}
+
+	return &Dir{path: path}, nil
+}
+
+// Path returns the filesystem path to the snapshot directory.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Write serializes the provided graph into a new snapshot file in the
+// directory. The file is written under a temporary name and renamed into
+// place, so a partially-written snapshot is never visible under a real name.
+func (d *Dir) Write(g system.CoreGraph) (Info, error) {
+	var payload bytes.Buffer
+	if err := represent.WriteSnapshot(&payload, g); err != nil {
+		return Info{}, err
+	}
+
+	info := Info{
+		Path:     filepath.Join(d.path, fmt.Sprintf("%020d%s", g.MsgID(), ext)),
+		MsgID:    g.MsgID(),
+		Size:     int64(headerLen + payload.Len()),
+		Checksum: crc32.ChecksumIEEE(payload.Bytes()),
+	}
+
+	f, err := ioutil.TempFile(d.path, ".tmp-snapshot-")
+	if err != nil {
+		return Info{}, err
+	}
+	// errs here are irrelevant if everything else succeeds; the file will have moved
+	defer os.Remove(f.Name())
+
+	if err = writeHeader(f, info, uint64(payload.Len())); err == nil {
+		_, err = payload.WriteTo(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), fileMode)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+
+	return info, os.Rename(f.Name(), info.Path)
+}
+
+// List returns information about each snapshot file in the directory, ordered
+// from newest (highest msgid) to oldest. Only file names are examined; the
+// contents are not verified.
+func (d *Dir) List() ([]Info, error) {
+	fl, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Info
+	for _, f := range fl {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ext) {
+			continue
+		}
+
+		msgid, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ret = append(ret, Info{
+			Path:  filepath.Join(d.path, f.Name()),
+			MsgID: msgid,
+			Size:  f.Size(),
+		})
+	}
+
+	sort.Sort(sort.Reverse(byMsgID(ret)))
+	return ret, nil
+}
+
+// Latest loads the newest valid snapshot containing a graph with a msgid no
+// greater than max. Snapshots that fail verification are logged and skipped.
+//
+// If no suitable snapshot exists, a nil graph and nil error are returned.
+func (d *Dir) Latest(max uint64) (system.CoreGraph, Info, error) {
+	infos, err := d.List()
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	for _, info := range infos {
+		if info.MsgID > max {
+			continue
+		}
+
+		g, vinfo, err := Read(info.Path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"system": "snapshot",
+				"path":   info.Path,
+				"err":    err,
+			}).Warn("Skipping invalid snapshot")
+			continue
+		}
+
+		return g, vinfo, nil
+	}
+
+	return nil, Info{}, nil
+}
+
+// Prune deletes all but the newest keep snapshot files in the directory,
+// returning information about those it deleted. If keep is zero or less,
+// nothing is deleted.
+func (d *Dir) Prune(keep int) ([]Info, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+
+	infos, err := d.List()
+	if err != nil || len(infos) <= keep {
+		return nil, err
+	}
+
+	var pruned []Info
+	for _, info := range infos[keep:] {
+		if err := os.Remove(info.Path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, info)
+	}
+	return pruned, nil
+}
+
+// Follow consumes graphs from the provided channel, writing a new snapshot
+// each time the graph has advanced by at least interval messages past the
+// msgid of the last snapshot. Snapshots are written in a separate goroutine;
+// graphs that arrive while a write is in progress are not held up. After
+// each write, all but the newest keep snapshots are deleted; see Prune.
+//
+// Follow blocks until the channel is closed.
+func (d *Dir) Follow(last, interval uint64, keep int, graphs <-chan system.CoreGraph) {
+	done := make(chan uint64, 1)
+	var busy bool
+
+	for {
+		select {
+		case g, open := <-graphs:
+			if !open {
+				if busy {
+					<-done
+				}
+				return
+			}
+
+			if busy || g.MsgID() < last+interval {
+				continue
+			}
+
+			busy = true
+			go func(g system.CoreGraph, prev uint64) {
+				info, err := d.Write(g)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"system": "snapshot",
+						"msgid":  g.MsgID(),
+						"err":    err,
+					}).Error("Failed to write graph snapshot")
+					done <- prev
+					return
+				}
+
+				log.WithFields(log.Fields{
+					"system": "snapshot",
+					"msgid":  info.MsgID,
+					"path":   info.Path,
+				}).Info("Wrote graph snapshot")
+
+				pruned, err := d.Prune(keep)
+				for _, p := range pruned {
+					log.WithFields(log.Fields{
+						"system": "snapshot",
+						"msgid":  p.MsgID,
+						"path":   p.Path,
+					}).Info("Deleted old graph snapshot")
+				}
+				if err != nil {
+					log.WithFields(log.Fields{
+						"system": "snapshot",
+						"err":    err,
+					}).Error("Failed to delete old graph snapshots")
+				}
+				done <- info.MsgID
+			}(g, last)
+		case last = <-done:
+			busy = false
+		}
+	}
+}
+
+// Inspect reads and verifies the header and checksum of a snapshot file,
+// without decoding the graph it contains.
+func Inspect(path string) (Info, error) {
+	info, _, err := readVerified(path)
+	return info, err
+}
+
+// Read reads and verifies a snapshot file, then decodes the graph it contains.
+func Read(path string) (system.CoreGraph, Info, error) {
+	info, payload, err := readVerified(path)
+	if err != nil {
+		return nil, info, err
+	}
+
+	g, err := represent.ReadSnapshot(bytes.NewReader(payload))
+	if err != nil {
+		return nil, info, err
+	}
+
+	if g.MsgID() != info.MsgID {
+		return nil, info, fmt.Errorf("snapshot header indicates msgid %d, but contained graph is at msgid %d", info.MsgID, g.MsgID())
+	}
+
+	return g, info, nil
+}
+
+func readVerified(path string) (Info, []byte, error) {
+	info := Info{Path: path}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info, nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return info, nil, errors.New("snapshot file is too short to contain a header")
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return info, nil, errors.New("file is not a pipeviz graph snapshot")
+	}
+	h := header[len(magic):]
+	if h[0] != version {
+		return info, nil, fmt.Errorf("unsupported snapshot format version %d", h[0])
+	}
+
+	info.MsgID = binary.BigEndian.Uint64(h[1:9])
+	info.Checksum = binary.BigEndian.Uint32(h[9:13])
+	plen := binary.BigEndian.Uint64(h[13:21])
+
+	payload, err := ioutil.ReadAll(f)
+	if err != nil {
+		return info, nil, err
+	}
+	info.Size = int64(headerLen + len(payload))
+
+	if uint64(len(payload)) != plen {
+		return info, nil, fmt.Errorf("snapshot payload is truncated or padded; expected %d bytes, found %d", plen, len(payload))
+	}
+	if crc32.ChecksumIEEE(payload) != info.Checksum {
+		return info, nil, errors.New("snapshot payload does not match its checksum")
+	}
+
+	return info, payload, nil
+}
+
+func writeHeader(w io.Writer, info Info, plen uint64) error {
+	header := make([]byte, headerLen)
+	copy(header, magic)
+
+	h := header[len(magic):]
+	h[0] = version
+	binary.BigEndian.PutUint64(h[1:9], info.MsgID)
+	binary.BigEndian.PutUint32(h[9:13], info.Checksum)
+	binary.BigEndian.PutUint64(h[13:21], plen)
+
+	_, err := w.Write(header)
+	return err
+}
+
+type byMsgID []Info
+
+func (s byMsgID) Len() int           { return len(s) }
+func (s byMsgID) Less(i, j int) bool { return s[i].MsgID < s[j].MsgID }
+func (s byMsgID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
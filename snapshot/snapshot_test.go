@@ -0,0 +1,241 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Loads the ein fixtures into a fresh memory mlog.
+func fixtureLog(t *testing.T) mlog.Store {
+	j := mem.NewMemStore()
+	for i := range make([]struct{}, 8) {
+		path := fmt.Sprintf("../fixtures/ein/%v.json", i+1)
+		f, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("json fnf: " + path)
+		}
+		j.NewEntry(f, "127.0.0.1", "")
+	}
+
+	return j
+}
+
+func encoded(t *testing.T, g system.CoreGraph) []byte {
+	var buf bytes.Buffer
+	if err := represent.WriteSnapshot(&buf, g); err != nil {
+		t.Fatal("Failed to encode graph:", err)
+	}
+	return buf.Bytes()
+}
+
+func tempDir(t *testing.T) *Dir {
+	path, err := ioutil.TempDir("", "pvsnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestWriteRead(t *testing.T) {
+	j := fixtureLog(t)
+	g, err := ingest.Replay(represent.NewGraph(), j.Get, 8)
+	if err != nil {
+		t.Fatal("Replay failed:", err)
+	}
+
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	info, err := d.Write(g)
+	if err != nil {
+		t.Fatal("Failed to write snapshot:", err)
+	}
+	if info.MsgID != 8 {
+		t.Errorf("Snapshot should record msgid 8, got %v", info.MsgID)
+	}
+
+	g2, info2, err := Read(info.Path)
+	if err != nil {
+		t.Fatal("Failed to read back snapshot:", err)
+	}
+	if info2.Checksum != info.Checksum || info2.MsgID != info.MsgID {
+		t.Errorf("Info read back (%+v) does not match info written (%+v)", info2, info)
+	}
+	if !bytes.Equal(encoded(t, g), encoded(t, g2)) {
+		t.Error("Graph read from snapshot differs from the graph that was written")
+	}
+}
+
+func TestRestoreThenReplay(t *testing.T) {
+	j := fixtureLog(t)
+	full, _ := ingest.Replay(represent.NewGraph(), j.Get, 8)
+	partial, _ := ingest.Replay(represent.NewGraph(), j.Get, 4)
+
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	if _, err := d.Write(partial); err != nil {
+		t.Fatal("Failed to write snapshot:", err)
+	}
+
+	sg, info, err := d.Latest(8)
+	if err != nil || sg == nil {
+		t.Fatalf("Failed to find latest snapshot: %v", err)
+	}
+	if info.MsgID != 4 {
+		t.Fatalf("Expected snapshot at msgid 4, got %v", info.MsgID)
+	}
+
+	restored, err := ingest.Replay(sg, j.Get, 8)
+	if err != nil {
+		t.Fatal("Replay from snapshot failed:", err)
+	}
+
+	if !bytes.Equal(encoded(t, full), encoded(t, restored)) {
+		t.Error("Graph restored from snapshot plus replay differs from full replay")
+	}
+}
+
+func TestLatestSkipsInvalid(t *testing.T) {
+	j := fixtureLog(t)
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	var infos []Info
+	for _, id := range []uint64{2, 5, 7} {
+		g, _ := ingest.Replay(represent.NewGraph(), j.Get, id)
+		info, err := d.Write(g)
+		if err != nil {
+			t.Fatal("Failed to write snapshot:", err)
+		}
+		infos = append(infos, info)
+	}
+
+	// Newer snapshots than the mlog can support must not be used
+	_, info, _ := d.Latest(6)
+	if info.MsgID != 5 {
+		t.Errorf("Expected snapshot at msgid 5 to be chosen when max is 6, got %v", info.MsgID)
+	}
+
+	// Corrupt the payload of the msgid 5 snapshot; the checksum should catch it
+	raw, _ := ioutil.ReadFile(infos[1].Path)
+	raw[len(raw)-1] ^= 0xff
+	ioutil.WriteFile(infos[1].Path, raw, fileMode)
+
+	if _, err := Inspect(infos[1].Path); err == nil {
+		t.Error("Inspect should fail on a snapshot with a corrupted payload")
+	}
+
+	_, info, _ = d.Latest(6)
+	if info.MsgID != 2 {
+		t.Errorf("Expected fallback to snapshot at msgid 2 after corruption, got %v", info.MsgID)
+	}
+
+	// Truncate the msgid 7 snapshot
+	ioutil.WriteFile(infos[2].Path, raw[:headerLen-1], fileMode)
+	if _, _, err := Read(infos[2].Path); err == nil {
+		t.Error("Read should fail on a truncated snapshot")
+	}
+
+	g, _, err := d.Latest(1)
+	if g != nil || err != nil {
+		t.Error("No snapshot should be found when all are newer than max")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	j := fixtureLog(t)
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	c := make(chan system.CoreGraph)
+	done := make(chan struct{})
+	go func() {
+		d.Follow(0, 3, 1, c)
+		close(done)
+	}()
+
+	g := represent.NewGraph()
+	for i := uint64(1); i <= 8; i++ {
+		g, _ = ingest.Replay(g, j.Get, i)
+		c <- g
+	}
+	close(c)
+	<-done
+
+	infos, _ := d.List()
+	if len(infos) != 1 {
+		t.Fatalf("Follow should have kept exactly one snapshot, found %v", len(infos))
+	}
+	if infos[0].MsgID < 3 {
+		t.Errorf("Snapshot written at msgid %v, before the interval had elapsed", infos[0].MsgID)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	j := fixtureLog(t)
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	for _, id := range []uint64{2, 5, 7} {
+		g, _ := ingest.Replay(represent.NewGraph(), j.Get, id)
+		if _, err := d.Write(g); err != nil {
+			t.Fatal("Failed to write snapshot:", err)
+		}
+	}
+
+	if pruned, err := d.Prune(0); len(pruned) != 0 || err != nil {
+		t.Errorf("Expected nothing to be pruned when keeping all snapshots, got %v, %v", pruned, err)
+	}
+
+	pruned, err := d.Prune(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].MsgID != 2 {
+		t.Errorf("Expected only the oldest snapshot to be pruned, got %v", pruned)
+	}
+
+	infos, _ := d.List()
+	if len(infos) != 2 || infos[0].MsgID != 7 || infos[1].MsgID != 5 {
+		t.Errorf("Expected snapshots at msgids 7 and 5 to remain, got %v", infos)
+	}
+}
+
+func TestOldVersionRejected(t *testing.T) {
+	j := fixtureLog(t)
+	d := tempDir(t)
+	defer os.RemoveAll(d.Path())
+
+	g, _ := ingest.Replay(represent.NewGraph(), j.Get, 5)
+	info, err := d.Write(g)
+	if err != nil {
+		t.Fatal("Failed to write snapshot:", err)
+	}
+
+	// Earlier versions lack parts of the graph, but otherwise decode cleanly
+	raw, _ := ioutil.ReadFile(info.Path)
+	raw[len(magic)] = version - 1
+	ioutil.WriteFile(info.Path, raw, fileMode)
+
+	if _, _, err := Read(info.Path); err == nil {
+		t.Error("Read should fail on a snapshot in an earlier format version")
+	}
+	if g, _, err := d.Latest(5); g != nil || err != nil {
+		t.Errorf("Expected snapshot in an earlier format version to be skipped, got %v, %v", g, err)
+	}
+}
@@ -3,6 +3,8 @@ package semantic
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"strconv"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
 	"github.com/pipeviz/pipeviz/represent/q"
@@ -53,12 +55,26 @@ func (s Sha1) String() string {
 	return hex.EncodeToString(s[:])
 }
 
+var errSha1 = errors.New("must be a 40-character hexadecimal sha1")
+
+// ParseSha1 parses the standard 40-char hexadecimal representation of a sha1.
+func ParseSha1(str string) (Sha1, error) {
+	var s Sha1
+	if len(str) != 40 {
+		return s, errSha1
+	}
+	if _, err := hex.Decode(s[:], []byte(str)); err != nil {
+		return s, errSha1
+	}
+	return s, nil
+}
+
 func (d Commit) UnificationForm() []system.UnifyInstructionForm {
-	byts, err := hex.DecodeString(d.Sha1Str)
+	sha1, err := ParseSha1(d.Sha1Str)
 	if err != nil {
 		return nil
 	}
-	copy(d.Sha1[:], byts[0:20])
+	d.Sha1 = sha1
 
 	v := pv{typ: "commit", props: system.RawProps{
 		"sha1":       d.Sha1,
@@ -71,19 +87,32 @@ func (d Commit) UnificationForm() []system.UnifyInstructionForm {
 	var edges []system.EdgeSpec
 
 	for k, pstr := range d.ParentsStr {
-		byts, err := hex.DecodeString(pstr)
+		sha1, err := ParseSha1(pstr)
 		if err != nil {
 			continue
 		}
 
-		var sha1 Sha1
-		copy(sha1[:], byts[0:20])
 		edges = append(edges, specGitCommitParent{Sha1: sha1, ParentNum: k + 1})
 	}
 
 	return []system.UnifyInstructionForm{uif{v: v, u: commitUnify, e: edges}}
 }
 
+// Validate reports a sha1 or parent that is not a valid sha1. When
+// interpreted, the commit would be dropped, or the parent ignored.
+func (d Commit) Validate() []FieldError {
+	var errs []FieldError
+	if _, err := ParseSha1(d.Sha1Str); err != nil {
+		errs = append(errs, FieldError{Path: []string{"sha1"}, Message: err.Error()})
+	}
+	for k, pstr := range d.ParentsStr {
+		if _, err := ParseSha1(pstr); err != nil {
+			errs = append(errs, FieldError{Path: []string{"parents", strconv.Itoa(k)}, Message: err.Error()})
+		}
+	}
+	return errs
+}
+
 func commitUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	candidates := g.VerticesWith(q.Qbv(system.VType("commit"), "sha1", u.Vertex().Properties()["sha1"]))
 
@@ -129,3 +158,8 @@ func (spec specGitCommitParent) Resolve(g system.CoreGraph, mid uint64, src syst
 
 	return
 }
+
+// Awaits declares that the spec depends on the parent commit's vertex.
+func (spec specGitCommitParent) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("commit"), "sha1", spec.Sha1)}
+}
@@ -1,8 +1,6 @@
 package semantic
 
 import (
-	"encoding/hex"
-
 	"github.com/pipeviz/pipeviz/represent/q"
 	"github.com/pipeviz/pipeviz/types/system"
 )
@@ -17,12 +15,10 @@ type CommitMeta struct {
 func (d CommitMeta) UnificationForm() []system.UnifyInstructionForm {
 	ret := make([]system.UnifyInstructionForm, 0)
 
-	var commit Sha1
-	byts, err := hex.DecodeString(d.Sha1Str)
+	commit, err := ParseSha1(d.Sha1Str)
 	if err != nil {
 		return nil
 	}
-	copy(commit[:], byts[0:20])
 
 	for _, tag := range d.Tags {
 		v := pv{typ: "git-tag", props: system.RawProps{"name": tag}}
@@ -42,6 +38,15 @@ func (d CommitMeta) UnificationForm() []system.UnifyInstructionForm {
 	return ret
 }
 
+// Validate reports a sha1 that is not a valid sha1, in which case the
+// metadata would be dropped when interpreted.
+func (d CommitMeta) Validate() []FieldError {
+	if _, err := ParseSha1(d.Sha1Str); err != nil {
+		return []FieldError{{Path: []string{"sha1"}, Message: err.Error()}}
+	}
+	return nil
+}
+
 func commitMetaUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	// the commit is the only scoping edge
 	spec := u.ScopingSpecs()[0].(specCommit)
@@ -132,6 +132,12 @@ func (d ParentDataset) UnificationForm() []system.UnifyInstructionForm {
 	return ret
 }
 
+// Validate reports a missing environment, without which the dataset cannot
+// be unified or linked to anything.
+func (d ParentDataset) Validate() []FieldError {
+	return validateEnvLink(d.Environment)
+}
+
 func parentDatasetUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	edge, success := u.ScopingSpecs()[0].(EnvLink).Resolve(g, 0, emptyVT(u.Vertex()))
 	if !success {
@@ -179,6 +185,15 @@ func (spec specDatasetHierarchy) Resolve(g system.CoreGraph, mid uint64, src sys
 	return
 }
 
+// Awaits declares that the spec depends on the parent dataset's vertex, and on
+// the environment it is found through.
+func (spec specDatasetHierarchy) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{
+		q.Qbv(system.VType("parent-dataset"), "name", spec.NamePath[0]),
+		q.Qbv(system.VType("environment")),
+	}
+}
+
 func (spec DataProvenance) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (e system.StdEdge, success bool) {
 	// FIXME this presents another weird case where "success" is not binary. We *could*
 	// find an already-existing data-provenance edge, but then have some net-addr params
@@ -220,6 +235,16 @@ func (spec DataProvenance) Resolve(g system.CoreGraph, mid uint64, src system.Ve
 	return
 }
 
+// Awaits declares that the spec depends on the environment and dataset
+// vertices it walks through to find the target dataset.
+func (spec DataProvenance) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{
+		q.Qbv(system.VType("environment")),
+		q.Qbv(system.VType("parent-dataset")),
+		q.Qbv(system.VType("dataset")),
+	}
+}
+
 func (spec DataAlpha) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (e system.StdEdge, success bool) {
 	// TODO this makes a loop...are we cool with that?
 	success = true // impossible to fail here
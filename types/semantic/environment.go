@@ -1,6 +1,8 @@
 package semantic
 
 import (
+	"strconv"
+
 	"github.com/pipeviz/pipeviz/maputil"
 	"github.com/pipeviz/pipeviz/represent/q"
 	"github.com/pipeviz/pipeviz/types/system"
@@ -38,18 +40,7 @@ func (d Environment) UnificationForm() []system.UnifyInstructionForm {
 		u: envUnify,
 	}}
 
-	envlink := EnvLink{Address: Address{}}
-	// Create an envlink for any nested items, preferring nick, then hostname, ipv4, ipv6.
-	if d.Nick != "" {
-		envlink.Nick = d.Nick
-	} else if d.Address.Hostname != "" {
-		envlink.Address.Hostname = d.Address.Hostname
-	} else if d.Address.Ipv4 != "" {
-		envlink.Address.Ipv4 = d.Address.Ipv4
-	} else if d.Address.Ipv6 != "" {
-		envlink.Address.Ipv6 = d.Address.Ipv6
-	}
-
+	envlink := d.link()
 	for _, ls := range d.LogicStates {
 		ls.Environment = envlink
 		ret = append(ret, ls.UnificationForm()...)
@@ -66,6 +57,36 @@ func (d Environment) UnificationForm() []system.UnifyInstructionForm {
 	return ret
 }
 
+// link creates an envlink for any nested items, preferring nick, then
+// hostname, ipv4, ipv6.
+func (d Environment) link() EnvLink {
+	envlink := EnvLink{Address: Address{}}
+	if d.Nick != "" {
+		envlink.Nick = d.Nick
+	} else if d.Address.Hostname != "" {
+		envlink.Address.Hostname = d.Address.Hostname
+	} else if d.Address.Ipv4 != "" {
+		envlink.Address.Ipv4 = d.Address.Ipv4
+	} else if d.Address.Ipv6 != "" {
+		envlink.Address.Ipv6 = d.Address.Ipv6
+	}
+
+	return envlink
+}
+
+// Validate reports an environment that nothing could be linked to, and any
+// problems with the logic states nested within it.
+func (d Environment) Validate() []FieldError {
+	var errs []FieldError
+	if d.link().IsEmpty() {
+		errs = append(errs, FieldError{Message: "must have an address or nick"})
+	}
+	for k, ls := range d.LogicStates {
+		errs = append(errs, prefixErrors(ls.validate(), "logic-states", strconv.Itoa(k))...)
+	}
+	return errs
+}
+
 func envUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	matches := g.VerticesWith(q.Qbv(system.VType("environment")))
 
@@ -83,6 +104,11 @@ type EnvLink struct {
 	Nick    string  `json:"nick,omitempty"`
 }
 
+// IsEmpty indicates whether the envlink identifies no environment at all.
+func (spec EnvLink) IsEmpty() bool {
+	return spec.Nick == "" && spec.Address == Address{}
+}
+
 func (spec EnvLink) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (e system.StdEdge, success bool) {
 	_, e, success = findEnv(g, src)
 
@@ -111,3 +137,64 @@ func (spec EnvLink) Resolve(g system.CoreGraph, mid uint64, src system.VertexTup
 
 	return
 }
+
+// Awaits declares that the spec depends on environment vertices. Matching is
+// done on any of several properties, so no narrower filter is possible.
+func (spec EnvLink) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("environment"))}
+}
+
+// EnvScope declares that the message containing it reports everything of the
+// given kinds within an environment, such that anything of those kinds
+// currently linked to the environment but absent from the message should be
+// removed.
+//
+// Kinds are named as in the top level of a message: "processes" (which
+// includes their listeners), "logic-states" and "datasets".
+type EnvScope struct {
+	Environment EnvLink  `json:"environment"`
+	Kinds       []string `json:"kinds"`
+}
+
+// scopeVTypes maps the kinds that may appear in an EnvScope to the vertex
+// types they cover.
+var scopeVTypes = map[string][]system.VType{
+	"processes":    {"process", "comm"},
+	"logic-states": {"logic-state"},
+	"datasets":     {"parent-dataset", "dataset"},
+}
+
+func (d EnvScope) UnificationForm() []system.UnifyInstructionForm {
+	var vtypes []system.VType
+	for _, k := range d.Kinds {
+		vtypes = append(vtypes, scopeVTypes[k]...)
+	}
+
+	return []system.UnifyInstructionForm{system.AuthoritativeScope{
+		UnifyInstructionForm: uif{
+			v:  pv{typ: "environment", props: system.RawProps{}},
+			u:  envScopeUnify,
+			se: []system.EdgeSpec{d.Environment},
+		},
+		EType:  "envlink",
+		Nested: "dataset-hierarchy",
+		VTypes: vtypes,
+	}}
+}
+
+// Validate reports a missing environment, without which there is nothing for
+// the scope to cover.
+func (d EnvScope) Validate() []FieldError {
+	return validateEnvLink(d.Environment)
+}
+
+// envScopeUnify finds the environment an EnvScope refers to, exactly as the
+// envlink of a vertex within the environment would.
+func envScopeUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
+	edge, success := u.ScopingSpecs()[0].(EnvLink).Resolve(g, 0, emptyVT(u.Vertex()))
+	if !success {
+		return 0
+	}
+
+	return edge.Target
+}
@@ -1,8 +1,6 @@
 package semantic
 
 import (
-	"encoding/hex"
-
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
 	"github.com/pipeviz/pipeviz/maputil"
 	"github.com/pipeviz/pipeviz/represent/q"
@@ -59,10 +57,8 @@ func (d LogicState) UnificationForm() []system.UnifyInstructionForm {
 	var edges []system.EdgeSpec
 
 	if d.ID.CommitStr != "" {
-		var commit Sha1
-		byts, err := hex.DecodeString(d.ID.CommitStr)
+		commit, err := ParseSha1(d.ID.CommitStr)
 		if err == nil {
-			copy(commit[:], byts[0:20])
 			edges = append(edges, specCommit{commit})
 		}
 	}
@@ -74,6 +70,24 @@ func (d LogicState) UnificationForm() []system.UnifyInstructionForm {
 	return []system.UnifyInstructionForm{uif{v: v, u: lsUnify, e: edges, se: []system.EdgeSpec{d.Environment}}}
 }
 
+// Validate reports a commit that is not a valid sha1, which would be ignored
+// when interpreted, and a missing environment.
+func (d LogicState) Validate() []FieldError {
+	return append(validateEnvLink(d.Environment), d.validate()...)
+}
+
+// validate checks everything but the environment, which a logic state nested
+// within an environment takes from it.
+func (d LogicState) validate() []FieldError {
+	if d.ID.CommitStr == "" {
+		return nil
+	}
+	if _, err := ParseSha1(d.ID.CommitStr); err != nil {
+		return []FieldError{{Path: []string{"id", "commit"}, Message: err.Error()}}
+	}
+	return nil
+}
+
 func lsUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	// only one scoping edge - the envlink
 	edge, success := u.ScopingSpecs()[0].(EnvLink).Resolve(g, 0, emptyVT(u.Vertex()))
@@ -122,6 +136,11 @@ func (spec specCommit) Resolve(g system.CoreGraph, mid uint64, src system.Vertex
 	return
 }
 
+// Awaits declares that the spec depends on the commit's vertex.
+func (spec specCommit) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("commit"), "sha1", spec.Sha1)}
+}
+
 func (spec DataLink) Resolve(g system.CoreGraph, mid uint64, src system.VertexTuple) (e system.StdEdge, success bool) {
 	e = system.StdEdge{
 		Source: src.ID,
@@ -259,3 +278,15 @@ func (spec DataLink) Resolve(g system.CoreGraph, mid uint64, src system.VertexTu
 	e.Target = dataset.ID
 	return
 }
+
+// Awaits declares that the spec depends on every vertex type along the path
+// it walks from the environment to the target dataset.
+func (spec DataLink) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{
+		q.Qbv(system.VType("environment")),
+		q.Qbv(system.VType("comm")),
+		q.Qbv(system.VType("process")),
+		q.Qbv(system.VType("parent-dataset")),
+		q.Qbv(system.VType("dataset")),
+	}
+}
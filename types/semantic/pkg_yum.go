@@ -28,6 +28,18 @@ func (d PkgYum) UnificationForm() []system.UnifyInstructionForm {
 	}}
 }
 
+// Validate reports an empty name, version or arch. Packages are identified by
+// these, so one without them would be conflated with others.
+func (d PkgYum) Validate() []FieldError {
+	var errs []FieldError
+	for _, f := range []struct{ name, val string }{{"name", d.Name}, {"version", d.Version}, {"arch", d.Arch}} {
+		if f.val == "" {
+			errs = append(errs, FieldError{Path: []string{f.name}, Message: "must not be empty"})
+		}
+	}
+	return errs
+}
+
 func pkgYumUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	props := u.Vertex().Properties()
 	vtv := g.VerticesWith(q.Qbv(system.VType("pkg-yum"),
@@ -73,6 +73,12 @@ func (d Process) UnificationForm() []system.UnifyInstructionForm {
 	}}, ret...)
 }
 
+// Validate reports a missing environment, without which the process cannot
+// be unified or linked to anything.
+func (d Process) Validate() []FieldError {
+	return validateEnvLink(d.Environment)
+}
+
 func processUnify(g system.CoreGraph, u system.UnifyInstructionForm) uint64 {
 	// only one scoping edge - the envlink
 	edge, success := u.ScopingSpecs()[0].(EnvLink).Resolve(g, 0, emptyVT(u.Vertex()))
@@ -138,6 +144,11 @@ func (spec specLocalLogic) Resolve(g system.CoreGraph, mid uint64, src system.Ve
 	return
 }
 
+// Awaits declares that the spec depends on the logic state's vertex.
+func (spec specLocalLogic) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("logic-state"), "path", spec.Path)}
+}
+
 type specParentDataset struct {
 	Name string
 }
@@ -170,6 +181,11 @@ func (spec specParentDataset) Resolve(g system.CoreGraph, mid uint64, src system
 	return
 }
 
+// Awaits declares that the spec depends on the parent dataset's vertex.
+func (spec specParentDataset) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("parent-dataset"), "name", spec.Name)}
+}
+
 type specNetListener struct {
 	Port  int
 	Proto string
@@ -203,6 +219,11 @@ func (spec specNetListener) Resolve(g system.CoreGraph, mid uint64, src system.V
 	return
 }
 
+// Awaits declares that the spec depends on the port's comm vertex.
+func (spec specNetListener) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("comm"), "type", "port", "port", spec.Port)}
+}
+
 type specUnixDomainListener struct {
 	Path string
 }
@@ -233,3 +254,8 @@ func (spec specUnixDomainListener) Resolve(g system.CoreGraph, mid uint64, src s
 
 	return
 }
+
+// Awaits declares that the spec depends on the socket's comm vertex.
+func (spec specUnixDomainListener) Awaits(src system.VertexTuple) []system.VFilter {
+	return []system.VFilter{q.Qbv(system.VType("comm"), "type", "unix", "path", spec.Path)}
+}
@@ -1,12 +1,31 @@
 package semantic
 
 import (
+	"encoding/gob"
+
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
 	"github.com/pipeviz/pipeviz/maputil"
 	"github.com/pipeviz/pipeviz/represent/q"
 	"github.com/pipeviz/pipeviz/types/system"
 )
 
+func init() {
+	// Graph snapshots use gob, which must know about every concrete type that
+	// can appear in a property value or a held-over (orphaned) edge spec.
+	gob.Register(Sha1{})
+	gob.Register(EnvLink{})
+	gob.Register(DataLink{})
+	gob.Register(DataAlpha(""))
+	gob.Register(DataProvenance{})
+	gob.Register(specCommit{})
+	gob.Register(specGitCommitParent{})
+	gob.Register(specLocalLogic{})
+	gob.Register(specParentDataset{})
+	gob.Register(specNetListener{})
+	gob.Register(specUnixDomainListener{})
+	gob.Register(specDatasetHierarchy{})
+}
+
 // pp is a convenience function to create a types.PropPair. The compiler
 // always inlines it, so there's no cost.
 func pp(k string, v interface{}) system.PropPair {
@@ -0,0 +1,32 @@
+package semantic
+
+// FieldError describes a field that the message schema accepts, but that
+// cannot be interpreted as intended.
+type FieldError struct {
+	// Path to the field from the datum that was validated; empty if the
+	// problem is with the datum as a whole.
+	Path    []string
+	Message string
+}
+
+// A Validator reports problems with a datum that the message schema cannot
+// express. Validate returns nil if there are none.
+type Validator interface {
+	Validate() []FieldError
+}
+
+// validateEnvLink reports an envlink that identifies no environment.
+func validateEnvLink(l EnvLink) []FieldError {
+	if l.IsEmpty() {
+		return []FieldError{{Path: []string{"environment"}, Message: "must identify an environment by address or nick"}}
+	}
+	return nil
+}
+
+// prefixErrors prepends the path to the path of each error.
+func prefixErrors(errs []FieldError, path ...string) []FieldError {
+	for k, e := range errs {
+		errs[k].Path = append(append([]string(nil), path...), e.Path...)
+	}
+	return errs
+}
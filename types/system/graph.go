@@ -1,5 +1,7 @@
 package system
 
+import "time"
+
 /*
 CoreGraph is the interface provided by pipeviz' main graph object.
 
@@ -15,6 +17,18 @@ type CoreGraph interface {
 	// that contains the resulting updates.
 	Merge(uint64, []UnifyInstructionForm) CoreGraph
 
+	// Merge a message into the graph as with Merge, additionally recording the
+	// time at which the message was received. Time-based policies, such as
+	// orphan expiry, are evaluated against these recorded times rather than
+	// the wall clock, so that replaying the same messages always produces the
+	// same graph.
+	MergeAt(uint64, time.Time, []UnifyInstructionForm) CoreGraph
+
+	// Merge a message into the graph as with MergeAt, for a merge whose result
+	// is only to be previewed, then discarded. The merge is logged as a dry
+	// run, so it is not mistaken for one that changed the graph.
+	DryRunAt(uint64, time.Time, []UnifyInstructionForm) CoreGraph
+
 	// Enumerates the outgoing edges from the ego vertex, limiting the result set
 	// to those that pass the provided filter (if any).
 	OutWith(egoId uint64, ef EFilter) EdgeVector
@@ -7,6 +7,7 @@ type flatVTuple struct {
 	V        flatVertex `json:"vertex"`
 	InEdges  []flatEdge `json:"inEdges"`
 	OutEdges []flatEdge `json:"outEdges"`
+	Stale    bool       `json:"stale"`
 }
 
 type flatVertex struct {
@@ -0,0 +1,65 @@
+package system
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/mndrix/ps"
+)
+
+// PropPredicate is a test against a single property. When a PropPredicate is
+// used as the V in a PropPair, it is evaluated in place of the default
+// equality comparison against the property's value.
+//
+// Because some predicates (e.g., "does not exist") are satisfied by the
+// absence of a property, the predicate is always called, with exists
+// indicating whether the property was present at all. If exists is false,
+// the Property will be the zero value.
+type PropPredicate interface {
+	MatchProp(p Property, exists bool) bool
+}
+
+// MatchProps reports whether the provided property map satisfies all of the
+// given PropPairs. Pairs with a PropPredicate as their value are evaluated
+// via the predicate; all others require that the property exist and that
+// its value be equal to the pair's value.
+func MatchProps(props ps.Map, pairs []PropPair) bool {
+	for _, pp := range pairs {
+		val, exists := props.Lookup(pp.K)
+
+		var p Property
+		if exists {
+			p = val.(Property)
+		}
+
+		if pred, ok := pp.V.(PropPredicate); ok {
+			if !pred.MatchProp(p, exists) {
+				return false
+			}
+		} else if !exists || !EqualValues(p.Value, pp.V) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EqualValues compares two raw property values for equality. Byte slices
+// are compared by content; other values of uncomparable types are never
+// considered equal, rather than causing a runtime panic.
+func EqualValues(a, b interface{}) bool {
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb || !ta.Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -14,6 +14,10 @@ type EFilterChain interface {
 
 // VFilter describes an Vertex Filter, used by the traversal/query
 // system to govern traversals ad limit results.
+//
+// The value in each of the filter's PropPairs may be a PropPredicate, in
+// which case it is evaluated instead of an equality test. The same is true
+// of EFilters.
 type VFilter interface {
 	VType() VType
 	VProps() []PropPair
@@ -14,9 +14,50 @@ type UnifyInstructionForm interface {
 	ScopingSpecs() []EdgeSpec
 }
 
+// Tombstone wraps a UnifyInstructionForm to indicate that the vertex it
+// identifies should be removed from the graph, along with all of its edges,
+// rather than merged into it. The vertex is identified via the wrapped form's
+// Unify method, exactly as it would be for a merge; edge specs are ignored.
+type Tombstone struct {
+	UnifyInstructionForm
+}
+
+// AuthoritativeScope wraps a UnifyInstructionForm identifying a vertex that
+// defines a scope, such as an environment, to declare that the message
+// containing it is a complete description of all vertices of the given types
+// within that scope. A vertex is within the scope if it has an out-edge of the
+// given type to the scope vertex or, where Nested is set, an out-edge of the
+// Nested type to another vertex within the scope.
+//
+// Once the rest of the message has been merged, any in-scope vertex that the
+// message did not describe is removed from the graph, along with its edges.
+type AuthoritativeScope struct {
+	UnifyInstructionForm
+	EType  EType
+	Nested EType
+	VTypes []VType
+}
+
 // TODO for now, no structure to this. change to queryish form later
 type EdgeSpec interface {
 	// Resolves the spec into a real edge, merging as appropriate with
 	// any existing edge (as returned from FindExisting)
 	Resolve(CoreGraph, uint64, VertexTuple) (StdEdge, bool)
 }
+
+// DependentEdgeSpec is an EdgeSpec that can declare which vertices its
+// resolution depends on.
+//
+// When a spec fails to resolve, the graph engine holds it until it has reason
+// to believe another attempt could succeed. For a DependentEdgeSpec, that is
+// when a vertex matching one of the returned filters is added or modified, or
+// gains or loses an edge; or, when the spec's own source vertex does. EdgeSpecs
+// that do not implement this interface are reattempted whenever anything in
+// the graph changes.
+//
+// The filters need not be exact, but must not be too narrow: any change to
+// the graph that could cause Resolve to succeed must touch a matching vertex.
+type DependentEdgeSpec interface {
+	EdgeSpec
+	Awaits(src VertexTuple) []VFilter
+}
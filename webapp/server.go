@@ -2,15 +2,19 @@ package webapp
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/gorilla/websocket"
 	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/web"
 	"github.com/pipeviz/pipeviz/broker"
+	"github.com/pipeviz/pipeviz/history"
 	"github.com/pipeviz/pipeviz/log"
 	"github.com/pipeviz/pipeviz/mlog"
 	"github.com/pipeviz/pipeviz/represent"
@@ -25,8 +29,10 @@ var (
 var (
 	// Subscribe to the master broker and store latest locally as it comes
 	brokerListen = broker.Get().Subscribe()
-	// Initially set the latestGraph to a new, empty one to avoid nil pointer
+	// Initially set the latestGraph to a new, empty one to avoid nil pointer.
+	// Access only through latest and setLatest.
 	latestGraph = represent.NewGraph()
+	latestLock  sync.RWMutex
 	// Count of active websocket clients (for expvars)
 	clientCount int64
 )
@@ -38,6 +44,8 @@ const (
 	pongWait = 60 * time.Second
 	// Send pings to client with this period; less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+	// Maximum size of a query request body.
+	maxQuerySize = 64 << 10
 )
 
 var (
@@ -49,11 +57,25 @@ func init() {
 	// Kick off goroutine to listen on the graph broker and keep our local pointer up to date
 	go func() {
 		for g := range brokerListen {
-			latestGraph = g
+			setLatest(g)
 		}
 	}()
 }
 
+// latest returns the latest graph received from the broker.
+func latest() system.CoreGraph {
+	latestLock.RLock()
+	defer latestLock.RUnlock()
+	return latestGraph
+}
+
+// setLatest replaces the latest graph.
+func setLatest(g system.CoreGraph) {
+	latestLock.Lock()
+	latestGraph = g
+	latestLock.Unlock()
+}
+
 // Creates a Goji *web.Mux that can act as the http muxer for the frontend app.
 func NewMux() *web.Mux {
 	m := web.New()
@@ -61,6 +83,13 @@ func NewMux() *web.Mux {
 	m.Use(log.NewHTTPLogger("webapp"))
 	m.Get("/sock", openSocket)
 	m.Get("/message/:mid", getMessage)
+	m.Get("/message/:mid/effects", getMessageEffects)
+	m.Get("/graph", getGraph)
+	m.Get("/vertex/:vid", getVertex)
+	m.Get("/vertex/:vid/history", getVertexHistory)
+	m.Get("/diff", getDiff)
+	m.Get("/orphans", getOrphans)
+	m.Post("/query", postQuery)
 	m.Get("/*", http.StripPrefix("/", http.FileServer(http.Dir(publicDir))))
 
 	return m
@@ -71,13 +100,28 @@ func RegisterToMux(m *web.Mux) {
 	m.Use(log.NewHTTPLogger("webapp"))
 	m.Get("/sock", openSocket)
 	m.Get("/message/:mid", getMessage)
+	m.Get("/message/:mid/effects", getMessageEffects)
+	m.Get("/graph", getGraph)
+	m.Get("/vertex/:vid", getVertex)
+	m.Get("/vertex/:vid/history", getVertexHistory)
+	m.Get("/diff", getDiff)
+	m.Get("/orphans", getOrphans)
+	m.Post("/query", postQuery)
 	m.Get("/*", http.StripPrefix("/", http.FileServer(http.Dir(publicDir))))
 }
 
+// flatVertex flattens the vertex for conversion to JSON, marking it stale if
+// it has gone unaffirmed for longer than its TTL allows.
+func flatVertex(g system.CoreGraph, vt system.VertexTuple) interface{} {
+	f := vt.Flat()
+	f.Stale = represent.IsStale(g, vt.ID)
+	return f
+}
+
 func graphToJSON(g system.CoreGraph) ([]byte, error) {
 	var vertices []interface{}
 	for _, v := range g.VerticesWith(q.Qbv(system.VTypeNone)) {
-		vertices = append(vertices, v.Flat())
+		vertices = append(vertices, flatVertex(g, v))
 	}
 
 	// TODO use something that lets us write to a reusable byte buffer instead
@@ -119,7 +163,358 @@ func getMessage(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(rec.Message)
 }
 
+// getMessageEffects writes out, as JSON, the vertices and edges created,
+// changed or removed by merging the message, and the edge specs from it that
+// were left unresolved.
+func getMessageEffects(c web.C, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(c.URLParams["mid"], 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	hb, err := historyBuilder(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	e, err := hb.Effects(id)
+	if err == history.ErrOutOfRange {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, "Error while marshaling message effects to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// getGraph writes out the graph as JSON, in the same form as is sent over the
+// websocket. By default this is the latest graph, but an earlier one can be
+// requested with either a msgid or at query parameter; see graphFromRequest.
+func getGraph(c web.C, w http.ResponseWriter, r *http.Request) {
+	g, status, err := graphFromRequest(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	j, err := graphToJSON(g)
+	if err != nil {
+		http.Error(w, "Error while marshaling graph to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// getVertex writes out a single vertex, with its edges, as JSON. The same
+// query parameters as getGraph can be used to retrieve the vertex as it
+// existed at some earlier point.
+func getVertex(c web.C, w http.ResponseWriter, r *http.Request) {
+	vid, err := strconv.ParseUint(c.URLParams["vid"], 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	g, status, err := graphFromRequest(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	vt, err := g.Get(vid)
+	if err != nil {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Id     uint64      `json:"id"`
+		Vertex interface{} `json:"vertex"`
+	}{
+		Id:     g.MsgID(),
+		Vertex: flatVertex(g, vt),
+	})
+	if err != nil {
+		http.Error(w, "Error while marshaling vertex to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// getVertexHistory writes out, as JSON, the values each property of a vertex
+// has held over time. The same query parameters as getGraph can be used to
+// end the history at an earlier version of the graph.
+func getVertexHistory(c web.C, w http.ResponseWriter, r *http.Request) {
+	vid, err := strconv.ParseUint(c.URLParams["vid"], 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	g, status, err := graphFromRequest(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	hb, err := historyBuilder(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	vh, err := hb.Vertex(g, vid)
+	if err == history.ErrNoVertex {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Id     uint64                 `json:"id"`
+		Vertex *history.VertexHistory `json:"vertex"`
+	}{
+		Id:     g.MsgID(),
+		Vertex: vh,
+	})
+	if err != nil {
+		http.Error(w, "Error while marshaling vertex history to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// graphFromRequest picks the graph to operate on based on the request's query
+// parameters:
+//
+//   - msgid=<n>: the graph immediately after message n was merged
+//   - at=<time>: the graph as of the given time, either RFC3339 or unix seconds
+//
+// If neither is given, the latest graph is used. On failure, an appropriate
+// http status code is returned along with the error.
+func graphFromRequest(c web.C, r *http.Request) (system.CoreGraph, int, error) {
+	qv := r.URL.Query()
+	mid, at := qv.Get("msgid"), qv.Get("at")
+
+	g := latest()
+	if mid == "" && at == "" {
+		return g, 200, nil
+	}
+	if mid != "" && at != "" {
+		return nil, 400, errors.New("only one of msgid or at may be specified")
+	}
+
+	if mid != "" {
+		id, err := strconv.ParseUint(mid, 10, 64)
+		if err != nil {
+			return nil, 400, errors.New("msgid must be a non-negative integer")
+		}
+		return graphAtMsgID(c, id)
+	}
+
+	t, err := parseTime(at)
+	if err != nil {
+		return nil, 400, err
+	}
+
+	hb, err := historyBuilder(c)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	g, err = hb.AtTime(t)
+	if err != nil {
+		return nil, 500, err
+	}
+	return g, 200, nil
+}
+
+// graphAtMsgID returns the graph as it was immediately after the given msgid
+// was merged. On failure, an appropriate http status code is returned along
+// with the error.
+func graphAtMsgID(c web.C, id uint64) (system.CoreGraph, int, error) {
+	// No need to rebuild anything if the latest graph is what's wanted
+	if g := latest(); id == g.MsgID() {
+		return g, 200, nil
+	}
+
+	hb, err := historyBuilder(c)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	g, err := hb.AtMsgID(id)
+	if err == history.ErrOutOfRange {
+		return nil, 404, err
+	} else if err != nil {
+		return nil, 500, err
+	}
+	return g, 200, nil
+}
+
+func historyBuilder(c web.C) (*history.Builder, error) {
+	if b, exists := c.Env["history"]; exists {
+		if hb, ok := b.(*history.Builder); ok && hb != nil {
+			return hb, nil
+		}
+	}
+
+	return nil, errors.New("historical graphs are not available")
+}
+
+// getDiff writes out, as JSON, the changes between the graph as of two
+// msgids, given by the from and to query parameters. If to is omitted, the
+// latest graph is used.
+func getDiff(c web.C, w http.ResponseWriter, r *http.Request) {
+	qv := r.URL.Query()
+
+	fid, err := strconv.ParseUint(qv.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "from must be a non-negative integer msgid", 400)
+		return
+	}
+
+	to := latest()
+	if ts := qv.Get("to"); ts != "" {
+		tid, err := strconv.ParseUint(ts, 10, 64)
+		if err != nil {
+			http.Error(w, "to must be a non-negative integer msgid", 400)
+			return
+		}
+
+		var status int
+		if to, status, err = graphAtMsgID(c, tid); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	from, status, err := graphAtMsgID(c, fid)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	j, err := json.Marshal(represent.Diff(from, to))
+	if err != nil {
+		http.Error(w, "Error while marshaling diff to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// getOrphans writes out, as JSON, the edge specs held in the graph because
+// they have not yet been resolved. The same query parameters as getGraph can
+// be used to inspect an earlier version of the graph.
+func getOrphans(c web.C, w http.ResponseWriter, r *http.Request) {
+	g, status, err := graphFromRequest(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	orphans := represent.Orphans(g)
+	if orphans == nil {
+		orphans = []represent.Orphan{}
+	}
+
+	j, err := json.Marshal(struct {
+		ID      uint64             `json:"id"`
+		Orphans []represent.Orphan `json:"orphans"`
+	}{
+		ID:      g.MsgID(),
+		Orphans: orphans,
+	})
+	if err != nil {
+		http.Error(w, "Error while marshaling orphans to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// postQuery runs the JSON query in the request body (see q.Query) against
+// the graph, and writes out the result as JSON. The same query parameters as
+// getGraph can be used to query an earlier version of the graph.
+func postQuery(c web.C, w http.ResponseWriter, r *http.Request) {
+	qry, err := q.ParseQuery(http.MaxBytesReader(w, r.Body, maxQuerySize))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	g, status, err := graphFromRequest(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	j, err := json.Marshal(qry.Run(g))
+	if err != nil {
+		http.Error(w, "Error while marshaling query result to JSON", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(j)
+}
+
+// parseTime accepts either an RFC3339 timestamp or integer unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return t, errors.New("at must be an RFC3339 timestamp or unix seconds")
+	}
+	return t, nil
+}
+
+// openSocket upgrades the request to a websocket connection and begins
+// pushing graph data to the client. The protocol used is selected by the
+// proto query parameter; see the protoFull and protoDelta constants.
 func openSocket(w http.ResponseWriter, r *http.Request) {
+	proto := protoFull
+	switch r.URL.Query().Get("proto") {
+	case "", "1":
+	case "2":
+		proto = protoDelta
+	default:
+		http.Error(w, "Unsupported websocket protocol version", 400)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		entry := logrus.WithFields(logrus.Fields{
@@ -135,48 +530,133 @@ func openSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientCount++
-	go wsWriter(ws)
-	wsReader(ws)
-	clientCount--
+	sc := &sockClient{
+		ws:     ws,
+		proto:  proto,
+		resync: make(chan struct{}, 1),
+		subs:   make(chan *subscription, 1),
+		done:   make(chan struct{}),
+	}
+
+	atomic.AddInt64(&clientCount, 1)
+	go wsWriter(sc)
+	wsReader(sc)
+	atomic.AddInt64(&clientCount, -1)
 }
 
-func wsReader(ws *websocket.Conn) {
-	defer ws.Close()
-	ws.SetReadLimit(512)
+func wsReader(sc *sockClient) {
+	ws := sc.ws
+	defer func() {
+		close(sc.done)
+		ws.Close()
+	}()
+
+	ws.SetReadLimit(maxClientMessage)
 	ws.SetReadDeadline(time.Now().Add(pongWait))
 	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	// for now, we ignore all messages from the frontend
 	for {
-		_, _, err := ws.ReadMessage()
+		_, msg, err := ws.ReadMessage()
 		if err != nil {
 			break
 		}
+
+		var cm clientMessage
+		if err := json.Unmarshal(msg, &cm); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"system": "webapp",
+				"err":    err,
+			}).Debug("Ignoring malformed message from websocket client")
+			continue
+		}
+
+		switch cm.Type {
+		case "subscribe", "unsubscribe":
+			var sub *subscription
+			if cm.Type == "subscribe" && cm.Filter != nil {
+				err := cm.Filter.Vertex.Validate()
+				if err == nil {
+					err = cm.Filter.Edge.Validate()
+				}
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"system": "webapp",
+						"err":    err,
+					}).Debug("Ignoring invalid subscription from websocket client")
+					continue
+				}
+				sub = cm.Filter
+			}
+
+			// Only the most recent subscription matters; replace any pending one
+			select {
+			case <-sc.subs:
+			default:
+			}
+			sc.subs <- sub
+		case "resync":
+			// Coalesce multiple pending requests into a single resync
+			select {
+			case sc.resync <- struct{}{}:
+			default:
+			}
+		default:
+			logrus.WithFields(logrus.Fields{
+				"system": "webapp",
+				"type":   cm.Type,
+			}).Debug("Ignoring unknown message type from websocket client")
+		}
 	}
 }
 
-func wsWriter(ws *websocket.Conn) {
+func wsWriter(sc *sockClient) {
 	graphIn := broker.Get().Subscribe()
 	pingTicker := time.NewTicker(pingPeriod)
 	defer func() {
 		pingTicker.Stop()
 		broker.Get().Unsubscribe(graphIn)
-		ws.Close()
+		sc.ws.Close()
 	}()
 
+	// The latest graph, and the subgraph of it last sent to the client
+	var last, sent system.CoreGraph
+	var sub *subscription
+	sendFull := func() {
+		sent = sub.apply(last)
+		if sc.proto == protoDelta {
+			frameToSock(sc.ws, fullFrame(sent))
+		} else {
+			graphToSock(sc.ws, sent)
+		}
+	}
+
 	// write the current graph state first, before entering loop
-	graphToSock(ws, latestGraph)
-	var g system.CoreGraph
+	last = latest()
+	sendFull()
+
 	for {
 		select {
+		case <-sc.done:
+			return
 		case <-pingTicker.C:
 			// ensure client connection is healthy
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			sc.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := sc.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
-		case g = <-graphIn:
-			graphToSock(ws, g)
+		case <-sc.resync:
+			sendFull()
+		case sub = <-sc.subs:
+			sendFull()
+		case last = <-graphIn:
+			view := sub.apply(last)
+			if sc.proto == protoDelta && sub == nil {
+				deltaToSock(sc.ws, sent, view)
+			} else if sc.proto == protoDelta {
+				frameToSock(sc.ws, deltaFrame(sent, view))
+			} else {
+				graphToSock(sc.ws, view)
+			}
+			sent = view
 		}
 	}
 }
@@ -190,6 +670,36 @@ func graphToSock(ws *websocket.Conn, g system.CoreGraph) {
 		}).Error("Error while marshaling graph into JSON for transmission over websocket")
 	}
 
+	writeToSock(ws, j)
+}
+
+func frameToSock(ws *websocket.Conn, frame interface{}) {
+	j, err := json.Marshal(frame)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system": "webapp",
+			"err":    err,
+		}).Error("Error while marshaling frame into JSON for transmission over websocket")
+	}
+
+	writeToSock(ws, j)
+}
+
+// deltaToSock writes the delta frame between the two graphs to a client
+// without a subscription; see sharedDeltaJSON.
+func deltaToSock(ws *websocket.Conn, from, to system.CoreGraph) {
+	j, err := sharedDeltaJSON(from, to)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"system": "webapp",
+			"err":    err,
+		}).Error("Error while marshaling frame into JSON for transmission over websocket")
+	}
+
+	writeToSock(ws, j)
+}
+
+func writeToSock(ws *websocket.Conn, j []byte) {
 	if j != nil {
 		ws.SetWriteDeadline(time.Now().Add(writeWait))
 		if err := ws.WriteMessage(websocket.TextMessage, j); err != nil {
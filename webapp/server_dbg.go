@@ -2,9 +2,12 @@
 
 package webapp
 
-import "expvar"
+import (
+	"expvar"
+	"sync/atomic"
+)
 
 func init() {
 	// Publish count of websocket clients
-	expvar.Publish("WebsockClients", expvar.Func(func() interface{} { return clientCount }))
+	expvar.Publish("WebsockClients", expvar.Func(func() interface{} { return atomic.LoadInt64(&clientCount) }))
 }
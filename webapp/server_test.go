@@ -0,0 +1,280 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/zenazn/goji/web"
+	"github.com/pipeviz/pipeviz/history"
+	"github.com/pipeviz/pipeviz/mlog"
+	"github.com/pipeviz/pipeviz/mlog/mem"
+	"github.com/pipeviz/pipeviz/represent"
+)
+
+// Fixture records are timestamped an hour apart, starting from the epoch.
+var epoch = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func recordTime(id uint64) time.Time {
+	return epoch.Add(time.Duration(id) * time.Hour)
+}
+
+// newTestMux sets up the webapp's mux over a mlog containing the ein
+// fixtures, with the latest graph built from all of them.
+func newTestMux(t *testing.T) *web.Mux {
+	j := mem.NewMemStore()
+	for i := 1; i <= 8; i++ {
+		path := fmt.Sprintf("../fixtures/ein/%v.json", i)
+		f, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("json fnf: " + path)
+		}
+
+		rec, _ := j.NewEntry(f, "127.0.0.1", "")
+		ts := recordTime(rec.Index)
+		rec.TimeSec, rec.TimeNSec = ts.Unix(), int64(ts.Nanosecond())
+	}
+
+	hb := history.NewBuilder(j, nil)
+	g, err := hb.AtMsgID(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLatest(g)
+
+	m := web.New()
+	m.Use(func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.Env == nil {
+				c.Env = make(map[interface{}]interface{})
+			}
+			c.Env["mlogGet"] = mlog.RecordGetter(j.Get)
+			c.Env["history"] = hb
+			h.ServeHTTP(w, r)
+		})
+	})
+	RegisterToMux(m)
+	return m
+}
+
+func get(m *web.Mux, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+// decodeStrict decodes the body into v, failing on any fields v lacks.
+func decodeStrict(t *testing.T, url string, body []byte, v interface{}) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		t.Errorf("%s: body did not match expected shape: %s", url, err)
+	}
+}
+
+func TestGraphFromRequest(t *testing.T) {
+	m := newTestMux(t)
+
+	tt := []struct {
+		query  string
+		status int
+		msgid  uint64
+	}{
+		{"", 200, 8},
+		{"msgid=3", 200, 3},
+		{"msgid=8", 200, 8},
+		{"msgid=0", 200, 0},
+		{"msgid=9", 404, 0},
+		{"msgid=abc", 400, 0},
+		{"msgid=-1", 400, 0},
+		{"msgid=3&at=0", 400, 0},
+		{"at=" + recordTime(3).Format(time.RFC3339), 200, 3},
+		{"at=" + recordTime(5).Add(30*time.Minute).Format(time.RFC3339Nano), 200, 5},
+		{"at=" + strconv.FormatInt(recordTime(6).Unix(), 10), 200, 6},
+		{"at=" + recordTime(0).Format(time.RFC3339), 200, 0},
+		{"at=" + recordTime(100).Format(time.RFC3339), 200, 8},
+		{"at=yesterday", 400, 0},
+		{"at=2015-06-01", 400, 0},
+	}
+
+	for _, c := range tt {
+		url := "/graph?" + c.query
+		w := get(m, url)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %v, got %v (%s)", url, c.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+
+		var g struct {
+			Id       uint64        `json:"id"`
+			Vertices []interface{} `json:"vertices"`
+		}
+		decodeStrict(t, url, w.Body.Bytes(), &g)
+		if g.Id != c.msgid {
+			t.Errorf("%s: expected graph at msgid %v, got %v", url, c.msgid, g.Id)
+		}
+		if (len(g.Vertices) == 0) != (c.msgid == 0) {
+			t.Errorf("%s: unexpected number of vertices for msgid %v: %v", url, c.msgid, len(g.Vertices))
+		}
+	}
+}
+
+func TestGetDiff(t *testing.T) {
+	m := newTestMux(t)
+
+	tt := []struct {
+		query    string
+		status   int
+		from, to uint64
+	}{
+		{"from=2&to=3", 200, 2, 3},
+		{"from=3&to=2", 200, 3, 2},
+		{"from=5", 200, 5, 8},
+		{"from=0&to=8", 200, 0, 8},
+		{"", 400, 0, 0},
+		{"from=abc", 400, 0, 0},
+		{"from=-1", 400, 0, 0},
+		{"from=1&to=x", 400, 0, 0},
+		{"from=9", 404, 0, 0},
+		{"from=1&to=9", 404, 0, 0},
+	}
+
+	for _, c := range tt {
+		url := "/diff?" + c.query
+		w := get(m, url)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %v, got %v (%s)", url, c.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+
+		var d represent.GraphDiff
+		decodeStrict(t, url, w.Body.Bytes(), &d)
+		if d.From != c.from || d.To != c.to {
+			t.Errorf("%s: expected diff from %v to %v, got %v to %v", url, c.from, c.to, d.From, d.To)
+		}
+	}
+
+	// Message 3 resolves message 2's version edges; the reverse removes them
+	var fwd, rev represent.GraphDiff
+	json.Unmarshal(get(m, "/diff?from=2&to=3").Body.Bytes(), &fwd)
+	json.Unmarshal(get(m, "/diff?from=3&to=2").Body.Bytes(), &rev)
+	if len(fwd.EdgesAdded) == 0 || len(fwd.EdgesAdded) != len(rev.EdgesRemoved) {
+		t.Errorf("Expected edges added from 2 to 3 to be removed from 3 to 2, got %v and %v", len(fwd.EdgesAdded), len(rev.EdgesRemoved))
+	}
+}
+
+func TestGetOrphans(t *testing.T) {
+	m := newTestMux(t)
+
+	tt := []struct {
+		query  string
+		status int
+		msgid  uint64
+		// Number of messages merged since message 2, where the orphans originate
+		age uint64
+	}{
+		{"msgid=2", 200, 2, 0},
+		{"at=" + recordTime(2).Format(time.RFC3339), 200, 2, 0},
+		{"msgid=3", 200, 3, 1},
+		{"at=" + recordTime(0).Format(time.RFC3339), 200, 0, 0},
+		{"msgid=9", 404, 0, 0},
+		{"msgid=two", 400, 0, 0},
+		{"at=never", 400, 0, 0},
+	}
+
+	counts := make(map[uint64]int)
+	for _, c := range tt {
+		url := "/orphans?" + c.query
+		w := get(m, url)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %v, got %v (%s)", url, c.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+
+		var o struct {
+			ID      uint64             `json:"id"`
+			Orphans []represent.Orphan `json:"orphans"`
+		}
+		decodeStrict(t, url, w.Body.Bytes(), &o)
+		if o.ID != c.msgid {
+			t.Errorf("%s: expected orphans as of msgid %v, got %v", url, c.msgid, o.ID)
+		}
+		if o.Orphans == nil {
+			t.Errorf("%s: expected orphans to be an array, even if empty", url)
+		}
+		for _, orphan := range o.Orphans {
+			if orphan.MsgID != 2 || orphan.Age != c.age || orphan.Time == nil || !orphan.Time.Equal(recordTime(2)) {
+				t.Errorf("%s: expected orphan from message 2, received at %v, aged %v; got %+v", url, recordTime(2), c.age, orphan)
+			}
+		}
+		counts[o.ID] = len(o.Orphans)
+	}
+
+	// Message 3 supplies the commits some of message 2's edges point to
+	if counts[0] != 0 || counts[2] == 0 || counts[3] >= counts[2] {
+		t.Errorf("Expected no orphans in an empty graph, and fewer after message 3 than 2; got %v", counts)
+	}
+}
+
+func TestGetMessageEffects(t *testing.T) {
+	m := newTestMux(t)
+
+	tt := []struct {
+		path   string
+		status int
+	}{
+		{"/message/2/effects", 200},
+		{"/message/3/effects", 200},
+		{"/message/8/effects", 200},
+		{"/message/0/effects", 404},
+		{"/message/9/effects", 404},
+		{"/message/abc/effects", 400},
+		{"/message/-1/effects", 400},
+	}
+
+	for _, c := range tt {
+		w := get(m, c.path)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %v, got %v (%s)", c.path, c.status, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+
+		var e history.Effects
+		decodeStrict(t, c.path, w.Body.Bytes(), &e)
+		if e.To == 0 || e.From != e.To-1 {
+			t.Errorf("%s: expected effects to span a single message, got %v to %v", c.path, e.From, e.To)
+		}
+		if e.Orphans == nil {
+			t.Errorf("%s: expected orphans to be an array, even if empty", c.path)
+		}
+	}
+
+	// Message 2 leaves orphans; message 3 resolves some of them
+	var e2, e3 history.Effects
+	json.Unmarshal(get(m, "/message/2/effects").Body.Bytes(), &e2)
+	json.Unmarshal(get(m, "/message/3/effects").Body.Bytes(), &e3)
+	if len(e2.VerticesAdded) == 0 || len(e2.Orphans) == 0 {
+		t.Errorf("Expected message 2 to add vertices and leave orphans, got %v and %v", len(e2.VerticesAdded), len(e2.Orphans))
+	}
+	if len(e3.EdgesAdded) == 0 || len(e3.Orphans) != 0 {
+		t.Errorf("Expected message 3 to add edges and leave no orphans of its own, got %v and %v", len(e3.EdgesAdded), len(e3.Orphans))
+	}
+}
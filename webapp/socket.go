@@ -0,0 +1,244 @@
+package webapp
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// Websocket protocol versions. Clients select one with the proto query
+// parameter when opening /sock.
+const (
+	// protoFull (version 1, the default) sends the entire graph, as produced
+	// by graphToJSON, every time a message is merged.
+	protoFull = 1 + iota
+
+	// protoDelta (version 2) sends the entire graph once, as a "full" frame,
+	// then sends a "delta" frame containing only what changed each time a
+	// message is merged. Vertices in a delta frame take the same form as in a
+	// full frame, edges included, so each upserted vertex simply replaces any
+	// the client already holds with the same id. Each delta frame carries
+	// both the msgid it applies on top of (from) and the msgid it produces
+	// (id); a client that sees a from that does not match the last id it
+	// applied has missed something, and should send a resync message to
+	// receive a new full frame:
+	//
+	//  {"type": "resync"}
+	protoDelta
+)
+
+// Clients on either protocol may restrict the graph data they receive by
+// sending a subscription message. A subscription selects all vertices that
+// match the vertex filter, plus all vertices adjacent to those via edges that
+// match the edge filter; both filters are optional, and an empty filter
+// matches everything. For example:
+//
+//  {"type": "subscribe", "filter": {
+//      "vertex": {"vtype": "environment", "props": {"hostname": "prod-web01"}},
+//      "edge": {"etype": "envlink"}
+//  }}
+//
+// Only the selected vertices, and the edges between them, are sent. On
+// receipt of a subscription, the server immediately sends a full frame
+// (protoDelta) or full graph (protoFull) restricted to the new filter.
+// Sending {"type": "unsubscribe"} removes the filter.
+//
+// The filters are the same as those used in the query language; see
+// q.VertexMatch and q.EdgeMatch.
+
+// maxClientMessage is the largest message a client may send over the websocket.
+const maxClientMessage = 8 << 10
+
+// sockClient holds the state associated with a single websocket connection.
+type sockClient struct {
+	ws    *websocket.Conn
+	proto int
+	// signals the writer to send a full frame
+	resync chan struct{}
+	// passes new subscriptions to the writer; nil clears the subscription
+	subs chan *subscription
+	// closed by the reader when the connection is done
+	done chan struct{}
+}
+
+// clientMessage is a message sent from the client over the websocket.
+type clientMessage struct {
+	Type   string        `json:"type"`
+	Filter *subscription `json:"filter"`
+}
+
+// subscription describes the subgraph a client is interested in.
+type subscription struct {
+	Vertex q.VertexMatch `json:"vertex"`
+	Edge   q.EdgeMatch   `json:"edge"`
+}
+
+// apply returns the subgraph of the provided graph selected by the
+// subscription. A nil subscription selects the entire graph.
+func (s *subscription) apply(g system.CoreGraph) system.CoreGraph {
+	if s == nil {
+		return g
+	}
+
+	ef := s.Edge.Filter()
+
+	var ids []uint64
+	for _, vt := range g.VerticesWith(s.Vertex.Filter()) {
+		ids = append(ids, vt.ID)
+		for _, adj := range g.SuccessorsWith(vt.ID, ef) {
+			ids = append(ids, adj.ID)
+		}
+		for _, adj := range g.PredecessorsWith(vt.ID, ef) {
+			ids = append(ids, adj.ID)
+		}
+	}
+
+	return represent.Subgraph(g, ids)
+}
+
+type graphFrame struct {
+	Type     string        `json:"type"`
+	Id       uint64        `json:"id"`
+	Vertices []interface{} `json:"vertices"`
+}
+
+type changeFrame struct {
+	Type     string      `json:"type"`
+	From     uint64      `json:"from"`
+	Id       uint64      `json:"id"`
+	Vertices vertexDelta `json:"vertices"`
+	Edges    edgeDelta   `json:"edges"`
+}
+
+// vertexDelta contains the complete current state, in the same form as in a
+// full frame, of all vertices that were added or changed, or whose edges
+// changed, and the IDs of all vertices that were removed.
+type vertexDelta struct {
+	Upsert []interface{} `json:"upsert"`
+	Delete []uint64      `json:"delete"`
+}
+
+// edgeDelta contains the complete current state of all edges that were
+// added or changed, and the IDs of all edges that were removed.
+type edgeDelta struct {
+	Upsert []represent.DiffEdge `json:"upsert"`
+	Delete []uint64             `json:"delete"`
+}
+
+// fullFrame creates a frame containing the entire graph, for protoDelta.
+func fullFrame(g system.CoreGraph) graphFrame {
+	f := graphFrame{
+		Type:     "full",
+		Id:       g.MsgID(),
+		Vertices: make([]interface{}, 0),
+	}
+
+	for _, v := range g.VerticesWith(q.Qbv(system.VTypeNone)) {
+		f.Vertices = append(f.Vertices, flatVertex(g, v))
+	}
+
+	return f
+}
+
+// sharedDelta holds the delta frame, marshaled to JSON, most recently sent to
+// clients without a subscription. Those clients are all sent the same graphs,
+// so each frame need only be computed once per merge, rather than once per
+// client.
+var sharedDelta struct {
+	sync.Mutex
+	from, to system.CoreGraph
+	j        []byte
+}
+
+// sharedDeltaJSON returns the delta frame between the from and to graphs,
+// marshaled to JSON, for clients without a subscription. The frame is reused
+// for as long as the graphs are the same.
+func sharedDeltaJSON(from, to system.CoreGraph) ([]byte, error) {
+	sharedDelta.Lock()
+	defer sharedDelta.Unlock()
+
+	if sharedDelta.j != nil && sharedDelta.from == from && sharedDelta.to == to {
+		return sharedDelta.j, nil
+	}
+
+	j, err := json.Marshal(deltaFrame(from, to))
+	if err != nil {
+		return nil, err
+	}
+	sharedDelta.from, sharedDelta.to, sharedDelta.j = from, to, j
+	return j, nil
+}
+
+// deltaFrame creates a frame containing the changes needed to transform the
+// from graph into the to graph, for protoDelta.
+func deltaFrame(from, to system.CoreGraph) changeFrame {
+	d := represent.Diff(from, to)
+	f := changeFrame{
+		Type: "delta",
+		From: d.From,
+		Id:   d.To,
+		Vertices: vertexDelta{
+			Upsert: make([]interface{}, 0, len(d.VerticesAdded)+len(d.VerticesChanged)),
+			Delete: make([]uint64, 0, len(d.VerticesRemoved)),
+		},
+		Edges: edgeDelta{
+			Upsert: append(make([]represent.DiffEdge, 0, len(d.EdgesAdded)+len(d.EdgesChanged)), d.EdgesAdded...),
+			Delete: make([]uint64, 0, len(d.EdgesRemoved)),
+		},
+	}
+
+	upserted := make(map[uint64]struct{})
+	upsert := func(vid uint64) {
+		if _, done := upserted[vid]; done {
+			return
+		}
+		vt, err := to.Get(vid)
+		if err != nil {
+			return // removed along with the edge
+		}
+		upserted[vid] = struct{}{}
+		f.Vertices.Upsert = append(f.Vertices.Upsert, flatVertex(to, vt))
+	}
+
+	for _, dv := range d.VerticesAdded {
+		upsert(dv.ID)
+	}
+	for _, vc := range d.VerticesChanged {
+		upsert(vc.ID)
+	}
+
+	// A vertex's edges are sent along with it, so the endpoints of any edge
+	// that changed must be sent again, too
+	for _, edges := range [][]represent.DiffEdge{d.EdgesAdded, d.EdgesChanged, d.EdgesRemoved} {
+		for _, e := range edges {
+			upsert(e.Source)
+			upsert(e.Target)
+		}
+	}
+
+	// Vertices can go stale without changing, purely because time has passed
+	for vtype, p := range represent.VertexTTLs {
+		if p.Stale == 0 {
+			continue
+		}
+		for _, vt := range to.VerticesWith(q.Qbv(vtype)) {
+			if represent.IsStale(from, vt.ID) != represent.IsStale(to, vt.ID) {
+				upsert(vt.ID)
+			}
+		}
+	}
+	f.Edges.Upsert = append(f.Edges.Upsert, d.EdgesChanged...)
+
+	for _, v := range d.VerticesRemoved {
+		f.Vertices.Delete = append(f.Vertices.Delete, v.ID)
+	}
+	for _, e := range d.EdgesRemoved {
+		f.Edges.Delete = append(f.Edges.Delete, e.ID)
+	}
+
+	return f
+}
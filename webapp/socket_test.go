@@ -0,0 +1,279 @@
+package webapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pipeviz/pipeviz/Godeps/_workspace/src/github.com/gorilla/websocket"
+	"github.com/pipeviz/pipeviz/broker"
+	"github.com/pipeviz/pipeviz/ingest"
+	"github.com/pipeviz/pipeviz/represent"
+	"github.com/pipeviz/pipeviz/represent/q"
+	"github.com/pipeviz/pipeviz/types/system"
+)
+
+// feed publishes graphs to the broker, as the interpreter would.
+var feed = make(chan system.CoreGraph)
+
+func init() {
+	broker.Get().Fanout(feed)
+}
+
+// merge merges a JSON message into the graph with the given msgid.
+func merge(t *testing.T, g system.CoreGraph, id uint64, msg string) system.CoreGraph {
+	m := ingest.Message{}
+	if err := json.Unmarshal([]byte(msg), &m); err != nil {
+		t.Fatal(err)
+	}
+	return g.Merge(id, m.UnificationForm())
+}
+
+// testFrame holds any frame sent over the websocket, on either protocol.
+type testFrame struct {
+	Type     string          `json:"type"`
+	From     uint64          `json:"from"`
+	Id       uint64          `json:"id"`
+	Vertices json.RawMessage `json:"vertices"`
+}
+
+type testDelta struct {
+	Upsert []json.RawMessage `json:"upsert"`
+	Delete []uint64          `json:"delete"`
+}
+
+// openTestSocket opens a websocket to a test server, with the given query.
+func openTestSocket(t *testing.T, query string) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(openSocket))
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal("Failed to open websocket:", err)
+	}
+	return ws, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func readFrame(t *testing.T, ws *websocket.Conn) testFrame {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var f testFrame
+	if err := ws.ReadJSON(&f); err != nil {
+		t.Fatal("Failed to read frame from websocket:", err)
+	}
+	return f
+}
+
+func sendMessage(t *testing.T, ws *websocket.Conn, msg string) {
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal("Failed to write to websocket:", err)
+	}
+}
+
+// vertexSet holds vertices, as sent over the websocket, by id.
+type vertexSet map[uint64]interface{}
+
+func (vs vertexSet) upsert(t *testing.T, raw []json.RawMessage) {
+	for _, r := range raw {
+		var v struct {
+			ID uint64 `json:"id"`
+		}
+		var whole interface{}
+		if err := json.Unmarshal(r, &v); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(r, &whole)
+		vs[v.ID] = whole
+	}
+}
+
+// fullSet reads the vertices out of a full frame, or a legacy push.
+func fullSet(t *testing.T, f testFrame) vertexSet {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(f.Vertices, &raw); err != nil {
+		t.Fatal("Failed to decode vertices:", err)
+	}
+	vs := make(vertexSet)
+	vs.upsert(t, raw)
+	return vs
+}
+
+// apply applies a delta frame to the vertices.
+func (vs vertexSet) apply(t *testing.T, f testFrame) {
+	var d testDelta
+	if err := json.Unmarshal(f.Vertices, &d); err != nil {
+		t.Fatal("Failed to decode delta:", err)
+	}
+	vs.upsert(t, d.Upsert)
+	for _, id := range d.Delete {
+		delete(vs, id)
+	}
+}
+
+// expectedSet is the set of vertices a client should hold for the graph.
+func expectedSet(t *testing.T, g system.CoreGraph) vertexSet {
+	j, _ := json.Marshal(fullFrame(g))
+	var f testFrame
+	json.Unmarshal(j, &f)
+	return fullSet(t, f)
+}
+
+func TestSocketDelta(t *testing.T) {
+	g1 := merge(t, represent.NewGraph(), 1, `{"environments": [{"address": {"hostname": "a"}}]}`)
+	g2 := merge(t, g1, 2, `{"environments": [{"address": {"hostname": "a"}, "logic-states": [{"path": "/a"}]}]}`)
+	g3 := merge(t, g2, 3, `{"environments": [{"address": {"hostname": "b"}}]}`)
+	g4 := merge(t, g3, 4, `{"environments": [{"address": {"hostname": "c"}}]}`)
+	setLatest(g1)
+
+	ws, done := openTestSocket(t, "proto=2")
+	defer done()
+
+	f := readFrame(t, ws)
+	if f.Type != "full" || f.Id != 1 {
+		t.Fatalf("Expected full frame for msgid 1, got %q for %v", f.Type, f.Id)
+	}
+	state := fullSet(t, f)
+	if !reflect.DeepEqual(state, expectedSet(t, g1)) {
+		t.Errorf("Full frame did not contain the graph's vertices: %v", state)
+	}
+
+	// The new logic state links to the existing environment, so both must
+	// be sent, with their edges, for the delta to apply cleanly.
+	feed <- g2
+	f = readFrame(t, ws)
+	if f.Type != "delta" || f.From != 1 || f.Id != 2 {
+		t.Fatalf("Expected delta frame from 1 to 2, got %q from %v to %v", f.Type, f.From, f.Id)
+	}
+	state.apply(t, f)
+	if !reflect.DeepEqual(state, expectedSet(t, g2)) {
+		t.Errorf("Applying delta to full frame did not produce the new graph:\ngot  %v\nwant %v", state, expectedSet(t, g2))
+	}
+
+	// Lose a frame, as a client might when it falls behind
+	feed <- g3
+	readFrame(t, ws)
+	feed <- g4
+	f = readFrame(t, ws)
+	if f.Type != "delta" || f.From != 3 {
+		t.Fatalf("Expected delta frame from 3, got %q from %v", f.Type, f.From)
+	}
+	// The client last applied 2, so it knows it missed something
+
+	sendMessage(t, ws, `{"type": "resync"}`)
+	f = readFrame(t, ws)
+	if f.Type != "full" || f.Id != 4 {
+		t.Fatalf("Expected full frame for msgid 4 after resync, got %q for %v", f.Type, f.Id)
+	}
+	if state = fullSet(t, f); !reflect.DeepEqual(state, expectedSet(t, g4)) {
+		t.Errorf("Full frame after resync did not contain the graph's vertices: %v", state)
+	}
+}
+
+func TestSocketLegacy(t *testing.T) {
+	g1 := merge(t, represent.NewGraph(), 1, `{"environments": [{"address": {"hostname": "a"}}]}`)
+	g2 := merge(t, g1, 2, `{"environments": [{"address": {"hostname": "b"}}]}`)
+	setLatest(g1)
+
+	ws, done := openTestSocket(t, "")
+	defer done()
+
+	for _, g := range []system.CoreGraph{g1, g2} {
+		if g != g1 {
+			feed <- g
+		}
+		f := readFrame(t, ws)
+		if f.Type != "" || f.Id != g.MsgID() {
+			t.Fatalf("Expected legacy full push for msgid %v, got type %q for %v", g.MsgID(), f.Type, f.Id)
+		}
+		if vs := fullSet(t, f); !reflect.DeepEqual(vs, expectedSet(t, g)) {
+			t.Errorf("Legacy push for msgid %v did not contain the whole graph: %v", g.MsgID(), vs)
+		}
+	}
+}
+
+// hostnames collects the hostnames of the environments in the set.
+func (vs vertexSet) hostnames() []string {
+	var hosts []string
+	for _, v := range vs {
+		vertex := v.(map[string]interface{})["vertex"].(map[string]interface{})
+		if vertex["type"] != "environment" {
+			continue
+		}
+		props := vertex["properties"].(map[string]interface{})
+		hosts = append(hosts, props["hostname"].(map[string]interface{})["value"].(string))
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestSocketSubscription(t *testing.T) {
+	g1 := merge(t, represent.NewGraph(), 1, `{"environments": [{"address": {"hostname": "a"}}, {"address": {"hostname": "b"}}]}`)
+	g2 := merge(t, g1, 2, `{"environments": [{"address": {"hostname": "a"}, "logic-states": [{"path": "/a"}]}]}`)
+	g3 := merge(t, g2, 3, `{"environments": [{"address": {"hostname": "b"}, "logic-states": [{"path": "/b"}]}]}`)
+	setLatest(g1)
+
+	ws, done := openTestSocket(t, "proto=2")
+	defer done()
+	readFrame(t, ws)
+
+	sendMessage(t, ws, `{"type": "subscribe", "filter": {"vertex": {"vtype": "environment", "props": {"hostname": "b"}}}}`)
+	f := readFrame(t, ws)
+	if f.Type != "full" || f.Id != 1 {
+		t.Fatalf("Expected full frame for msgid 1 on subscribing, got %q for %v", f.Type, f.Id)
+	}
+	state := fullSet(t, f)
+	if len(state) != 1 || !reflect.DeepEqual(state.hostnames(), []string{"b"}) {
+		t.Errorf("Expected subscribed full frame to contain only environment b, got %v", state)
+	}
+
+	// A logic state in environment a is outside the subscription
+	feed <- g2
+	f = readFrame(t, ws)
+	state.apply(t, f)
+	if f.Type != "delta" || f.From != 1 || f.Id != 2 || len(state) != 1 {
+		t.Errorf("Expected empty delta from 1 to 2, got %q from %v to %v leaving %v", f.Type, f.From, f.Id, state)
+	}
+
+	// One in environment b is adjacent to it, so within the subscription
+	feed <- g3
+	state.apply(t, readFrame(t, ws))
+	sub := (&subscription{Vertex: q.VertexMatch{VType: "environment", Props: map[string]interface{}{"hostname": "b"}}}).apply(g3)
+	if len(state) != 2 || !reflect.DeepEqual(state, expectedSet(t, sub)) {
+		t.Errorf("Expected delta to add the logic state in environment b, got %v", state)
+	}
+
+	sendMessage(t, ws, `{"type": "unsubscribe"}`)
+	f = readFrame(t, ws)
+	if f.Type != "full" || f.Id != 3 {
+		t.Fatalf("Expected full frame for msgid 3 on unsubscribing, got %q for %v", f.Type, f.Id)
+	}
+	if state = fullSet(t, f); !reflect.DeepEqual(state, expectedSet(t, g3)) {
+		t.Errorf("Expected the whole graph after unsubscribing, got %v", state)
+	}
+}
+
+func TestSharedDelta(t *testing.T) {
+	g1 := merge(t, represent.NewGraph(), 1, `{"environments": [{"address": {"hostname": "a"}}]}`)
+	g2 := merge(t, g1, 2, `{"environments": [{"address": {"hostname": "b"}}]}`)
+	g3 := merge(t, g2, 3, `{"environments": [{"address": {"hostname": "c"}}]}`)
+
+	j1, _ := sharedDeltaJSON(g1, g2)
+	expect, _ := json.Marshal(deltaFrame(g1, g2))
+	if string(j1) != string(expect) {
+		t.Errorf("Expected shared delta to match the delta frame, got %s", j1)
+	}
+
+	// Every client without a subscription is sent the same frame
+	if j, _ := sharedDeltaJSON(g1, g2); &j[0] != &j1[0] {
+		t.Error("Expected the delta between the same graphs to be reused")
+	}
+	if j, _ := sharedDeltaJSON(g2, g3); string(j) == string(j1) {
+		t.Error("Expected a new delta once the graphs change")
+	}
+}